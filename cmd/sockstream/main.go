@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	"net/url"
@@ -12,18 +15,20 @@ import (
 	"strings"
 	"syscall"
 
-	"sockstream/internal/config"
-	"sockstream/internal/proxy"
-	"sockstream/internal/server"
-)
+	"gopkg.in/yaml.v3"
 
-var version = "dev"
+	"github.com/foxzi/SockStream/internal/buildinfo"
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/logging"
+	"github.com/foxzi/SockStream/internal/proxy"
+	"github.com/foxzi/SockStream/internal/server"
+)
 
 func main() {
 	flags := parseFlags()
 
 	if flags.showVersion {
-		fmt.Println("sockstream", version)
+		fmt.Println(buildinfo.Get())
 		os.Exit(0)
 	}
 
@@ -48,56 +53,138 @@ func main() {
 		DisableRewriteHost: flags.disableRewriteHost,
 	}
 
-	cfg, err := config.Load(flags.configPath, "SOCKSTREAM", overrides)
+	cfg, err := config.Load(configPath(flags), "SOCKSTREAM", overrides)
 	if err != nil {
 		slog.Error("failed to load config", "error", err)
 		os.Exit(1)
 	}
 
-	targetURL, err := url.Parse(cfg.Target)
-	if err != nil {
-		slog.Error("invalid target url", "error", err)
-		os.Exit(1)
+	if flags.printConfig {
+		if err := printConfig(cfg); err != nil {
+			slog.Error("failed to print config", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	forwardMode := strings.EqualFold(cfg.Mode, "forward")
+	var targetURL *url.URL
+	if !forwardMode {
+		// Already validated by config.Load
+		targetURL, _ = url.Parse(cfg.Target)
 	}
 
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+	var logOut io.Writer = os.Stdout
+	if cfg.Logging.File != "" {
+		f, err := logging.NewRotatingFile(cfg.Logging.File, cfg.Logging.MaxSizeMB, cfg.Logging.MaxBackups, cfg.Logging.MaxAgeDays)
+		if err != nil {
+			slog.Error("failed to open log file", "error", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		logOut = f
+	}
+	logger := slog.New(slog.NewJSONHandler(logOut, &slog.HandlerOptions{
 		Level: parseLogLevel(cfg.Logging.Level),
 	}))
+	slog.SetDefault(logger)
+	build := buildinfo.Get()
+	logger.Info("sockstream starting", "version", build.Version, "commit", build.Commit,
+		"build_date", build.BuildDate, "go_version", build.GoVersion)
 
+	if strings.EqualFold(cfg.Mode, "grpc") {
+		// gRPC needs HTTP/2 end to end; never downgrade to HTTP/1.1 upstream
+		cfg.Proxy.Transport.HTTP2Only = true
+	}
+	cfg.Proxy.Transport.TLSFingerprint = cfg.TLS.Fingerprint
+	cfg.Proxy.Security = cfg.Security
+	if cfg.Proxy.HealthCheck.WarmUpURL == "" {
+		// Validation requires warm_up_url in forward mode; named pools
+		// inherit it along with the settings above
+		cfg.Proxy.HealthCheck.WarmUpURL = cfg.Target
+	}
 	proxyPool, err := proxy.NewProxyPool(cfg.Proxy)
 	if err != nil {
 		logger.Error("failed to create proxy pool", "error", err)
 		os.Exit(1)
 	}
 	proxyPool.SetLogger(logger)
+	proxyPool.SetTargetServerName(cfg.TLS.ServerName)
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
 	// Start health check for proxy pool
-	if len(cfg.Proxy.URLs) > 0 || (cfg.Proxy.Type != "" && cfg.Proxy.Type != "direct") {
-		logger.Info("starting proxy health check", "count", proxyPool.Size(), "rotation", cfg.Proxy.Rotation)
+	if len(cfg.Proxy.URLs) > 0 || len(cfg.Proxy.Groups) > 0 || len(cfg.Proxy.Pools) > 0 ||
+		(cfg.Proxy.Type != "" && cfg.Proxy.Type != "direct") {
+		logger.Info("starting proxy health check", "count", proxyPool.Size(), "rotation", cfg.Proxy.Rotation,
+			"pools", len(cfg.Proxy.Pools))
+		// The initial check completes before StartHealthCheck returns
 		proxyPool.StartHealthCheck(ctx)
 		defer proxyPool.Stop()
+		if cfg.Proxy.FailOnStartup && proxyPool.HealthyCount() == 0 {
+			logger.Error("no healthy proxies after startup check, exiting", "count", proxyPool.Size())
+			os.Exit(1)
+		}
+		for name, sub := range proxyPool.Pools() {
+			if cfg.Proxy.Pools[name].FailOnStartup && sub.HealthyCount() == 0 {
+				logger.Error("no healthy proxies after startup check, exiting", "pool", name, "count", sub.Size())
+				os.Exit(1)
+			}
+		}
 	}
 
-	reverseProxy := proxy.NewReverseProxy(targetURL, cfg, proxyPool, logger)
-	srv, err := server.New(cfg, logger, reverseProxy)
+	// In forward mode the server builds its own CONNECT handler
+	var proxyHandler http.Handler
+	if !forwardMode {
+		proxyHandler = proxy.NewReverseProxy(targetURL, cfg, proxyPool, logger)
+	}
+	srv, err := server.New(cfg, logger, proxyHandler, proxyPool)
 	if err != nil {
 		logger.Error("failed to init server", "error", err)
 		os.Exit(1)
 	}
 
-	logger.Info("starting server", "listen", cfg.Listen, "target", cfg.Target)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				logger.Info("received SIGHUP, reloading")
+				if newCfg, err := config.Load(configPath(flags), "SOCKSTREAM", overrides); err != nil {
+					logger.Error("failed to reload config", "error", err)
+				} else {
+					srv.SetMaintenance(newCfg.Maintenance.Enabled)
+				}
+				srv.Reload()
+			}
+		}
+	}()
+
+	if forwardMode {
+		logger.Info("starting forward proxy", "listen", cfg.Listen)
+		if cfg.OpenForward() {
+			logger.Warn("forward proxy is open: any client that reaches the listener can use it; set forward.username or access.allow", "listen", cfg.Listen)
+		}
+	} else {
+		logger.Info("starting server", "listen", cfg.Listen, "target", cfg.Target)
+	}
 	if len(cfg.Proxy.URLs) > 0 {
 		logger.Info("using proxy pool", "count", proxyPool.Size(), "healthy", proxyPool.HealthyCount())
 	} else if cfg.Proxy.Type != "" && cfg.Proxy.Type != "direct" {
 		logger.Info("using upstream proxy", "type", cfg.Proxy.Type, "address", cfg.Proxy.Address)
 	}
+	for name, sub := range proxyPool.Pools() {
+		logger.Info("using proxy pool", "pool", name, "count", sub.Size(), "healthy", sub.HealthyCount())
+	}
 	if cfg.TLS.HasCertificates() {
 		logger.Info("serving TLS with provided certificate")
 	} else if cfg.TLS.ACME.Enabled {
-		logger.Info("serving TLS via ACME", "domain", cfg.TLS.ACME.Domain)
+		logger.Info("serving TLS via ACME", "domains", cfg.TLS.ACME.AllDomains())
 	}
 
 	if err := srv.Start(ctx); err != nil && err != http.ErrServerClosed {
@@ -106,6 +193,20 @@ func main() {
 	}
 }
 
+// printConfig writes the effective config as YAML followed by the source of each set value.
+func printConfig(cfg config.Config) error {
+	data, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(data))
+	fmt.Println("# sources (unlisted values are defaults):")
+	for _, key := range cfg.Sources.Keys() {
+		fmt.Printf("#   %s: %s\n", key, cfg.Sources.Source(key))
+	}
+	return nil
+}
+
 func parseLogLevel(level string) slog.Level {
 	switch strings.ToLower(level) {
 	case "debug":
@@ -119,6 +220,19 @@ func parseLogLevel(level string) slog.Level {
 	}
 }
 
+// configPath returns the config file to load. With -config-optional a missing
+// file is skipped with a warning; a file that exists but is invalid still fails.
+func configPath(f cliFlags) string {
+	if !f.configOptional || f.configPath == "" {
+		return f.configPath
+	}
+	if _, err := os.Stat(f.configPath); errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("config file not found, continuing with defaults, env and flags", "path", f.configPath)
+		return ""
+	}
+	return f.configPath
+}
+
 type cliFlags struct {
 	configPath         string
 	listen             string
@@ -137,7 +251,9 @@ type cliFlags struct {
 	acmeEmail          string
 	acmeCache          string
 	disableRewriteHost bool
+	configOptional     bool
 	showVersion        bool
+	printConfig        bool
 }
 
 func parseFlags() cliFlags {
@@ -147,6 +263,7 @@ func parseFlags() cliFlags {
 	headerPairs := multiFlag{}
 
 	flag.StringVar(&f.configPath, "config", "", "path to config file (yaml or toml)")
+	flag.BoolVar(&f.configOptional, "config-optional", false, "continue with defaults, env and flags when the config file does not exist")
 	flag.StringVar(&f.listen, "listen", "", "listen address override")
 	flag.StringVar(&f.hostName, "host-name", "", "override Host header to this value")
 	flag.StringVar(&f.target, "target", "", "target URL to proxy to")
@@ -164,6 +281,7 @@ func parseFlags() cliFlags {
 	flag.StringVar(&f.acmeCache, "acme-cache", "", "ACME cache directory")
 	flag.BoolVar(&f.disableRewriteHost, "no-rewrite-host", false, "disable rewriting Host header to target")
 	flag.BoolVar(&f.showVersion, "version", false, "show version and exit")
+	flag.BoolVar(&f.printConfig, "print-config", false, "print effective config with value sources and exit")
 	flag.Parse()
 
 	f.allowCIDR = allowCIDR.values
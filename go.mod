@@ -1,14 +1,21 @@
-module sockstream
+module github.com/foxzi/SockStream
 
 go 1.24.0
 
 toolchain go1.24.11
 
 require (
+	github.com/Azure/go-ntlmssp v0.1.1
 	github.com/pelletier/go-toml/v2 v2.1.1
+	github.com/refraction-networking/utls v1.8.2
 	golang.org/x/crypto v0.46.0
 	golang.org/x/net v0.48.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/text v0.32.0 // indirect
+require (
+	github.com/andybalholm/brotli v1.0.6 // indirect
+	github.com/klauspost/compress v1.17.4 // indirect
+	golang.org/x/sys v0.39.0 // indirect
+	golang.org/x/text v0.32.0 // indirect
+)
@@ -0,0 +1,137 @@
+package acmedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+type cloudflare struct {
+	baseURL string
+	token   string
+	client  *http.Client
+
+	mu      sync.Mutex
+	records map[string]cloudflareRecord // fqdn|value -> created record
+}
+
+type cloudflareRecord struct {
+	zoneID string
+	id     string
+}
+
+type cloudflareResponse struct {
+	Success bool              `json:"success"`
+	Errors  []cloudflareError `json:"errors"`
+	Result  json.RawMessage   `json:"result"`
+}
+
+type cloudflareError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func newCloudflare(cfg config.CloudflareConfig, client *http.Client) *cloudflare {
+	return &cloudflare{
+		baseURL: cloudflareAPI,
+		token:   cfg.APIToken,
+		client:  client,
+		records: make(map[string]cloudflareRecord),
+	}
+}
+
+func (c *cloudflare) Present(ctx context.Context, fqdn, value string) error {
+	zoneID, err := c.findZone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	body := map[string]any{"type": "TXT", "name": fqdn, "content": value, "ttl": 120}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", body, &created); err != nil {
+		return fmt.Errorf("cloudflare create txt record %s: %w", fqdn, err)
+	}
+
+	c.mu.Lock()
+	c.records[fqdn+"|"+value] = cloudflareRecord{zoneID: zoneID, id: created.ID}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *cloudflare) CleanUp(ctx context.Context, fqdn, value string) error {
+	c.mu.Lock()
+	rec, ok := c.records[fqdn+"|"+value]
+	delete(c.records, fqdn+"|"+value)
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := c.do(ctx, http.MethodDelete, "/zones/"+rec.zoneID+"/dns_records/"+rec.id, nil, nil); err != nil {
+		return fmt.Errorf("cloudflare delete txt record %s: %w", fqdn, err)
+	}
+	return nil
+}
+
+// findZone walks up the record name until Cloudflare reports a matching zone.
+func (c *cloudflare) findZone(ctx context.Context, fqdn string) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	for i := 1; i < len(labels)-1; i++ {
+		name := strings.Join(labels[i:], ".")
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := c.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", fmt.Errorf("cloudflare lookup zone %s: %w", name, err)
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare zone not found for %s", fqdn)
+}
+
+func (c *cloudflare) do(ctx context.Context, method, path string, body, result any) error {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var out cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("decode response (status %d): %w", resp.StatusCode, err)
+	}
+	if !out.Success {
+		if len(out.Errors) > 0 {
+			return fmt.Errorf("api error %d: %s", out.Errors[0].Code, out.Errors[0].Message)
+		}
+		return fmt.Errorf("api request failed with status %d", resp.StatusCode)
+	}
+	if result != nil && len(out.Result) > 0 {
+		return json.Unmarshal(out.Result, result)
+	}
+	return nil
+}
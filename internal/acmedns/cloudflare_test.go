@@ -0,0 +1,74 @@
+package acmedns
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestCloudflare_PresentAndCleanUp(t *testing.T) {
+	var created, deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/zones":
+			// Only the apex is a zone
+			if r.URL.Query().Get("name") == "example.com" {
+				_, _ = w.Write([]byte(`{"success":true,"result":[{"id":"zone1"}]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"success":true,"result":[]}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/zones/zone1/dns_records":
+			var rec map[string]any
+			_ = json.NewDecoder(r.Body).Decode(&rec)
+			created = append(created, rec["name"].(string)+"="+rec["content"].(string))
+			_, _ = w.Write([]byte(`{"success":true,"result":{"id":"rec1"}}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/zones/zone1/dns_records/rec1":
+			deleted = append(deleted, "rec1")
+			_, _ = w.Write([]byte(`{"success":true,"result":{"id":"rec1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"success":false,"errors":[{"code":7003,"message":"not found"}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	cf := newCloudflare(config.CloudflareConfig{APIToken: "token"}, srv.Client())
+	cf.baseURL = srv.URL
+
+	ctx := context.Background()
+	if err := cf.Present(ctx, "_acme-challenge.www.example.com", "abc"); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	if len(created) != 1 || created[0] != "_acme-challenge.www.example.com=abc" {
+		t.Errorf("created = %v", created)
+	}
+	if err := cf.CleanUp(ctx, "_acme-challenge.www.example.com", "abc"); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if len(deleted) != 1 {
+		t.Errorf("deleted = %v", deleted)
+	}
+}
+
+func TestCloudflare_APIError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`))
+	}))
+	defer srv.Close()
+
+	cf := newCloudflare(config.CloudflareConfig{APIToken: "bad"}, srv.Client())
+	cf.baseURL = srv.URL
+
+	if err := cf.Present(context.Background(), "_acme-challenge.example.com", "abc"); err == nil {
+		t.Fatal("expected error for rejected token")
+	}
+}
@@ -0,0 +1,328 @@
+// Package acmedns obtains ACME certificates using DNS-01 challenges, for
+// wildcard names and hosts where port 80 is not reachable.
+package acmedns
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+const (
+	// accountKeyName matches autocert so both challenge types share one account
+	accountKeyName = "acme_account+key"
+	renewBefore    = 30 * 24 * time.Hour
+	renewInterval  = 12 * time.Hour
+	// propagationDelay gives resolvers time to see new TXT records
+	propagationDelay = 15 * time.Second
+)
+
+// Manager obtains a certificate for its domains and renews it before expiry.
+// Certificates and the account key are kept in an autocert.Cache.
+type Manager struct {
+	domains      []string
+	email        string
+	directoryURL string
+	cache        autocert.Cache
+	provider     Provider
+	logger       *slog.Logger
+	propagation  time.Duration
+	now          func() time.Time
+
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func New(cfg config.ACMEConfig, logger *slog.Logger) (*Manager, error) {
+	provider, err := NewProvider(cfg.DNS)
+	if err != nil {
+		return nil, err
+	}
+	directoryURL := cfg.Directory()
+	if directoryURL == "" {
+		directoryURL = autocert.DefaultACMEDirectory
+	}
+	return &Manager{
+		domains:      cfg.AllDomains(),
+		email:        cfg.Email,
+		directoryURL: directoryURL,
+		cache:        autocert.DirCache(cfg.CacheDir),
+		provider:     provider,
+		logger:       logger,
+		propagation:  propagationDelay,
+		now:          time.Now,
+	}, nil
+}
+
+// Start loads a cached certificate or obtains a new one, then renews it in the
+// background until ctx is done. It fails when no usable certificate is available.
+func (m *Manager) Start(ctx context.Context) error {
+	cert, err := m.loadCached(ctx)
+	if err != nil {
+		m.logger.Warn("failed to load cached acme certificate", "error", err)
+	}
+	if cert == nil || m.needsRenewal(cert) {
+		fresh, err := m.obtain(ctx)
+		if err != nil {
+			if cert == nil {
+				return fmt.Errorf("obtain acme certificate: %w", err)
+			}
+			m.logger.Error("failed to renew acme certificate, using cached one", "error", err)
+		} else {
+			cert = fresh
+		}
+	}
+	m.cert.Store(cert)
+	go m.renewLoop(ctx)
+	return nil
+}
+
+// TLSConfig returns a server TLS config serving the managed certificate.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+func (m *Manager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := m.cert.Load()
+	if cert == nil {
+		return nil, errors.New("acme certificate not available")
+	}
+	return cert, nil
+}
+
+func (m *Manager) renewLoop(ctx context.Context) {
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if cert := m.cert.Load(); cert != nil && !m.needsRenewal(cert) {
+				continue
+			}
+			cert, err := m.obtain(ctx)
+			if err != nil {
+				m.logger.Error("failed to renew acme certificate", "error", err)
+				continue
+			}
+			m.cert.Store(cert)
+			m.logger.Info("acme certificate renewed", "domains", m.domains, "not_after", cert.Leaf.NotAfter)
+		}
+	}
+}
+
+// needsRenewal reports whether cert is close to expiry or no longer covers
+// every configured domain.
+func (m *Manager) needsRenewal(cert *tls.Certificate) bool {
+	if cert.Leaf == nil {
+		return true
+	}
+	if m.now().Add(renewBefore).After(cert.Leaf.NotAfter) {
+		return true
+	}
+	for _, d := range m.domains {
+		if cert.Leaf.VerifyHostname(d) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) certKey() string {
+	return m.domains[0] + "+dns01"
+}
+
+func (m *Manager) loadCached(ctx context.Context) (*tls.Certificate, error) {
+	data, err := m.cache.Get(ctx, m.certKey())
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (m *Manager) obtain(ctx context.Context) (*tls.Certificate, error) {
+	client, err := m.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.domains...))
+	if err != nil {
+		return nil, fmt.Errorf("create order: %w", err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, u); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, fmt.Errorf("wait order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.domains[0]},
+		DNSNames: m.domains,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("finalize order: %w", err)
+	}
+
+	data, err := encodeCertificate(key, der)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.cache.Put(ctx, m.certKey(), data); err != nil {
+		m.logger.Warn("failed to cache acme certificate", "error", err)
+	}
+	return &cert, nil
+}
+
+func (m *Manager) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+	if err := m.provider.Present(ctx, fqdn, value); err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.provider.CleanUp(context.WithoutCancel(ctx), fqdn, value); err != nil {
+			m.logger.Warn("failed to clean up dns-01 record", "record", fqdn, "error", err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(m.propagation):
+	}
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accept challenge for %s: %w", authz.Identifier.Value, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorize %s: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// client returns an ACME client with a registered account, creating and
+// caching the account key on first use.
+func (m *Manager) client(ctx context.Context) (*acme.Client, error) {
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: m.directoryURL, UserAgent: "sockstream"}
+	acct := &acme.Account{}
+	if m.email != "" {
+		acct.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("register acme account: %w", err)
+	}
+	return client, nil
+}
+
+func (m *Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := m.cache.Get(ctx, accountKeyName)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "EC PRIVATE KEY" {
+			return nil, errors.New("invalid cached acme account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.cache.Put(ctx, accountKeyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// encodeCertificate stores the key followed by the chain, the same layout
+// autocert uses for its cache entries.
+func encodeCertificate(key *ecdsa.PrivateKey, chain [][]byte) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}); err != nil {
+		return nil, err
+	}
+	for _, c := range chain {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c}); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,114 @@
+package acmedns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// selfSigned returns a cache entry for a certificate covering names.
+func selfSigned(t *testing.T, names []string, notAfter time.Time) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := encodeCertificate(key, [][]byte{der})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newTestManager(t *testing.T, domains []string) *Manager {
+	t.Helper()
+	return &Manager{
+		domains: domains,
+		cache:   autocert.DirCache(t.TempDir()),
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		now:     time.Now,
+		// Unreachable directory: any attempt to obtain a certificate fails
+		directoryURL: "http://127.0.0.1:1/directory",
+	}
+}
+
+func TestManager_StartUsesCachedCertificate(t *testing.T) {
+	m := newTestManager(t, []string{"example.com"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := m.cache.Put(ctx, m.certKey(), selfSigned(t, []string{"example.com"}, time.Now().Add(60*24*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	cert, err := m.TLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err != nil {
+		t.Fatalf("GetCertificate() error = %v", err)
+	}
+	if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "example.com" {
+		t.Errorf("unexpected certificate served: %+v", cert.Leaf)
+	}
+}
+
+func TestManager_StartFailsWithoutCertificate(t *testing.T) {
+	m := newTestManager(t, []string{"example.com"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := m.Start(ctx); err == nil {
+		t.Fatal("expected error when no certificate can be obtained")
+	}
+}
+
+func TestManager_NeedsRenewal(t *testing.T) {
+	tests := []struct {
+		name     string
+		domains  []string
+		certFor  []string
+		notAfter time.Duration
+		want     bool
+	}{
+		{name: "fresh", domains: []string{"example.com"}, certFor: []string{"example.com"}, notAfter: 60 * 24 * time.Hour, want: false},
+		{name: "close to expiry", domains: []string{"example.com"}, certFor: []string{"example.com"}, notAfter: 10 * 24 * time.Hour, want: true},
+		{name: "missing domain", domains: []string{"example.com", "api.example.com"}, certFor: []string{"example.com"}, notAfter: 60 * 24 * time.Hour, want: true},
+		{name: "wildcard covers subdomain", domains: []string{"api.example.com"}, certFor: []string{"*.example.com"}, notAfter: 60 * 24 * time.Hour, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, tt.domains)
+			data := selfSigned(t, tt.certFor, time.Now().Add(tt.notAfter))
+			cert, err := tls.X509KeyPair(data, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.needsRenewal(&cert); got != tt.want {
+				t.Errorf("needsRenewal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package acmedns
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// Provider publishes and removes the TXT records used by DNS-01 challenges.
+type Provider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// NewProvider builds the DNS provider selected in cfg.
+func NewProvider(cfg config.ACMEDNSConfig) (Provider, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch strings.ToLower(cfg.Provider) {
+	case "cloudflare":
+		return newCloudflare(cfg.Cloudflare, client), nil
+	case "route53":
+		return newRoute53(cfg.Route53, client), nil
+	default:
+		return nil, fmt.Errorf("unsupported acme dns provider: %s", cfg.Provider)
+	}
+}
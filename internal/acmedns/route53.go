@@ -0,0 +1,177 @@
+package acmedns
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+const (
+	route53API    = "https://route53.amazonaws.com"
+	route53Region = "us-east-1"
+	route53Poll   = 5 * time.Second
+)
+
+type route53 struct {
+	baseURL   string
+	accessKey string
+	secretKey string
+	zoneID    string
+	client    *http.Client
+	poll      time.Duration
+	now       func() time.Time
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+	Name    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL     int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	Value   string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+type route53ChangeInfo struct {
+	ID     string `xml:"ChangeInfo>Id"`
+	Status string `xml:"ChangeInfo>Status"`
+}
+
+func newRoute53(cfg config.Route53Config, client *http.Client) *route53 {
+	return &route53{
+		baseURL:   route53API,
+		accessKey: cfg.AccessKeyID,
+		secretKey: cfg.SecretAccessKey,
+		zoneID:    strings.TrimPrefix(cfg.HostedZoneID, "/hostedzone/"),
+		client:    client,
+		poll:      route53Poll,
+		now:       time.Now,
+	}
+}
+
+// Present upserts the TXT record and waits until Route53 reports it in sync.
+func (r *route53) Present(ctx context.Context, fqdn, value string) error {
+	info, err := r.change(ctx, "UPSERT", fqdn, value)
+	if err != nil {
+		return fmt.Errorf("route53 upsert txt record %s: %w", fqdn, err)
+	}
+	for info.Status != "INSYNC" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.poll):
+		}
+		if err := r.do(ctx, http.MethodGet, "/2013-04-01/change/"+strings.TrimPrefix(info.ID, "/change/"), nil, &info); err != nil {
+			return fmt.Errorf("route53 get change %s: %w", info.ID, err)
+		}
+	}
+	return nil
+}
+
+func (r *route53) CleanUp(ctx context.Context, fqdn, value string) error {
+	if _, err := r.change(ctx, "DELETE", fqdn, value); err != nil {
+		return fmt.Errorf("route53 delete txt record %s: %w", fqdn, err)
+	}
+	return nil
+}
+
+func (r *route53) change(ctx context.Context, action, fqdn, value string) (route53ChangeInfo, error) {
+	body, err := xml.Marshal(route53ChangeRequest{
+		Action: action,
+		Name:   strings.TrimSuffix(fqdn, ".") + ".",
+		Type:   "TXT",
+		TTL:    60,
+		Value:  `"` + value + `"`,
+	})
+	if err != nil {
+		return route53ChangeInfo{}, err
+	}
+	var info route53ChangeInfo
+	err = r.do(ctx, http.MethodPost, "/2013-04-01/hostedzone/"+r.zoneID+"/rrset", append([]byte(xml.Header), body...), &info)
+	return info, err
+}
+
+func (r *route53) do(ctx context.Context, method, path string, body []byte, result any) error {
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	signV4(req, body, r.accessKey, r.secretKey, route53Region, "route53", r.now())
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+			return fmt.Errorf("api error %s: %s", apiErr.Code, apiErr.Message)
+		}
+		return fmt.Errorf("api request failed with status %d", resp.StatusCode)
+	}
+	return xml.Unmarshal(data, result)
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header, signing the
+// host and x-amz-date headers.
+func signV4(req *http.Request, body []byte, accessKey, secretKey, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	payloadHash := sha256.Sum256(body)
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	const signedHeaders = "host;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		"host:" + req.URL.Host + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,81 @@
+package acmedns
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestSignV4(t *testing.T) {
+	// AWS Signature Version 4 test suite, "get-vanilla"
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signV4(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", now)
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRoute53_PresentWaitsForSync(t *testing.T) {
+	var body string
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			t.Errorf("missing signature: %q", r.Header.Get("Authorization"))
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/2013-04-01/hostedzone/Z123/rrset":
+			data, _ := io.ReadAll(r.Body)
+			body = string(data)
+			_, _ = w.Write([]byte(`<ChangeResourceRecordSetsResponse><ChangeInfo><Id>/change/C1</Id><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`))
+		case r.Method == http.MethodGet && r.URL.Path == "/2013-04-01/change/C1":
+			polls++
+			status := "PENDING"
+			if polls > 1 {
+				status = "INSYNC"
+			}
+			_, _ = w.Write([]byte(`<GetChangeResponse><ChangeInfo><Id>/change/C1</Id><Status>` + status + `</Status></ChangeInfo></GetChangeResponse>`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`<ErrorResponse><Error><Code>InvalidInput</Code><Message>bad</Message></Error></ErrorResponse>`))
+		}
+	}))
+	defer srv.Close()
+
+	r53 := newRoute53(config.Route53Config{
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		HostedZoneID:    "/hostedzone/Z123",
+	}, srv.Client())
+	r53.baseURL = srv.URL
+	r53.poll = time.Millisecond
+
+	if err := r53.Present(context.Background(), "_acme-challenge.example.com", "abc"); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	if polls != 2 {
+		t.Errorf("polls = %d, want 2", polls)
+	}
+	for _, want := range []string{"<Action>UPSERT</Action>", "<Name>_acme-challenge.example.com.</Name>", "<Value>&#34;abc&#34;</Value>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("request body missing %s:\n%s", want, body)
+		}
+	}
+
+	if err := r53.CleanUp(context.Background(), "_acme-challenge.other.com", "abc"); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if !strings.Contains(body, "<Action>DELETE</Action>") {
+		t.Errorf("expected DELETE change, got:\n%s", body)
+	}
+}
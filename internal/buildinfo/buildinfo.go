@@ -0,0 +1,66 @@
+// Package buildinfo reports which build of sockstream is running.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, for example:
+//
+//	go build -ldflags "-X github.com/foxzi/SockStream/internal/buildinfo.Version=1.2.3 \
+//	  -X github.com/foxzi/SockStream/internal/buildinfo.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/foxzi/SockStream/internal/buildinfo.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/sockstream
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes the running build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build details. A commit or date not set with -ldflags is
+// taken from the VCS stamp go build records, when there is one.
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, BuildDate: Date, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// String formats the info on one line, as printed by -version.
+func (i Info) String() string {
+	s := "sockstream " + i.Version
+	if i.Commit != "" {
+		s += fmt.Sprintf(" (commit %s", shortCommit(i.Commit))
+		if i.BuildDate != "" {
+			s += ", built " + i.BuildDate
+		}
+		s += ")"
+	} else if i.BuildDate != "" {
+		s += " (built " + i.BuildDate + ")"
+	}
+	return s + " " + i.GoVersion
+}
+
+func shortCommit(c string) string {
+	if len(c) > 12 {
+		return c[:12]
+	}
+	return c
+}
@@ -0,0 +1,41 @@
+package buildinfo
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestInfo_String(t *testing.T) {
+	tests := []struct {
+		name string
+		info Info
+		want string
+	}{
+		{"version only", Info{Version: "dev", GoVersion: "go1.24.1"}, "sockstream dev go1.24.1"},
+		{"date only", Info{Version: "dev", BuildDate: "2024-05-01T10:00:00Z", GoVersion: "go1.24.1"}, "sockstream dev (built 2024-05-01T10:00:00Z) go1.24.1"},
+		{
+			"full",
+			Info{Version: "1.4.0", Commit: "0123456789abcdef0123", BuildDate: "2024-05-01T10:00:00Z", GoVersion: "go1.24.1"},
+			"sockstream 1.4.0 (commit 0123456789ab, built 2024-05-01T10:00:00Z) go1.24.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.info.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGet_LinkerValues(t *testing.T) {
+	defer func(v, c, d string) { Version, Commit, Date = v, c, d }(Version, Commit, Date)
+	Version, Commit, Date = "1.4.0", "abc123", "2024-05-01T10:00:00Z"
+
+	got := Get()
+	want := Info{Version: "1.4.0", Commit: "abc123", BuildDate: "2024-05-01T10:00:00Z", GoVersion: runtime.Version()}
+	if got != want {
+		t.Errorf("Get() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+package config
+
+import "sort"
+
+// Config value sources, from lowest to highest precedence
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// Sources maps a config path such as "proxy.type" to the layer that set it.
+type Sources map[string]string
+
+// Source returns where the value at key came from, "default" when no layer set it.
+func (s Sources) Source(key string) string {
+	if src, ok := s[key]; ok {
+		return src
+	}
+	return SourceDefault
+}
+
+// Keys returns the recorded config paths in sorted order.
+func (s Sources) Keys() []string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s Sources) set(key, source string) {
+	if s != nil {
+		s[key] = source
+	}
+}
+
+// recordFile marks every leaf key present in the raw config document as set by the file.
+func (s Sources) recordFile(data []byte, unmarshal func([]byte, any) error) {
+	if s == nil {
+		return
+	}
+	var raw map[string]any
+	if err := unmarshal(data, &raw); err != nil {
+		return
+	}
+	s.recordMap("", raw)
+}
+
+func (s Sources) recordMap(prefix string, m map[string]any) {
+	for k, v := range m {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]any); ok {
+			s.recordMap(key, nested)
+			continue
+		}
+		s[key] = SourceFile
+	}
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "1.2", want: tls.VersionTLS12},
+		{in: "1.3", want: tls.VersionTLS13},
+		{in: "TLS1.2", want: tls.VersionTLS12},
+		{in: "1.4", wantErr: true},
+		{in: "abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseTLSVersion(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTLSVersion(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseTLSVersion(%q) = %#x, want %#x", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := ParseCipherSuites([]string{
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+		"tls_ecdhe_rsa_with_chacha20_poly1305_sha256",
+	})
+	if err != nil {
+		t.Fatalf("ParseCipherSuites() error = %v", err)
+	}
+	want := []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	}
+	if len(ids) != len(want) {
+		t.Fatalf("got %d suites, want %d", len(ids), len(want))
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Errorf("suite[%d] = %#x, want %#x", i, ids[i], want[i])
+		}
+	}
+
+	if _, err := ParseCipherSuites([]string{"TLS_NOPE"}); err == nil {
+		t.Error("expected error for unknown cipher suite")
+	}
+}
@@ -0,0 +1,157 @@
+// Package errorpage renders configurable bodies for error responses.
+package errorpage
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// Data is passed to error page templates.
+type Data struct {
+	Status     int
+	StatusText string
+	// Message is the short reason the proxy would otherwise send as plain text
+	Message string
+	// RequestID is taken from the client's X-Request-ID header, if any.
+	// Non-HTML templates insert it unescaped, so for them IDs longer than
+	// maxRequestID or with characters other than letters, digits and -_.:
+	// are dropped.
+	RequestID string
+}
+
+// maxRequestID bounds the X-Request-ID value passed to non-HTML templates.
+const maxRequestID = 128
+
+type executor interface {
+	Execute(w io.Writer, data any) error
+}
+
+// Pages writes error responses from templates keyed by status code.
+// A nil *Pages writes plain http.Error responses.
+type Pages struct {
+	contentType string
+	// html marks templates that escape values themselves
+	html     bool
+	byStatus map[int]executor
+	fallback executor
+}
+
+// New parses the configured templates. It returns nil when no page is configured.
+// HTML content types use html/template so request values are escaped.
+func New(cfg config.ErrorPagesConfig) (*Pages, error) {
+	if len(cfg.Pages) == 0 && cfg.Default == "" {
+		return nil, nil
+	}
+	p := &Pages{contentType: cfg.ContentType, byStatus: make(map[int]executor)}
+	if p.contentType == "" {
+		p.contentType = "text/html; charset=utf-8"
+	}
+	p.html = strings.Contains(p.contentType, "html")
+
+	for key, body := range cfg.Pages {
+		status, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("error page %q: status must be a number", key)
+		}
+		tmpl, err := parse(key, body, p.html)
+		if err != nil {
+			return nil, err
+		}
+		p.byStatus[status] = tmpl
+	}
+	if cfg.Default != "" {
+		tmpl, err := parse("default", cfg.Default, p.html)
+		if err != nil {
+			return nil, err
+		}
+		p.fallback = tmpl
+	}
+	return p, nil
+}
+
+func parse(name, body string, html bool) (executor, error) {
+	var (
+		tmpl executor
+		err  error
+	)
+	if html {
+		tmpl, err = htmltemplate.New(name).Parse(body)
+	} else {
+		tmpl, err = template.New(name).Parse(body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse error page %s: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// Error replies with the page configured for status, like http.Error.
+// Without a matching page, or if rendering fails, msg is sent as plain text.
+func (p *Pages) Error(w http.ResponseWriter, r *http.Request, msg string, status int) {
+	contentType, body := p.Render(r, msg, status)
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// Render returns the content type and body Error would send. Without a
+// matching page, or if rendering fails, the body is msg as plain text.
+func (p *Pages) Render(r *http.Request, msg string, status int) (string, []byte) {
+	plain := func() (string, []byte) {
+		return "text/plain; charset=utf-8", []byte(msg + "\n")
+	}
+	if p == nil {
+		return plain()
+	}
+	tmpl, ok := p.byStatus[status]
+	if !ok {
+		tmpl = p.fallback
+	}
+	if tmpl == nil {
+		return plain()
+	}
+
+	id := r.Header.Get("X-Request-ID")
+	if !p.html && !safeRequestID(id) {
+		id = ""
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, Data{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    msg,
+		RequestID:  id,
+	})
+	if err != nil {
+		return plain()
+	}
+	return p.contentType, buf.Bytes()
+}
+
+// safeRequestID reports whether id can be inserted into any body format
+// without escaping.
+func safeRequestID(id string) bool {
+	if len(id) > maxRequestID {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
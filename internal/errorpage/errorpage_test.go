@@ -0,0 +1,132 @@
+package errorpage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestPages_Error(t *testing.T) {
+	tests := []struct {
+		name            string
+		cfg             config.ErrorPagesConfig
+		status          int
+		requestID       string
+		wantBody        string
+		wantContentType string
+	}{
+		{
+			name:            "not configured",
+			cfg:             config.ErrorPagesConfig{},
+			status:          http.StatusBadGateway,
+			wantBody:        "proxy error\n",
+			wantContentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:            "html page with variables",
+			cfg:             config.ErrorPagesConfig{Pages: map[string]string{"502": "<h1>{{.Status}} {{.StatusText}}</h1><p>{{.RequestID}}</p>"}},
+			status:          http.StatusBadGateway,
+			requestID:       "abc",
+			wantBody:        "<h1>502 Bad Gateway</h1><p>abc</p>",
+			wantContentType: "text/html; charset=utf-8",
+		},
+		{
+			name:            "html escapes request values",
+			cfg:             config.ErrorPagesConfig{Pages: map[string]string{"502": "<p>{{.RequestID}}</p>"}},
+			status:          http.StatusBadGateway,
+			requestID:       "<script>",
+			wantBody:        "<p>&lt;script&gt;</p>",
+			wantContentType: "text/html; charset=utf-8",
+		},
+		{
+			name: "json default page",
+			cfg: config.ErrorPagesConfig{
+				ContentType: "application/json",
+				Default:     `{"status":{{.Status}},"error":"{{.Message}}"}`,
+			},
+			status:          http.StatusForbidden,
+			wantBody:        `{"status":403,"error":"forbidden"}`,
+			wantContentType: "application/json",
+		},
+		{
+			name: "json drops unsafe request id",
+			cfg: config.ErrorPagesConfig{
+				ContentType: "application/json",
+				Default:     `{"status":{{.Status}},"request_id":"{{.RequestID}}"}`,
+			},
+			status:          http.StatusForbidden,
+			requestID:       `x","admin":true,"y":"`,
+			wantBody:        `{"status":403,"request_id":""}`,
+			wantContentType: "application/json",
+		},
+		{
+			name: "json keeps safe request id",
+			cfg: config.ErrorPagesConfig{
+				ContentType: "application/json",
+				Default:     `{"request_id":"{{.RequestID}}"}`,
+			},
+			status:          http.StatusForbidden,
+			requestID:       "7f3c-91ab_2.1:a",
+			wantBody:        `{"request_id":"7f3c-91ab_2.1:a"}`,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "other status falls back to plain text",
+			cfg:             config.ErrorPagesConfig{Pages: map[string]string{"502": "bad gateway"}},
+			status:          http.StatusForbidden,
+			wantBody:        "forbidden\n",
+			wantContentType: "text/plain; charset=utf-8",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages, err := New(tt.cfg)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.requestID != "" {
+				req.Header.Set("X-Request-ID", tt.requestID)
+			}
+			msg := "proxy error"
+			if tt.status == http.StatusForbidden {
+				msg = "forbidden"
+			}
+			rec := httptest.NewRecorder()
+			pages.Error(rec, req, msg, tt.status)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestNew_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.ErrorPagesConfig
+		want string
+	}{
+		{name: "non-numeric key", cfg: config.ErrorPagesConfig{Pages: map[string]string{"oops": "x"}}, want: "status must be a number"},
+		{name: "bad template", cfg: config.ErrorPagesConfig{Default: "{{.Status"}, want: "parse error page default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("New() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
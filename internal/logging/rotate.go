@@ -0,0 +1,136 @@
+// Package logging provides log output destinations.
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotatingFile is an io.WriteCloser that appends to a file and rotates it
+// once it exceeds a size limit, pruning old backups by count and age.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+	now        func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRotatingFile opens path for appending. maxSizeMB <= 0 disables rotation;
+// maxBackups and maxAgeDays of 0 keep backups without limit.
+func NewRotatingFile(path string, maxSizeMB, maxBackups, maxAgeDays int) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		maxAge:     time.Duration(maxAgeDays) * 24 * time.Hour,
+		now:        time.Now,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+func (r *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("create log directory: %w", err)
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+// rotate renames the current file to a timestamped backup and starts a new one.
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(r.path, r.backupName(r.now())); err != nil {
+		// Keep writing to the current file; the next write tries again
+		if oerr := r.open(); oerr != nil {
+			return fmt.Errorf("rotate log file: %w; reopen: %w", err, oerr)
+		}
+		return fmt.Errorf("rotate log file: %w", err)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+func (r *RotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(r.path)
+	return strings.TrimSuffix(r.path, ext) + "-" + t.Format(backupTimeFormat) + ext
+}
+
+// prune removes backups beyond maxBackups and older than maxAge. Errors are
+// ignored; a leftover backup is preferable to failing a log write.
+func (r *RotatingFile) prune() {
+	ext := filepath.Ext(r.path)
+	base := strings.TrimSuffix(r.path, ext) + "-"
+	matches, _ := filepath.Glob(base + "*" + ext)
+	// Only names backupName could have made; app-audit.log is not a backup
+	var backups []string
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, base), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// Timestamps sort lexically, newest first after reversing
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	cutoff := r.now().Add(-r.maxAge)
+	for i, b := range backups {
+		if r.maxBackups > 0 && i >= r.maxBackups {
+			_ = os.Remove(b)
+			continue
+		}
+		if r.maxAge > 0 {
+			if info, err := os.Stat(b); err == nil && info.ModTime().Before(cutoff) {
+				_ = os.Remove(b)
+			}
+		}
+	}
+}
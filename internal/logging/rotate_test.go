@@ -0,0 +1,146 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile_RotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sockstream.log")
+	r, err := NewRotatingFile(path, 1, 2, 0)
+	if err != nil {
+		t.Fatalf("NewRotatingFile() error = %v", err)
+	}
+	defer r.Close()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	line := []byte(strings.Repeat("x", 400*1024) + "\n")
+	for i := 0; i < 10; i++ {
+		if _, err := r.Write(line); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "sockstream-*.log"))
+	if len(backups) != 2 {
+		t.Errorf("backups = %v, want 2 kept", backups)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 1024*1024 {
+		t.Errorf("active file size = %d, exceeds limit", info.Size())
+	}
+}
+
+func TestRotatingFile_PrunesByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	old := filepath.Join(dir, "app-2020-01-01T00-00-00.000.log")
+	if err := os.WriteFile(old, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-30 * 24 * time.Hour)
+	_ = os.Chtimes(old, past, past)
+
+	r, err := NewRotatingFile(path, 1, 0, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, _ = r.Write([]byte(strings.Repeat("y", 1024*1024)))
+	_, _ = r.Write([]byte("trigger rotation\n"))
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("backup older than max age should be removed")
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, "app-*.log"))
+	if len(backups) != 1 {
+		t.Errorf("backups = %v, want the fresh one only", backups)
+	}
+}
+
+func TestRotatingFile_PruneKeepsSiblings(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	sibling := filepath.Join(dir, "app-audit.log")
+	if err := os.WriteFile(sibling, []byte("audit\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-30 * 24 * time.Hour)
+	_ = os.Chtimes(sibling, past, past)
+
+	r, err := NewRotatingFile(path, 1, 1, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := 0; i < 3; i++ {
+		_, _ = r.Write([]byte(strings.Repeat("y", 1024*1024)))
+	}
+
+	if _, err := os.Stat(sibling); err != nil {
+		t.Errorf("unrelated file was pruned: %v", err)
+	}
+}
+
+func TestRotatingFile_RenameFailureKeepsWriting(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	r, err := NewRotatingFile(path, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return stamp }
+
+	// A non-empty directory in the way makes the rename fail
+	blocker := r.backupName(stamp)
+	if err := os.MkdirAll(filepath.Join(blocker, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = r.Write([]byte(strings.Repeat("y", 1024*1024)))
+	if _, err := r.Write([]byte("rotate\n")); err == nil {
+		t.Fatal("Write() should report the failed rotation")
+	}
+
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("after\n")); err != nil {
+		t.Fatalf("Write() after a failed rotation error = %v", err)
+	}
+}
+
+func TestRotatingFile_AppendsToExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "app.log")
+	r, err := NewRotatingFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = r.Write([]byte("first\n"))
+	r.Close()
+
+	r, err = NewRotatingFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = r.Write([]byte("second\n"))
+	r.Close()
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "first\nsecond\n" {
+		t.Errorf("file = %q", data)
+	}
+}
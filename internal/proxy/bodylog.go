@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// bodyLogger captures request and response bodies, truncated and redacted,
+// and logs them at debug level once the body is closed.
+type bodyLogger struct {
+	logger       *slog.Logger
+	maxBytes     int
+	contentTypes []string
+	redact       []redactRule
+}
+
+type redactRule struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+const defaultMaxBodyBytes = 4096
+
+// newBodyLogger returns nil when body logging is disabled.
+func newBodyLogger(cfg config.DebugConfig, logger *slog.Logger) *bodyLogger {
+	if !cfg.LogBodies {
+		return nil
+	}
+	b := &bodyLogger{logger: logger, maxBytes: cfg.MaxBodyBytes, contentTypes: cfg.ContentTypes}
+	if b.maxBytes == 0 {
+		b.maxBytes = defaultMaxBodyBytes
+	}
+	for _, f := range cfg.RedactFields {
+		f = regexp.QuoteMeta(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		b.redact = append(b.redact,
+			// JSON "field": value
+			redactRule{regexp.MustCompile(`(?i)("` + f + `"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]+)`), `${1}"[REDACTED]"`},
+			// form field=value
+			redactRule{regexp.MustCompile(`(?i)((?:^|&)` + f + `=)[^&]*`), `${1}[REDACTED]`},
+		)
+	}
+	return b
+}
+
+func (b *bodyLogger) wrapRequest(r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody || !b.matches(r.Header.Get("Content-Type")) {
+		return
+	}
+	method, url := r.Method, r.URL.String()
+	r.Body = b.tee(r.Body, func(body string, truncated bool) {
+		b.logger.Debug("request body", "method", method, "url", url, "body", body, "truncated", truncated)
+	})
+}
+
+func (b *bodyLogger) wrapResponse(resp *http.Response) {
+	if resp.Body == nil || resp.Body == http.NoBody || !b.matches(resp.Header.Get("Content-Type")) {
+		return
+	}
+	status := resp.StatusCode
+	url := ""
+	if resp.Request != nil {
+		url = resp.Request.URL.String()
+	}
+	resp.Body = b.tee(resp.Body, func(body string, truncated bool) {
+		b.logger.Debug("response body", "status", status, "url", url, "body", body, "truncated", truncated)
+	})
+}
+
+func (b *bodyLogger) matches(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, ct := range b.contentTypes {
+		if strings.HasPrefix(mediaType, strings.ToLower(ct)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *bodyLogger) tee(rc io.ReadCloser, log func(body string, truncated bool)) io.ReadCloser {
+	return &teeBody{ReadCloser: rc, max: b.maxBytes, log: func(data []byte, truncated bool) {
+		log(b.redactBody(data), truncated)
+	}}
+}
+
+func (b *bodyLogger) redactBody(data []byte) string {
+	for _, r := range b.redact {
+		data = r.re.ReplaceAll(data, []byte(r.repl))
+	}
+	return string(data)
+}
+
+// teeBody copies up to max bytes of what is read and reports them on Close.
+// Reads are passed through unchanged, so streaming is not delayed.
+type teeBody struct {
+	io.ReadCloser
+	max       int
+	buf       bytes.Buffer
+	truncated bool
+	log       func([]byte, bool)
+	once      sync.Once
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		if room := t.max - t.buf.Len(); room < n {
+			t.buf.Write(p[:max(room, 0)])
+			t.truncated = true
+		} else {
+			t.buf.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	t.once.Do(func() { t.log(t.buf.Bytes(), t.truncated) })
+	return t.ReadCloser.Close()
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestBodyLogger_RedactBody(t *testing.T) {
+	b := newBodyLogger(config.DebugConfig{LogBodies: true, RedactFields: []string{"password", "token"}}, slog.Default())
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "json string", in: `{"user":"bob","password":"hunter2"}`, want: `{"user":"bob","password":"[REDACTED]"}`},
+		{name: "json number", in: `{"token": 12345, "n": 1}`, want: `{"token": "[REDACTED]", "n": 1}`},
+		{name: "json escaped quote", in: `{"password":"a\"b"}`, want: `{"password":"[REDACTED]"}`},
+		{name: "case insensitive", in: `{"Password":"x"}`, want: `{"Password":"[REDACTED]"}`},
+		{name: "form", in: `user=bob&password=hunter2&token=abc`, want: `user=bob&password=[REDACTED]&token=[REDACTED]`},
+		{name: "untouched", in: `{"user":"bob"}`, want: `{"user":"bob"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.redactBody([]byte(tt.in)); got != tt.want {
+				t.Errorf("redactBody() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewBodyLogger_Disabled(t *testing.T) {
+	if b := newBodyLogger(config.DebugConfig{}, slog.Default()); b != nil {
+		t.Error("body logger should be nil when log_bodies is off")
+	}
+}
+
+func TestTeeBody_Truncates(t *testing.T) {
+	var logged []byte
+	var truncated bool
+	body := &teeBody{
+		ReadCloser: io.NopCloser(strings.NewReader("0123456789")),
+		max:        4,
+		log:        func(b []byte, tr bool) { logged, truncated = append([]byte(nil), b...), tr },
+	}
+	data, _ := io.ReadAll(body)
+	_ = body.Close()
+
+	if string(data) != "0123456789" {
+		t.Errorf("passthrough data = %q", data)
+	}
+	if string(logged) != "0123" || !truncated {
+		t.Errorf("logged = %q, truncated = %v", logged, truncated)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for use by concurrent log writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+func TestReverseProxy_LogsBodies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"token":"abc","ok":true}`)
+	}))
+	defer upstream.Close()
+
+	var out syncBuffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	cfg := config.DefaultConfig()
+	cfg.Debug.LogBodies = true
+	target, _ := url.Parse(upstream.URL)
+	front := httptest.NewServer(NewReverseProxy(target, cfg, nil, logger))
+	defer front.Close()
+
+	resp, err := http.Post(front.URL+"/login", "application/json", strings.NewReader(`{"user":"bob","password":"hunter2"}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	front.Close()
+
+	logs := out.String()
+	for _, want := range []string{"request body", "response body", `\"user\":\"bob\"`, `\"ok\":true`} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("logs missing %s:\n%s", want, logs)
+		}
+	}
+	for _, secret := range []string{"hunter2", `\"abc\"`} {
+		if strings.Contains(logs, secret) {
+			t.Errorf("logs leak %s:\n%s", secret, logs)
+		}
+	}
+}
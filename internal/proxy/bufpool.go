@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// defaultBufferSize matches the copy buffer ReverseProxy allocates on its own
+	defaultBufferSize = 32 << 10
+	// maxPooledBodySize keeps unusually large request bodies out of the pool
+	maxPooledBodySize = 1 << 20
+	// defaultRetryMemory is how much of a request body is kept in memory
+	// for retries before the rest spills to a temp file
+	defaultRetryMemory = 1 << 20
+	// defaultRetryMaxBody is how much of a request body is kept for retries
+	// at all; the rest is streamed and cannot be resent
+	defaultRetryMaxBody = 64 << 20
+)
+
+var errBodyClosed = errors.New("read on closed request body")
+
+// BufferPool recycles the buffers used to copy response bodies and to hold
+// request bodies for retries. It implements httputil.BufferPool.
+type BufferPool struct {
+	size   int
+	copies sync.Pool
+	bodies sync.Pool
+}
+
+// NewBufferPool returns a pool of size-byte copy buffers; size <= 0 uses 32 KiB.
+func NewBufferPool(size int) *BufferPool {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	return &BufferPool{size: size}
+}
+
+// Get returns a copy buffer.
+func (p *BufferPool) Get() []byte {
+	if b, ok := p.copies.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, p.size)
+}
+
+// Put returns a buffer obtained from Get.
+func (p *BufferPool) Put(b []byte) {
+	if cap(b) != p.size {
+		return
+	}
+	b = b[:p.size]
+	p.copies.Put(&b)
+}
+
+// readBody reads r into a pooled buffer and closes it. Anything past
+// memLimit bytes (<= 0 uses 1 MiB) spills to a temp file, so large uploads
+// stay retryable without being held in memory. Past maxSize bytes (<= 0
+// uses 64 MiB) reading stops and the remainder becomes rest, which is
+// streamed once. A body that is already replayable is shared rather than
+// copied again.
+func (p *BufferPool) readBody(r io.ReadCloser, memLimit, maxSize int64) (*replayBody, error) {
+	if rr, ok := r.(*replayReader); ok {
+		body := rr.body
+		body.refs.Add(1)
+		rr.Close()
+		return body, nil
+	}
+
+	buf, _ := p.bodies.Get().(*bytes.Buffer)
+	if buf == nil {
+		buf = bytes.NewBuffer(make([]byte, 0, p.size))
+	}
+	if memLimit <= 0 {
+		memLimit = defaultRetryMemory
+	}
+	if maxSize <= 0 {
+		maxSize = defaultRetryMaxBody
+	}
+	memLimit = min(memLimit, maxSize)
+	if _, err := buf.ReadFrom(io.LimitReader(r, memLimit)); err != nil {
+		r.Close()
+		p.putBody(buf)
+		return nil, err
+	}
+	body := &replayBody{buf: buf, pool: p}
+	body.refs.Store(1)
+	if int64(buf.Len()) == memLimit {
+		if err := body.spill(r, maxSize-memLimit); err != nil {
+			r.Close()
+			body.release()
+			return nil, err
+		}
+	}
+	if body.rest == nil {
+		r.Close()
+	}
+	return body, nil
+}
+
+func (p *BufferPool) putBody(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBodySize {
+		return
+	}
+	buf.Reset()
+	p.bodies.Put(buf)
+}
+
+// replayBody holds a request body so it can be sent more than once. The
+// buffer goes back to the pool, and the spill file is removed, after
+// release and once every reader handed out has been closed, since
+// transports may still read the body after RoundTrip returns.
+type replayBody struct {
+	buf  *bytes.Buffer
+	pool *BufferPool
+	refs atomic.Int32
+	// file holds the part of the body past buf, if any
+	file     *os.File
+	fileSize int64
+	// rest is the part of the body past the retry limit, not read yet. It
+	// can only be read once, so attempts stop once it has started.
+	rest *unreadBody
+}
+
+// spill copies up to limit more bytes of r to a temp file and keeps
+// anything beyond as rest. No file is created when r turns out to be
+// exhausted already.
+func (b *replayBody) spill(r io.ReadCloser, limit int64) error {
+	if limit > 0 {
+		var first [1]byte
+		if _, err := io.ReadFull(r, first[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		f, err := os.CreateTemp("", "sockstream-body-*")
+		if err != nil {
+			return err
+		}
+		b.file = f
+		n, err := io.Copy(f, io.LimitReader(io.MultiReader(bytes.NewReader(first[:]), r), limit))
+		b.fileSize = n
+		if err != nil || n < limit {
+			return err
+		}
+	}
+	var next [1]byte
+	if _, err := io.ReadFull(r, next[:]); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	b.rest = &unreadBody{ReadCloser: struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(next[:]), r), r}}
+	return nil
+}
+
+// reader returns a fresh reader over the whole body.
+func (b *replayBody) reader() io.ReadCloser {
+	b.refs.Add(1)
+	var r io.Reader = bytes.NewReader(b.buf.Bytes())
+	if b.file != nil {
+		r = io.MultiReader(r, io.NewSectionReader(b.file, 0, b.fileSize))
+	}
+	if b.rest != nil {
+		r = io.MultiReader(r, b.rest)
+	}
+	return &replayReader{r: r, body: b}
+}
+
+// release drops the owner's reference taken by readBody.
+func (b *replayBody) release() {
+	if b.refs.Add(-1) != 0 {
+		return
+	}
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+	if b.rest != nil {
+		b.rest.ReadCloser.Close()
+	}
+	b.pool.putBody(b.buf)
+}
+
+type replayReader struct {
+	mu     sync.Mutex
+	r      io.Reader
+	body   *replayBody
+	closed bool
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, errBodyClosed
+	}
+	return r.r.Read(p)
+}
+
+func (r *replayReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		r.closed = true
+		r.body.release()
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestBufferPool_GetPut(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		want int
+	}{
+		{name: "default", size: 0, want: defaultBufferSize},
+		{name: "negative", size: -1, want: defaultBufferSize},
+		{name: "custom", size: 4096, want: 4096},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewBufferPool(tt.size)
+			b := p.Get()
+			if len(b) != tt.want {
+				t.Fatalf("len(Get()) = %d, want %d", len(b), tt.want)
+			}
+			p.Put(b[:10])
+			if got := p.Get(); len(got) != tt.want {
+				t.Errorf("len(Get()) after Put = %d, want %d", len(got), tt.want)
+			}
+			// Foreign buffers are dropped rather than handed out later
+			p.Put(make([]byte, tt.want+1))
+			if got := p.Get(); len(got) != tt.want {
+				t.Errorf("len(Get()) after foreign Put = %d, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayBody(t *testing.T) {
+	p := NewBufferPool(0)
+	body, err := p.readBody(io.NopCloser(strings.NewReader("payload")), 0, 0)
+	if err != nil {
+		t.Fatalf("readBody() error = %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		r := body.reader()
+		got, err := io.ReadAll(r)
+		if err != nil || string(got) != "payload" {
+			t.Fatalf("reader %d = %q, %v, want payload", i, got, err)
+		}
+		r.Close()
+	}
+
+	// A replayable body is shared instead of being copied again
+	r := body.reader()
+	shared, err := p.readBody(r, 0, 0)
+	if err != nil {
+		t.Fatalf("readBody(replayReader) error = %v", err)
+	}
+	if shared != body {
+		t.Error("readBody(replayReader) should share the existing body")
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, errBodyClosed) {
+		t.Errorf("Read() after Close error = %v, want errBodyClosed", err)
+	}
+	if got := body.refs.Load(); got != 2 {
+		t.Errorf("refs = %d, want 2", got)
+	}
+	shared.release()
+	body.release()
+	if got := body.refs.Load(); got != 0 {
+		t.Errorf("refs after release = %d, want 0", got)
+	}
+}
+
+func TestReplayBody_Spill(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		wantSpill bool
+	}{
+		{name: "under limit", size: 100},
+		{name: "exactly limit", size: 1024},
+		{name: "over limit", size: 5000, wantSpill: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("TMPDIR", dir)
+			payload := strings.Repeat("x", tt.size)
+
+			body, err := NewBufferPool(0).readBody(io.NopCloser(strings.NewReader(payload)), 1024, 0)
+			if err != nil {
+				t.Fatalf("readBody() error = %v", err)
+			}
+			if (body.file != nil) != tt.wantSpill {
+				t.Fatalf("spilled = %v, want %v", body.file != nil, tt.wantSpill)
+			}
+			if body.buf.Len() > 1024 {
+				t.Errorf("in-memory part = %d bytes, want at most 1024", body.buf.Len())
+			}
+			for i := 0; i < 2; i++ {
+				r := body.reader()
+				got, err := io.ReadAll(r)
+				if err != nil || string(got) != payload {
+					t.Fatalf("reader %d returned %d bytes, %v, want %d", i, len(got), err, tt.size)
+				}
+				r.Close()
+			}
+
+			body.release()
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("spill files left after release: %d", len(entries))
+			}
+		})
+	}
+}
+
+func TestProxyPool_RetryBodyPooled(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs: []string{"http://proxy1:8080", "http://proxy2:8080"},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	var bodies []string
+	for _, e := range pool.entries {
+		e.transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			got, _ := io.ReadAll(r.Body)
+			r.Body.Close()
+			bodies = append(bodies, string(got))
+			return nil, &timeoutError{}
+		})
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://target.example.com/", strings.NewReader("payload"))
+	if _, err := pool.RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip() succeeded, want error")
+	}
+	if len(bodies) != 2 || bodies[0] != "payload" || bodies[1] != "payload" {
+		t.Errorf("bodies sent = %q, want payload twice", bodies)
+	}
+}
+
+type closeTracker struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestReplayBody_MaxSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		wantRest bool
+	}{
+		{name: "exactly max", size: 2048},
+		{name: "over max", size: 5000, wantRest: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TMPDIR", t.TempDir())
+			payload := strings.Repeat("x", tt.size)
+			src := &closeTracker{Reader: strings.NewReader(payload)}
+
+			body, err := NewBufferPool(0).readBody(src, 1024, 2048)
+			if err != nil {
+				t.Fatalf("readBody() error = %v", err)
+			}
+			if (body.rest != nil) != tt.wantRest {
+				t.Fatalf("rest = %v, want %v", body.rest != nil, tt.wantRest)
+			}
+			if body.fileSize != 1024 {
+				t.Errorf("spilled %d bytes, want 1024", body.fileSize)
+			}
+			if src.closed == tt.wantRest {
+				t.Errorf("source closed = %v, want %v before release", src.closed, !tt.wantRest)
+			}
+			r := body.reader()
+			got, err := io.ReadAll(r)
+			if err != nil || string(got) != payload {
+				t.Fatalf("reader returned %d bytes, %v, want %d", len(got), err, tt.size)
+			}
+			r.Close()
+			if tt.wantRest && !body.rest.started.Load() {
+				t.Error("rest not marked as started after reading")
+			}
+			body.release()
+			if !src.closed {
+				t.Error("source not closed after release")
+			}
+		})
+	}
+}
+
+func TestProxyPool_RetryBodyOverLimit(t *testing.T) {
+	payload := strings.Repeat("x", 2<<20)
+	tests := []struct {
+		name string
+		body func() io.Reader
+	}{
+		{name: "known length", body: func() io.Reader { return strings.NewReader(payload) }},
+		{name: "unknown length", body: func() io.Reader { return io.MultiReader(strings.NewReader(payload)) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TMPDIR", t.TempDir())
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs:           []string{"http://proxy1:8080", "http://proxy2:8080"},
+				RetryMaxBodyMB: 1,
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			var sizes []int
+			for _, e := range pool.entries {
+				e.transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+					got, _ := io.ReadAll(r.Body)
+					r.Body.Close()
+					sizes = append(sizes, len(got))
+					return nil, &timeoutError{}
+				})
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "http://target.example.com/", tt.body())
+			if _, err := pool.RoundTrip(req); err == nil {
+				t.Fatal("RoundTrip() succeeded, want error")
+			}
+			if len(sizes) != 1 || sizes[0] != len(payload) {
+				t.Errorf("attempts sent %v bytes, want one attempt with %d", sizes, len(payload))
+			}
+		})
+	}
+}
+
+// BenchmarkReverseProxyCopy compares response copies with and without the
+// buffer pool; run with -benchmem to see the allocations saved.
+func BenchmarkReverseProxyCopy(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 256<<10)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(bytes.NewReader(payload)),
+			Request:    r,
+		}, nil
+	})
+	target, _ := url.Parse("http://target.example.com")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, pooled := range []bool{false, true} {
+		name := "unpooled"
+		if pooled {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			rp := NewReverseProxy(target, config.Config{}, transport, logger)
+			if !pooled {
+				rp.BufferPool = nil
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rec := httptest.NewRecorder()
+				rec.Body = nil
+				rp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+		})
+	}
+}
+
+// BenchmarkRetryBody compares buffering a request body for retries with
+// io.ReadAll against the pooled replay buffer.
+func BenchmarkRetryBody(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 64<<10)
+
+	b.Run("readall", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, _ := io.ReadAll(bytes.NewReader(payload))
+			_, _ = io.Copy(io.Discard, bytes.NewReader(data))
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		p := NewBufferPool(0)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			body, _ := p.readBody(io.NopCloser(bytes.NewReader(payload)), 0, 0)
+			r := body.reader()
+			_, _ = io.Copy(io.Discard, r)
+			r.Close()
+			body.release()
+		}
+	})
+}
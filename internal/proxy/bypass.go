@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// bypassRule is one NO_PROXY style entry: an IP, a CIDR, or a domain,
+// optionally followed by a port.
+type bypassRule struct {
+	cidr   *net.IPNet
+	ip     net.IP
+	domain string
+	// subOnly is set for ".example.com", which matches subdomains only
+	subOnly bool
+	port    string
+}
+
+// bypassList decides which target hosts are reached without a proxy.
+type bypassList struct {
+	all   bool
+	rules []bypassRule
+}
+
+// newBypassList parses entries in NO_PROXY syntax. It returns nil for an empty list.
+func newBypassList(entries []string) (*bypassList, error) {
+	l := &bypassList{}
+	for _, raw := range entries {
+		entry := strings.ToLower(strings.TrimSpace(raw))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			l.all = true
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bypass cidr %s", raw)
+			}
+			l.rules = append(l.rules, bypassRule{cidr: n})
+			continue
+		}
+
+		var rule bypassRule
+		host := entry
+		if h, port, err := net.SplitHostPort(entry); err == nil {
+			host, rule.port = h, port
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			rule.ip = ip
+		} else {
+			host = strings.TrimPrefix(host, "*")
+			rule.subOnly = strings.HasPrefix(host, ".")
+			rule.domain = strings.TrimPrefix(host, ".")
+		}
+		l.rules = append(l.rules, rule)
+	}
+	if !l.all && len(l.rules) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// match reports whether requests to u should skip the proxy pool.
+func (l *bypassList) match(u *url.URL) bool {
+	if l.all {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "http":
+			port = "80"
+		}
+	}
+	ip := net.ParseIP(host)
+
+	for _, r := range l.rules {
+		if r.port != "" && r.port != port {
+			continue
+		}
+		switch {
+		case r.cidr != nil:
+			if ip != nil && r.cidr.Contains(ip) {
+				return true
+			}
+		case r.ip != nil:
+			if ip != nil && r.ip.Equal(ip) {
+				return true
+			}
+		default:
+			if strings.HasSuffix(host, "."+r.domain) || (!r.subOnly && host == r.domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestBypassList_Match(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		url     string
+		want    bool
+	}{
+		{name: "wildcard", entries: []string{"*"}, url: "https://anything.example.com", want: true},
+		{name: "exact domain", entries: []string{"internal.corp"}, url: "http://internal.corp/x", want: true},
+		{name: "domain matches subdomain", entries: []string{"internal.corp"}, url: "http://api.internal.corp", want: true},
+		{name: "leading dot excludes apex", entries: []string{".internal.corp"}, url: "http://internal.corp", want: false},
+		{name: "leading dot matches subdomain", entries: []string{".internal.corp"}, url: "http://api.internal.corp", want: true},
+		{name: "star dot prefix", entries: []string{"*.internal.corp"}, url: "http://api.internal.corp", want: true},
+		{name: "suffix is not a subdomain", entries: []string{"corp"}, url: "http://evilcorp", want: false},
+		{name: "ip", entries: []string{"10.1.2.3"}, url: "http://10.1.2.3:8080", want: true},
+		{name: "cidr", entries: []string{"10.0.0.0/8"}, url: "http://10.20.30.40", want: true},
+		{name: "cidr miss", entries: []string{"10.0.0.0/8"}, url: "http://192.168.1.1", want: false},
+		{name: "port must match", entries: []string{"internal.corp:8443"}, url: "https://internal.corp", want: false},
+		{name: "default port", entries: []string{"internal.corp:443"}, url: "https://internal.corp", want: true},
+		{name: "case insensitive", entries: []string{"Internal.Corp"}, url: "http://API.internal.corp", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := newBypassList(tt.entries)
+			if err != nil {
+				t.Fatalf("newBypassList() error = %v", err)
+			}
+			u, _ := url.Parse(tt.url)
+			if got := l.match(u); got != tt.want {
+				t.Errorf("match(%s) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewBypassList_Empty(t *testing.T) {
+	l, err := newBypassList([]string{"", " "})
+	if err != nil || l != nil {
+		t.Errorf("newBypassList() = %v, %v, want nil list", l, err)
+	}
+	if _, err := newBypassList([]string{"10.0.0.0/99"}); err == nil {
+		t.Error("invalid cidr should fail")
+	}
+}
+
+func TestProxyPool_Bypass(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:   []string{"http://127.0.0.1:1"},
+		Bypass: []string{"127.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v, want direct connection", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+}
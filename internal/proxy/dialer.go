@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-ntlmssp"
+	"golang.org/x/net/proxy"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// contextDialer is a dialer usable both as a forward dialer for SOCKS5 and by http.Transport
+type contextDialer interface {
+	proxy.Dialer
+	proxy.ContextDialer
+}
+
+// connectDialer tunnels connections through an HTTP(S) proxy using CONNECT
+type connectDialer struct {
+	proxy   config.ParsedProxy
+	forward contextDialer
+	// header is added to every CONNECT request
+	header http.Header
+}
+
+func (d *connectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.proxy.Type == "https" {
+		host, _, _ := net.SplitHostPort(d.proxy.Address)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake with proxy %s: %w", d.proxy.Address, err)
+		}
+		conn = tlsConn
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	br := bufio.NewReader(conn)
+	var resp *http.Response
+	if d.proxy.AuthScheme == "ntlm" {
+		resp, err = d.connectNTLM(conn, br, addr)
+	} else {
+		var auth string
+		if d.proxy.Username != "" {
+			auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(d.proxy.Username+":"+d.proxy.Password))
+		}
+		resp, err = d.connect(conn, br, addr, auth)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// A successful CONNECT response has no body; closing it would drain the tunnel
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", d.proxy.Address, addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// connect sends a CONNECT request for addr with the given Proxy-Authorization
+// value, if any, and reads the proxy's response.
+func (d *connectDialer) connect(conn net.Conn, br *bufio.Reader, addr, auth string) (*http.Response, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: d.header.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("write CONNECT to proxy %s: %w", d.proxy.Address, err)
+	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("read CONNECT response from proxy %s: %w", d.proxy.Address, err)
+	}
+	return resp, nil
+}
+
+// connectNTLM authenticates the CONNECT with NTLM. The proxy's challenge is
+// bound to the connection, so the negotiate message and the answer to the
+// challenge are sent as two CONNECT requests over the same connection.
+func (d *connectDialer) connectNTLM(conn net.Conn, br *bufio.Reader, addr string) (*http.Response, error) {
+	negotiate, err := ntlmssp.NewNegotiateMessage("", "")
+	if err != nil {
+		return nil, fmt.Errorf("ntlm negotiate for proxy %s: %w", d.proxy.Address, err)
+	}
+	resp, err := d.connect(conn, br, addr, "NTLM "+base64.StdEncoding.EncodeToString(negotiate))
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return resp, err
+	}
+	challenge := ntlmChallenge(resp.Header)
+	if challenge == nil {
+		return resp, nil
+	}
+	// Read the 407 body so the second request follows on the same connection
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.Close {
+		return nil, fmt.Errorf("proxy %s closed the connection during NTLM authentication", d.proxy.Address)
+	}
+
+	username := d.proxy.Username
+	if d.proxy.Domain != "" && !strings.ContainsAny(username, `\@`) {
+		username = d.proxy.Domain + `\` + username
+	}
+	authenticate, err := ntlmssp.NewAuthenticateMessage(challenge, username, d.proxy.Password, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ntlm authenticate for proxy %s: %w", d.proxy.Address, err)
+	}
+	return d.connect(conn, br, addr, "NTLM "+base64.StdEncoding.EncodeToString(authenticate))
+}
+
+// ntlmChallenge returns the decoded NTLM challenge from a 407 response, or nil.
+func ntlmChallenge(h http.Header) []byte {
+	for _, v := range h.Values("Proxy-Authenticate") {
+		scheme, token, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if !strings.EqualFold(scheme, "NTLM") || token == "" {
+			continue
+		}
+		if challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token)); err == nil {
+			return challenge
+		}
+	}
+	return nil
+}
+
+// bufferedConn serves bytes already read into r before reading from Conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// chainDialer dials through an ordered list of jump proxies
+type chainDialer struct {
+	dialer contextDialer
+	hops   []string
+}
+
+func (d *chainDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *chainDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s via proxy chain [%s]: %w", addr, strings.Join(d.hops, " -> "), err)
+	}
+	return conn, nil
+}
+
+// newChainDialer composes hops so each one is reached through the previous.
+// With no hops the base dialer is returned unchanged.
+func newChainDialer(base contextDialer, hops []config.ParsedProxy) (contextDialer, error) {
+	if len(hops) == 0 {
+		return base, nil
+	}
+
+	var current contextDialer = base
+	names := make([]string, 0, len(hops))
+	for i, hop := range hops {
+		d, err := newHopDialer(hop, current, nil)
+		if err != nil {
+			return nil, fmt.Errorf("proxy chain hop %d: %w", i+1, err)
+		}
+		current = d
+		names = append(names, fmt.Sprintf("%s://%s", hop.Type, hop.Address))
+	}
+	return &chainDialer{dialer: current, hops: names}, nil
+}
+
+// newHopDialer returns a dialer that reaches addresses through hop, which is
+// itself reached through forward. header is only used for HTTP(S) proxies.
+func newHopDialer(hop config.ParsedProxy, forward contextDialer, header http.Header) (contextDialer, error) {
+	if hop.Address == "" {
+		return nil, errors.New("address required")
+	}
+	switch hop.Type {
+	case "socks5":
+		var auth *proxy.Auth
+		if hop.Username != "" {
+			auth = &proxy.Auth{User: hop.Username, Password: hop.Password}
+		}
+		d, err := proxy.SOCKS5("tcp", hop.Address, auth, forward)
+		if err != nil {
+			return nil, err
+		}
+		cd, ok := d.(contextDialer)
+		if !ok {
+			return nil, errors.New("socks5 dialer does not support contexts")
+		}
+		return cd, nil
+	case "http", "https":
+		return &connectDialer{proxy: hop, forward: forward, header: header}, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", hop.Type)
+	}
+}
+
+// entryDialer opens raw TCP tunnels through a pool proxy, for traffic that
+// does not go through http.Transport.
+type entryDialer struct {
+	proxy   config.ParsedProxy
+	forward contextDialer
+	header  http.Header
+	creds   *sessionCredentials
+}
+
+func newEntryDialer(p config.ParsedProxy, opts transportOptions) (*entryDialer, error) {
+	forward, err := newChainDialer(opts.newDialer(), opts.chain)
+	if err != nil {
+		return nil, err
+	}
+	return &entryDialer{
+		proxy:   p,
+		forward: forward,
+		header:  opts.connectHeaders,
+		creds:   newSessionCredentials(p, opts.sessionTTL),
+	}, nil
+}
+
+func (d *entryDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	p := d.proxy
+	if d.creds != nil {
+		p.Username, p.Password = d.creds.next()
+	}
+	hop, err := newHopDialer(p, d.forward, d.header)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s://%s: %w", p.Type, p.Address, err)
+	}
+	return hop.DialContext(ctx, network, addr)
+}
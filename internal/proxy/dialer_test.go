@@ -0,0 +1,398 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// testProxy is a minimal HTTP proxy supporting CONNECT tunnels and absolute-URI forwarding.
+type testProxy struct {
+	*httptest.Server
+	mu       sync.Mutex
+	connects []string
+	forwards []string
+	headers  []http.Header
+}
+
+func newTestProxy(t *testing.T) *testProxy {
+	t.Helper()
+	p := &testProxy{}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testProxy) addr() string {
+	return strings.TrimPrefix(p.URL, "http://")
+}
+
+func (p *testProxy) serve(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.headers = append(p.headers, r.Header.Clone())
+	p.mu.Unlock()
+
+	if r.Method == http.MethodConnect {
+		p.mu.Lock()
+		p.connects = append(p.connects, r.Host)
+		p.mu.Unlock()
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			upstream.Close()
+			http.Error(w, "hijack unsupported", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		client, buf, err := hj.Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		if buf.Reader.Buffered() > 0 {
+			pending, _ := buf.Reader.Peek(buf.Reader.Buffered())
+			_, _ = upstream.Write(pending)
+		}
+		go func() {
+			_, _ = io.Copy(upstream, client)
+			upstream.Close()
+		}()
+		_, _ = io.Copy(client, upstream)
+		client.Close()
+		return
+	}
+
+	p.mu.Lock()
+	p.forwards = append(p.forwards, r.URL.String())
+	p.mu.Unlock()
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	resp, err := http.DefaultTransport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func TestProxyChain_ThroughJumpProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer target.Close()
+
+	jump := newTestProxy(t)
+	exit := newTestProxy(t)
+
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:  []string{exit.URL},
+		Chain: []string{jump.URL},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "hello" {
+		t.Errorf("body = %q, want %q", body, "hello")
+	}
+	if len(jump.connects) != 1 || jump.connects[0] != exit.addr() {
+		t.Errorf("jump proxy CONNECTs = %v, want [%s]", jump.connects, exit.addr())
+	}
+	if len(exit.forwards) != 1 {
+		t.Errorf("exit proxy forwarded %d requests, want 1", len(exit.forwards))
+	}
+}
+
+func TestProxyChain_HopFailure(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:  []string{"http://exit.invalid:8080"},
+		Chain: []string{"http://127.0.0.1:1"},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://target.invalid/", nil)
+	_, err = pool.RoundTrip(req)
+	if err == nil {
+		t.Fatal("RoundTrip() expected error when jump proxy is unreachable")
+	}
+	if !strings.Contains(err.Error(), "proxy chain [http://127.0.0.1:1]") {
+		t.Errorf("error %q should name the proxy chain", err)
+	}
+}
+
+func TestNewChainDialer_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		hops []config.ParsedProxy
+	}{
+		{"missing address", []config.ParsedProxy{{Type: "socks5"}}},
+		{"unsupported type", []config.ParsedProxy{{Type: "ftp", Address: "host:21"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newChainDialer(&net.Dialer{}, tt.hops); err == nil {
+				t.Error("newChainDialer() expected error")
+			}
+		})
+	}
+}
+
+func TestProxyPool_ConnectHeaders(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+	tp := newTestProxy(t)
+
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:           []string{"http://" + tp.addr()},
+		ConnectHeaders: map[string]string{"X-Session-Id": "sticky-42"},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	tr := pool.entries[0].transport.(*http.Transport)
+	tr.TLSClientConfig = backend.Client().Transport.(*http.Transport).TLSClientConfig
+
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if len(tp.connects) != 1 {
+		t.Fatalf("CONNECT requests = %d, want 1", len(tp.connects))
+	}
+	if got := tp.headers[0].Get("X-Session-Id"); got != "sticky-42" {
+		t.Errorf("CONNECT X-Session-Id = %q, want %q", got, "sticky-42")
+	}
+}
+
+// ntlmChallengeMessage is a minimal NTLM CHALLENGE message with no target
+// name or info, negotiating Unicode and NTLM.
+func ntlmChallengeMessage() []byte {
+	msg := make([]byte, 48)
+	copy(msg, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[20:], 0x00000201)
+	copy(msg[24:32], "chalenge")
+	return msg
+}
+
+func TestProxyPool_NTLMAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	var (
+		mu       sync.Mutex
+		messages []uint32
+		remotes  []string
+	)
+	tp := &testProxy{}
+	tp.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, _ := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+		msg, err := base64.StdEncoding.DecodeString(token)
+		if scheme != "NTLM" || err != nil || len(msg) < 12 || string(msg[:8]) != "NTLMSSP\x00" {
+			w.Header().Set("Proxy-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		typ := binary.LittleEndian.Uint32(msg[8:])
+		mu.Lock()
+		messages = append(messages, typ)
+		remotes = append(remotes, r.RemoteAddr)
+		mu.Unlock()
+		if typ == 1 {
+			w.Header().Set("Proxy-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(ntlmChallengeMessage()))
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			_, _ = io.WriteString(w, "authentication required")
+			return
+		}
+		tp.serve(w, r)
+	}))
+	defer tp.Close()
+
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs: []string{"http://alice:secret@" + tp.addr()},
+		Auth: config.ProxyAuth{Scheme: "ntlm", Domain: "CORP"},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(messages) != 2 || messages[0] != 1 || messages[1] != 3 {
+		t.Fatalf("NTLM messages = %v, want [1 3]", messages)
+	}
+	if remotes[0] != remotes[1] {
+		t.Errorf("handshake used connections %s and %s, want one", remotes[0], remotes[1])
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	// Plain HTTP targets are tunnelled too, since NTLM authenticates the connection
+	if len(tp.connects) != 1 || len(tp.forwards) != 0 {
+		t.Errorf("CONNECTs = %v, forwards = %v, want one CONNECT", tp.connects, tp.forwards)
+	}
+}
+
+func TestProxyPool_NTLMAuthRejected(t *testing.T) {
+	tp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Proxy-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(ntlmChallengeMessage()))
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer tp.Close()
+
+	d := &connectDialer{
+		proxy: config.ParsedProxy{
+			Type:       "http",
+			Address:    strings.TrimPrefix(tp.URL, "http://"),
+			Username:   "alice",
+			Password:   "wrong",
+			AuthScheme: "ntlm",
+		},
+		forward: &net.Dialer{},
+	}
+	_, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("DialContext() error = %v, want a 407 refusal", err)
+	}
+}
+
+// newEchoServer accepts TCP connections and writes back whatever it reads.
+func newEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestProxyPool_DialContext(t *testing.T) {
+	echo := newEchoServer(t)
+
+	tests := []struct {
+		name         string
+		bypass       []string
+		wantConnects int
+	}{
+		{name: "through proxy", wantConnects: 1},
+		{name: "bypassed", bypass: []string{"127.0.0.1"}, wantConnects: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestProxy(t)
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs:   []string{"http://" + tp.addr()},
+				Bypass: tt.bypass,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := pool.DialContext(context.Background(), "tcp", echo.Addr().String())
+			if err != nil {
+				t.Fatalf("DialContext() error = %v", err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "ping" {
+				t.Errorf("echo = %q, want ping", got)
+			}
+
+			tp.mu.Lock()
+			defer tp.mu.Unlock()
+			if len(tp.connects) != tt.wantConnects {
+				t.Errorf("proxy saw %d CONNECTs, want %d", len(tp.connects), tt.wantConnects)
+			}
+		})
+	}
+}
+
+func TestProxyPool_DialContext_TriesNext(t *testing.T) {
+	echo := newEchoServer(t)
+	tp := newTestProxy(t)
+	dead := newTestProxy(t)
+	deadAddr := dead.addr()
+	dead.Close()
+
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs: []string{"http://" + deadAddr, "http://" + tp.addr()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := pool.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	conn.Close()
+}
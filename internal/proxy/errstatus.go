@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// ErrorStatus picks the status and short message sent to the client when a
+// request could not be proxied: 504 for timeouts, 503 when no proxy may be
+// used or the upstream refused the connection, 400 for an unknown proxy
+// selected by header, 403 for a target the SSRF guard refuses and 502 for
+// anything else, DNS failures included.
+func ErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrNoProxyAvailable):
+		return http.StatusServiceUnavailable, "no healthy upstream proxy available"
+	case errors.Is(err, ErrUnknownProxy):
+		return http.StatusBadRequest, "unknown proxy selected"
+	case errors.Is(err, ErrProxyUnavailable):
+		return http.StatusServiceUnavailable, "selected proxy unavailable"
+	case errors.Is(err, ErrBlockedTarget):
+		return http.StatusForbidden, "target address not allowed"
+	case isTimeoutError(err):
+		return http.StatusGatewayTimeout, "upstream timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusServiceUnavailable, "upstream connection refused"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return http.StatusBadGateway, "upstream host not found"
+	}
+	return http.StatusBadGateway, "proxy error"
+}
+
+// ClientGone reports whether r failed because the client cancelled it, in
+// which case there is nobody left to send an error response to.
+func ClientGone(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "no proxy available", err: ErrNoProxyAvailable, want: http.StatusServiceUnavailable},
+		{name: "unknown proxy", err: fmt.Errorf("select: %w", ErrUnknownProxy), want: http.StatusBadRequest},
+		{name: "selected proxy unavailable", err: ErrProxyUnavailable, want: http.StatusServiceUnavailable},
+		{name: "blocked target", err: &net.OpError{Op: "dial", Net: "tcp", Err: ErrBlockedTarget}, want: http.StatusForbidden},
+		{name: "deadline exceeded", err: &url.Error{Op: "Get", URL: "http://x", Err: context.DeadlineExceeded}, want: http.StatusGatewayTimeout},
+		{
+			name: "connection refused",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			want: http.StatusServiceUnavailable,
+		},
+		{name: "dns failure", err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "x", IsNotFound: true}}, want: http.StatusBadGateway},
+		{name: "dns timeout", err: &net.DNSError{Err: "timeout", Name: "x", IsTimeout: true}, want: http.StatusGatewayTimeout},
+		{name: "other", err: errors.New("boom"), want: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := ErrorStatus(tt.err); got != tt.want {
+				t.Errorf("ErrorStatus() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxExitIPBody bounds how much of the IP echo response is read.
+const maxExitIPBody = 1024
+
+// fetchExitIP asks the IP echo endpoint at rawURL which address the request
+// came from. The body may be a bare IP or a JSON object with an "ip" field.
+func fetchExitIP(ctx context.Context, rt http.RoundTripper, rawURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxExitIPBody))
+	if err != nil {
+		return "", err
+	}
+
+	text := strings.TrimSpace(string(body))
+	if strings.HasPrefix(text, "{") {
+		var v struct {
+			IP string `json:"ip"`
+		}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return "", fmt.Errorf("decode response: %w", err)
+		}
+		text = strings.TrimSpace(v.IP)
+	}
+	ip := net.ParseIP(text)
+	if ip == nil {
+		return "", fmt.Errorf("response is not an IP address: %q", text)
+	}
+	return ip.String(), nil
+}
+
+// checkExitIP records the entry's exit IP and fails when it matches the
+// direct IP while rejectDirectIP is set. Direct entries are meant to use
+// the direct IP and are not compared.
+func (p *ProxyPool) checkExitIP(ctx context.Context, entry *proxyEntry) error {
+	ip, err := fetchExitIP(ctx, entry.healthTransport(), p.exitIPURL)
+	if err != nil {
+		return fmt.Errorf("exit ip lookup: %w", err)
+	}
+	entry.mu.Lock()
+	entry.exitIP = ip
+	entry.mu.Unlock()
+
+	if !p.rejectDirectIP || entry.proxy.Type == "direct" {
+		return nil
+	}
+	if direct := p.directIP.Load(); direct != nil && *direct == ip {
+		return fmt.Errorf("exit ip %s matches direct ip", ip)
+	}
+	return nil
+}
+
+// refreshDirectIP looks up the exit IP without a proxy. The previous value is
+// kept when the lookup fails.
+func (p *ProxyPool) refreshDirectIP(parent context.Context) {
+	ctx, cancel := context.WithTimeout(parent, defaultHealthCheckTimeout)
+	defer cancel()
+	ip, err := fetchExitIP(ctx, p.directProbe, p.exitIPURL)
+	if err != nil {
+		if p.logger != nil {
+			p.logger.Warn("direct exit ip lookup failed", "error", err)
+		}
+		return
+	}
+	p.directIP.Store(&ip)
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// textResponse answers every request with status and body.
+func textResponse(status int, body string) roundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: status,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	}
+}
+
+func TestFetchExitIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		rt      roundTripFunc
+		want    string
+		wantErr bool
+	}{
+		{name: "plain text", rt: textResponse(http.StatusOK, "203.0.113.7\n"), want: "203.0.113.7"},
+		{name: "json", rt: textResponse(http.StatusOK, `{"ip":"2001:db8::1"}`), want: "2001:db8::1"},
+		{name: "not an ip", rt: textResponse(http.StatusOK, "<html>login</html>"), wantErr: true},
+		{name: "error status", rt: textResponse(http.StatusBadGateway, "203.0.113.7"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fetchExitIP(context.Background(), tt.rt, "http://ip.example/")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchExitIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("fetchExitIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyPool_ExitIPCheck(t *testing.T) {
+	const exitURL = "http://ip.example/"
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs: []string{"http://transparent:8080", "http://working:8080", "direct"},
+		HealthCheck: config.HealthCheckConfig{
+			ExitIPURL:          exitURL,
+			RejectDirectExitIP: true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	pool.directProbe = textResponse(http.StatusOK, "198.51.100.1")
+	exitIPs := []string{"198.51.100.1", "203.0.113.7", "198.51.100.1"}
+	for i, e := range pool.entries {
+		ip := exitIPs[i]
+		e.checkTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			if r.URL.String() == exitURL {
+				return textResponse(http.StatusOK, ip)(r)
+			}
+			return stubResponse(http.StatusNoContent, nil)(r)
+		})
+	}
+
+	pool.checkAllProxies(context.Background())
+
+	status := pool.GetStatus()
+	if status[0].Healthy || !strings.Contains(status[0].LastError, "matches direct ip") {
+		t.Errorf("transparent proxy: healthy = %v, last_error = %q", status[0].Healthy, status[0].LastError)
+	}
+	if !status[1].Healthy || status[1].ExitIP != "203.0.113.7" {
+		t.Errorf("working proxy: healthy = %v, exit_ip = %q", status[1].Healthy, status[1].ExitIP)
+	}
+	if !status[2].Healthy {
+		t.Errorf("direct entry should not be rejected for the direct ip: last_error = %q", status[2].LastError)
+	}
+}
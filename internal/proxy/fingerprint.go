@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// tlsFingerprints maps tls.fingerprint names to the browser ClientHellos
+// they imitate.
+var tlsFingerprints = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"safari":  utls.HelloSafari_Auto,
+	"edge":    utls.HelloEdge_Auto,
+	"ios":     utls.HelloIOS_Auto,
+}
+
+// handshakeTLS runs a client handshake over conn, with Go's own ClientHello
+// or, when fingerprint is set, the named browser's. Only http/1.1 is offered
+// either way; ALPN values are not part of the JA3 hash.
+func handshakeTLS(ctx context.Context, conn net.Conn, cfg *tls.Config, fingerprint string) (net.Conn, error) {
+	if fingerprint == "" {
+		cfg.NextProtos = []string{"http/1.1"}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		return tc, nil
+	}
+
+	id, ok := tlsFingerprints[strings.ToLower(fingerprint)]
+	if !ok {
+		return nil, fmt.Errorf("unknown tls fingerprint %q", fingerprint)
+	}
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, fmt.Errorf("tls fingerprint %s: %w", fingerprint, err)
+	}
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = []string{"http/1.1"}
+		}
+	}
+	uc := utls.UClient(conn, &utls.Config{
+		ServerName:         cfg.ServerName,
+		RootCAs:            cfg.RootCAs,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}, utls.HelloCustom)
+	if err := uc.ApplyPreset(&spec); err != nil {
+		return nil, fmt.Errorf("tls fingerprint %s: %w", fingerprint, err)
+	}
+	if err := uc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return uc, nil
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// isGREASE reports whether v is a reserved GREASE value, which browsers send
+// and Go's own ClientHello never does.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func TestProxyPool_TLSFingerprint(t *testing.T) {
+	tests := []struct {
+		name        string
+		fingerprint string
+		wantGREASE  bool
+	}{
+		{name: "go default", wantGREASE: false},
+		{name: "chrome", fingerprint: "chrome", wantGREASE: true},
+		{name: "firefox", fingerprint: "firefox", wantGREASE: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hello *tls.ClientHelloInfo
+			target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.ProtoMajor != 1 {
+					t.Errorf("proto = %s, want HTTP/1.1", r.Proto)
+				}
+			}))
+			target.EnableHTTP2 = true
+			target.TLS = &tls.Config{GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+				hello = h
+				return nil, nil
+			}}
+			target.StartTLS()
+			defer target.Close()
+
+			pool, err := NewProxyPool(config.ProxyConfig{
+				Transport: config.TransportConfig{TLSFingerprint: tt.fingerprint, HeaderOrder: []string{"Host"}},
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			tr := pool.entries[0].transport.(*http.Transport)
+			tr.TLSClientConfig = &tls.Config{RootCAs: target.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+			req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+			resp, err := pool.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			resp.Body.Close()
+
+			grease := false
+			for _, c := range hello.CipherSuites {
+				grease = grease || isGREASE(c)
+			}
+			if grease != tt.wantGREASE {
+				t.Errorf("GREASE cipher suites = %v, want %v (%x)", grease, tt.wantGREASE, hello.CipherSuites)
+			}
+		})
+	}
+}
+
+func TestNewProxyPool_UnknownTLSFingerprint(t *testing.T) {
+	_, err := NewProxyPool(config.ProxyConfig{Transport: config.TransportConfig{TLSFingerprint: "netscape"}})
+	if err == nil {
+		t.Fatal("NewProxyPool() error = nil, want unknown fingerprint")
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// ErrBlockedTarget is returned when a connection to a cloud metadata endpoint
+// or, with security.block_private_targets, a non-public address is refused.
+var ErrBlockedTarget = errors.New("target address not allowed")
+
+// nonPublicPrefixes are ranges not covered by the netip.Addr predicates
+// used in blocked.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// metadataAddrs are the instance metadata endpoints of the common clouds.
+var metadataAddrs = []netip.Addr{
+	netip.MustParseAddr("169.254.169.254"), // AWS, GCP, Azure, DigitalOcean, OpenStack
+	netip.MustParseAddr("169.254.170.2"),   // AWS ECS task metadata
+	netip.MustParseAddr("fd00:ec2::254"),   // AWS over IPv6
+	netip.MustParseAddr("100.100.100.200"), // Alibaba Cloud
+	netip.MustParseAddr("192.0.0.192"),     // Oracle Cloud
+}
+
+// targetGuard refuses connections to cloud metadata endpoints and, when
+// private is set, to loopback, private, link-local and other non-public
+// addresses outside the allowed ranges.
+type targetGuard struct {
+	metadata bool
+	private  bool
+	allow    []netip.Prefix
+}
+
+// newTargetGuard returns nil when no target is refused.
+func newTargetGuard(cfg config.SecurityConfig) (*targetGuard, error) {
+	if !cfg.BlockPrivateTargets && cfg.AllowMetadataTargets {
+		return nil, nil
+	}
+	g := &targetGuard{metadata: !cfg.AllowMetadataTargets, private: cfg.BlockPrivateTargets}
+	for _, cidr := range cfg.AllowTargetCIDRs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("security.allow_target_cidrs: %w", err)
+		}
+		g.allow = append(g.allow, prefix.Masked())
+	}
+	return g, nil
+}
+
+// blocked reports whether addr may not be connected to.
+func (g *targetGuard) blocked(addr netip.Addr) bool {
+	addr = addr.WithZone("").Unmap()
+	if g.metadata && slices.Contains(metadataAddrs, addr) {
+		return true
+	}
+	if !g.private {
+		return false
+	}
+	for _, prefix := range g.allow {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return true
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *targetGuard) check(addr netip.Addr) error {
+	if g.blocked(addr) {
+		return fmt.Errorf("%w: %s", ErrBlockedTarget, addr)
+	}
+	return nil
+}
+
+// control is a net.Dialer Control function. It runs for each address a host
+// name resolved to, right before connecting, so DNS answers cannot slip a
+// private address past the guard.
+func (g *targetGuard) control(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlockedTarget, address)
+	}
+	return g.check(ap.Addr())
+}
+
+// checkHost resolves host and refuses it if any of its addresses is blocked.
+// It guards targets reached through a proxy, which resolves the name itself,
+// so names that do not resolve locally are refused too. Only addresses are
+// checked when just metadata endpoints are blocked: those are the proxy's
+// metadata, not ours, and resolving every name would cost a lookup.
+func (g *targetGuard) checkHost(ctx context.Context, host string) error {
+	if g == nil {
+		return nil
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return g.check(addr)
+	}
+	if !g.private {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("%w: resolve %s: %v", ErrBlockedTarget, host, err)
+	}
+	for _, addr := range addrs {
+		if err := g.check(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dial wraps a dial through a proxy with checkHost.
+func (g *targetGuard) dial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if g == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if err := g.checkHost(ctx, host); err != nil {
+			return nil, err
+		}
+		return dial(ctx, network, addr)
+	}
+}
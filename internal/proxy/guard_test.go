@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestTargetGuard_Blocked(t *testing.T) {
+	g, err := newTargetGuard(config.SecurityConfig{
+		BlockPrivateTargets: true,
+		AllowTargetCIDRs:    []string{"10.20.0.0/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.0.0.1", true},
+		{"172.16.5.4", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fe80::1%eth0", true},
+		{"fd00:ec2::254", true},
+		{"::ffff:127.0.0.1", true},
+		{"10.20.1.1", false},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::1", false},
+	}
+	for _, tt := range tests {
+		if got := g.blocked(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("blocked(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestTargetGuard_Metadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		security config.SecurityConfig
+		addr     string
+		want     bool
+	}{
+		{name: "blocked by default", addr: "169.254.169.254", want: true},
+		{name: "ipv6 blocked by default", addr: "fd00:ec2::254", want: true},
+		{name: "mapped blocked by default", addr: "::ffff:169.254.169.254", want: true},
+		{name: "other link-local allowed by default", addr: "169.254.1.1", want: false},
+		{name: "loopback allowed by default", addr: "127.0.0.1", want: false},
+		{
+			name:     "allow cidrs do not cover metadata",
+			security: config.SecurityConfig{BlockPrivateTargets: true, AllowTargetCIDRs: []string{"169.254.0.0/16"}},
+			addr:     "169.254.169.254",
+			want:     true,
+		},
+		{
+			name:     "override",
+			security: config.SecurityConfig{AllowMetadataTargets: true},
+			addr:     "169.254.169.254",
+			want:     false,
+		},
+		{
+			name:     "override still private",
+			security: config.SecurityConfig{BlockPrivateTargets: true, AllowMetadataTargets: true},
+			addr:     "169.254.169.254",
+			want:     true,
+		},
+		{
+			name: "override with allowed range",
+			security: config.SecurityConfig{
+				BlockPrivateTargets:  true,
+				AllowMetadataTargets: true,
+				AllowTargetCIDRs:     []string{"169.254.169.254/32"},
+			},
+			addr: "169.254.169.254",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := newTargetGuard(tt.security)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := g != nil && g.blocked(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("blocked(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetGuard_MetadataOnlySkipsLookup(t *testing.T) {
+	g, err := newTargetGuard(config.SecurityConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// .invalid never resolves, so a lookup would fail
+	if err := g.checkHost(context.Background(), "metadata.invalid"); err != nil {
+		t.Errorf("checkHost(name) error = %v, want none", err)
+	}
+	if err := g.checkHost(context.Background(), "169.254.169.254"); !errors.Is(err, ErrBlockedTarget) {
+		t.Errorf("checkHost(address) error = %v, want ErrBlockedTarget", err)
+	}
+}
+
+func TestTargetGuard_Direct(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+
+	tests := []struct {
+		name      string
+		security  config.SecurityConfig
+		wantBlock bool
+	}{
+		{name: "off", wantBlock: false},
+		{name: "blocks loopback", security: config.SecurityConfig{BlockPrivateTargets: true}, wantBlock: true},
+		{
+			name:      "allowed range",
+			security:  config.SecurityConfig{BlockPrivateTargets: true, AllowTargetCIDRs: []string{"127.0.0.0/8"}},
+			wantBlock: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewProxyPool(config.ProxyConfig{Security: tt.security})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A name is resolved before the guard sees it
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost:"+port, nil)
+			resp, err := pool.RoundTrip(req)
+			if tt.wantBlock {
+				if !errors.Is(err, ErrBlockedTarget) {
+					t.Fatalf("RoundTrip() error = %v, want ErrBlockedTarget", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			resp.Body.Close()
+
+			conn, err := pool.DialContext(context.Background(), "tcp", target.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("DialContext() error = %v", err)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestTargetGuard_ThroughProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer target.Close()
+	tp := newTestProxy(t)
+
+	// The proxy itself is on loopback; only the target is checked
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:     []string{tp.URL},
+		Security: config.SecurityConfig{BlockPrivateTargets: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+	if _, err := pool.RoundTrip(req); !errors.Is(err, ErrBlockedTarget) {
+		t.Fatalf("RoundTrip() error = %v, want ErrBlockedTarget", err)
+	}
+	if _, err := pool.DialContext(context.Background(), "tcp", target.Listener.Addr().String()); !errors.Is(err, ErrBlockedTarget) {
+		t.Fatalf("DialContext() error = %v, want ErrBlockedTarget", err)
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if len(tp.forwards) != 0 || len(tp.connects) != 0 {
+		t.Errorf("proxy saw forwards %v and connects %v, want none", tp.forwards, tp.connects)
+	}
+}
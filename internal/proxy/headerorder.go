@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type orderedState int
+
+const (
+	stateHead orderedState = iota
+	stateBody
+	stateChunkSize
+	stateChunkData
+	stateTrailer
+	statePassthrough
+)
+
+// Go writes request headers in a fixed order: Host and User-Agent first, the
+// rest sorted by name, with no hook to change it. With header_order set the
+// connections of a transport are wrapped in orderedConn, which rewrites the
+// header block of every HTTP/1.1 request as it is written.
+//
+// orderedConn reorders the header lines of each request written to it and
+// passes bodies through, following Content-Length and chunked framing to
+// find where the next request starts. After a CONNECT, an upgrade or
+// anything that is not HTTP it stops looking and passes bytes through.
+type orderedConn struct {
+	net.Conn
+	rank  map[string]int
+	state orderedState
+	// buf holds an incomplete header block, chunk size line or trailer
+	buf bytes.Buffer
+	// remaining counts body or chunk bytes, chunk CRLF included, still to pass
+	remaining int64
+}
+
+func newOrderedConn(conn net.Conn, order []string) *orderedConn {
+	rank := make(map[string]int, len(order))
+	for _, name := range order {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if _, ok := rank[name]; !ok {
+			rank[name] = len(rank)
+		}
+	}
+	return &orderedConn{Conn: conn, rank: rank}
+}
+
+func (c *orderedConn) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		var err error
+		if p, err = c.step(p); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// step consumes the start of p according to the current state and returns
+// what is left.
+func (c *orderedConn) step(p []byte) ([]byte, error) {
+	switch c.state {
+	case statePassthrough:
+		_, err := c.Conn.Write(p)
+		return nil, err
+
+	case stateBody, stateChunkData:
+		n := min(int64(len(p)), c.remaining)
+		if _, err := c.Conn.Write(p[:n]); err != nil {
+			return nil, err
+		}
+		if c.remaining -= n; c.remaining == 0 {
+			if c.state == stateBody {
+				c.state = stateHead
+			} else {
+				c.state = stateChunkSize
+			}
+		}
+		return p[n:], nil
+
+	case stateChunkSize:
+		line, rest, ok := c.line(p, "\r\n")
+		if !ok {
+			return nil, nil
+		}
+		if _, err := c.Conn.Write(line); err != nil {
+			return nil, err
+		}
+		hex, _, _ := strings.Cut(strings.TrimSpace(string(line)), ";")
+		size, err := strconv.ParseInt(hex, 16, 64)
+		if err != nil {
+			return nil, errors.New("header order: invalid chunk size")
+		}
+		if size == 0 {
+			c.state = stateTrailer
+		} else {
+			c.state, c.remaining = stateChunkData, size+2
+		}
+		return rest, nil
+
+	case stateTrailer:
+		line, rest, ok := c.line(p, "\r\n")
+		if !ok {
+			return nil, nil
+		}
+		if _, err := c.Conn.Write(line); err != nil {
+			return nil, err
+		}
+		if string(line) == "\r\n" {
+			c.state = stateHead
+		}
+		return rest, nil
+	}
+
+	// stateHead
+	if c.buf.Len() == 0 && !looksLikeRequest(p) {
+		c.state = statePassthrough
+		return p, nil
+	}
+	head, rest, ok := c.line(p, "\r\n\r\n")
+	if !ok {
+		return nil, nil
+	}
+	ordered, method, framing := c.reorder(head)
+	if _, err := c.Conn.Write(ordered); err != nil {
+		return nil, err
+	}
+	switch {
+	case method == http.MethodConnect || framing.upgrade:
+		c.state = statePassthrough
+	case framing.chunked:
+		c.state = stateChunkSize
+	case framing.length > 0:
+		c.state, c.remaining = stateBody, framing.length
+	}
+	return rest, nil
+}
+
+// line returns the buffered bytes plus p up to and including sep, or false
+// after buffering p when sep has not been written yet.
+func (c *orderedConn) line(p []byte, sep string) (line, rest []byte, ok bool) {
+	// sep may straddle the buffered bytes and p
+	start := max(c.buf.Len()-len(sep)+1, 0)
+	c.buf.Write(p)
+	i := bytes.Index(c.buf.Bytes()[start:], []byte(sep))
+	if i < 0 {
+		return nil, nil, false
+	}
+	end := start + i + len(sep)
+	all := c.buf.Bytes()
+	line = bytes.Clone(all[:end])
+	// sep was not complete before p was added, so what follows it is all from p
+	rest = p[len(p)-(len(all)-end):]
+	c.buf.Reset()
+	return line, rest, true
+}
+
+// looksLikeRequest reports whether p starts like an HTTP request line rather
+// than, say, a TLS record tunnelled after CONNECT.
+func looksLikeRequest(p []byte) bool {
+	return len(p) > 0 && p[0] >= 'A' && p[0] <= 'Z'
+}
+
+type bodyFraming struct {
+	length  int64
+	chunked bool
+	upgrade bool
+}
+
+// reorder moves the header lines named in the configured order to the top,
+// in that order, keeping the rest as Go wrote them.
+func (c *orderedConn) reorder(head []byte) ([]byte, string, bodyFraming) {
+	lines := strings.Split(strings.TrimSuffix(string(head), "\r\n\r\n"), "\r\n")
+	method, _, _ := strings.Cut(lines[0], " ")
+	var framing bodyFraming
+	type header struct {
+		line string
+		rank int
+	}
+	headers := make([]header, 0, len(lines)-1)
+	for _, l := range lines[1:] {
+		name, value, _ := strings.Cut(l, ":")
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		switch name {
+		case "Content-Length":
+			framing.length, _ = strconv.ParseInt(value, 10, 64)
+		case "Transfer-Encoding":
+			framing.chunked = strings.EqualFold(value, "chunked")
+		case "Upgrade":
+			framing.upgrade = true
+		}
+		rank, ok := c.rank[name]
+		if !ok {
+			rank = len(c.rank)
+		}
+		headers = append(headers, header{line: l, rank: rank})
+	}
+	// A stable sort keeps unlisted headers, and repeats, in their order
+	slices.SortStableFunc(headers, func(a, b header) int { return a.rank - b.rank })
+	var out bytes.Buffer
+	out.Grow(len(head))
+	out.WriteString(lines[0])
+	out.WriteString("\r\n")
+	for _, h := range headers {
+		out.WriteString(h.line)
+		out.WriteString("\r\n")
+	}
+	out.WriteString("\r\n")
+	return out.Bytes(), method, framing
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// captureConn records what is written to it.
+type captureConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *captureConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+func TestOrderedConn(t *testing.T) {
+	in := "POST /a HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\nContent-Length: 5\r\nX-B: 1\r\nX-A: 2\r\n\r\nhello" +
+		"POST /b HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nX-A: 3\r\n\r\n" +
+		"3\r\nabc\r\n0\r\nX-Trailer: t\r\n\r\n" +
+		"GET /c HTTP/1.1\r\nHost: example.com\r\nX-B: 4\r\nX-A: 5\r\nX-B: 6\r\n\r\n"
+	want := "POST /a HTTP/1.1\r\nX-A: 2\r\nX-B: 1\r\nHost: example.com\r\nAccept: */*\r\nContent-Length: 5\r\n\r\nhello" +
+		"POST /b HTTP/1.1\r\nX-A: 3\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3\r\nabc\r\n0\r\nX-Trailer: t\r\n\r\n" +
+		"GET /c HTTP/1.1\r\nX-A: 5\r\nX-B: 4\r\nX-B: 6\r\nHost: example.com\r\n\r\n"
+
+	for _, size := range []int{1, 7, len(in)} {
+		out := &captureConn{}
+		c := newOrderedConn(out, []string{"x-a", "X-B", "x-a"})
+		for p := []byte(in); len(p) > 0; {
+			n := min(size, len(p))
+			if _, err := c.Write(p[:n]); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			p = p[n:]
+		}
+		if out.buf.String() != want {
+			t.Errorf("writes of %d bytes:\ngot  %q\nwant %q", size, out.buf.String(), want)
+		}
+	}
+}
+
+func TestOrderedConn_Passthrough(t *testing.T) {
+	for _, in := range []string{
+		"\x16\x03\x01 not a request\r\n\r\n",
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n\x16\x03\x01 tls\r\n\r\n",
+	} {
+		out := &captureConn{}
+		c := newOrderedConn(out, []string{"Host"})
+		if _, err := c.Write([]byte(in)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		if out.buf.String() != in {
+			t.Errorf("got %q, want %q unchanged", out.buf.String(), in)
+		}
+	}
+}
+
+// headerNames serves HTTP/1.1 on a raw listener and reports the header names
+// of each request in the order they arrived.
+func headerNames(t *testing.T) (string, <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	names := make(chan []string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					var got []string
+					if _, err := br.ReadString('\n'); err != nil {
+						return
+					}
+					for {
+						line, err := br.ReadString('\n')
+						if err != nil {
+							return
+						}
+						if line == "\r\n" {
+							break
+						}
+						name, _, _ := strings.Cut(line, ":")
+						got = append(got, name)
+					}
+					names <- got
+					_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), names
+}
+
+func TestProxyPool_HeaderOrder(t *testing.T) {
+	addr, names := headerNames(t)
+	order := []string{"Accept", "User-Agent", "Host"}
+	// Unlisted headers keep Go's order, in which the transport's own Accept-Encoding comes last
+	want := []string{"Accept", "User-Agent", "Host", "X-Custom", "Accept-Encoding"}
+
+	tests := []struct {
+		name string
+		urls func(t *testing.T) []string
+	}{
+		{name: "direct", urls: func(t *testing.T) []string { return nil }},
+		{name: "http proxy", urls: func(t *testing.T) []string { return []string{"http://" + newTestProxy(t).addr()} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs:      tt.urls(t),
+				Transport: config.TransportConfig{HeaderOrder: order},
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			// Twice, so the second request reuses the connection
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+				req.Header.Set("X-Custom", "1")
+				req.Header.Set("Accept", "*/*")
+				resp, err := pool.RoundTrip(req)
+				if err != nil {
+					t.Fatalf("RoundTrip() error = %v", err)
+				}
+				resp.Body.Close()
+				if got := <-names; !slices.Equal(got, want) {
+					t.Errorf("request %d header order = %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyPool_HeaderOrderTLS(t *testing.T) {
+	var proto string
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+	}))
+	defer target.Close()
+
+	pool, err := NewProxyPool(config.ProxyConfig{
+		Transport: config.TransportConfig{HeaderOrder: []string{"User-Agent", "Host"}},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	tr := pool.entries[0].transport.(*http.Transport)
+	tr.TLSClientConfig = &tls.Config{RootCAs: target.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+	req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+	if proto != "HTTP/1.1" {
+		t.Errorf("proto = %q, want HTTP/1.1", proto)
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencySamples is how many recent response times are kept per proxy
+const latencySamples = 512
+
+// LatencyStats summarizes recent response times of a proxy, in milliseconds.
+type LatencyStats struct {
+	P50     float64 `json:"p50_ms"`
+	P95     float64 `json:"p95_ms"`
+	P99     float64 `json:"p99_ms"`
+	Samples int     `json:"samples"`
+}
+
+// latencyWindow is a ring buffer of the most recent response times.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	count   int
+}
+
+func (w *latencyWindow) observe(d time.Duration) {
+	w.mu.Lock()
+	w.samples[w.count%latencySamples] = d
+	w.count++
+	w.mu.Unlock()
+}
+
+// stats returns percentiles over the window, or false when nothing was recorded.
+func (w *latencyWindow) stats() (LatencyStats, bool) {
+	w.mu.Lock()
+	n := min(w.count, latencySamples)
+	sorted := slices.Clone(w.samples[:n])
+	w.mu.Unlock()
+	if n == 0 {
+		return LatencyStats{}, false
+	}
+
+	slices.Sort(sorted)
+	return LatencyStats{
+		P50:     percentileMs(sorted, 0.50),
+		P95:     percentileMs(sorted, 0.95),
+		P99:     percentileMs(sorted, 0.99),
+		Samples: n,
+	}, true
+}
+
+// percentileMs uses the nearest-rank method on sorted samples.
+func percentileMs(sorted []time.Duration, q float64) float64 {
+	idx := int(math.Ceil(q*float64(len(sorted)))) - 1
+	idx = max(idx, 0)
+	return float64(sorted[idx].Microseconds()) / 1000
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestLatencyWindow_Stats(t *testing.T) {
+	var w latencyWindow
+	if _, ok := w.stats(); ok {
+		t.Error("empty window should report no stats")
+	}
+
+	for i := 1; i <= 100; i++ {
+		w.observe(time.Duration(i) * time.Millisecond)
+	}
+	got, ok := w.stats()
+	if !ok {
+		t.Fatal("stats() reported no samples")
+	}
+	want := LatencyStats{P50: 50, P95: 95, P99: 99, Samples: 100}
+	if got != want {
+		t.Errorf("stats() = %+v, want %+v", got, want)
+	}
+
+	// Older samples fall out once the window is full
+	for i := 0; i < latencySamples; i++ {
+		w.observe(time.Second)
+	}
+	if got, _ := w.stats(); got.P50 != 1000 || got.Samples != latencySamples {
+		t.Errorf("stats() after wrap = %+v, want p50 1000ms over %d samples", got, latencySamples)
+	}
+}
+
+func TestProxyPool_RecordsLatency(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{URLs: []string{"http://proxy1:8080"}})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	if pool.GetStatus()[0].Latency != nil {
+		t.Error("latency should be nil before any request")
+	}
+
+	pool.entries[0].transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		time.Sleep(5 * time.Millisecond)
+		return stubResponse(http.StatusOK, nil)(r)
+	})
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if _, err := pool.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+
+	latency := pool.GetStatus()[0].Latency
+	if latency == nil || latency.Samples != 1 || latency.P50 < 5 {
+		t.Errorf("latency = %+v, want one sample of at least 5ms", latency)
+	}
+}
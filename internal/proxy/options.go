@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// PoolOptions configures a pool built by NewProxyPoolFromProxies. The zero
+// value matches an empty proxy section in the config file.
+type PoolOptions struct {
+	// Selector picks proxies; nil uses round-robin
+	Selector Selector
+	// Timeouts for connecting to proxies and keeping idle connections
+	Timeouts    config.TimeoutConfig
+	HealthCheck config.HealthCheckConfig
+	// Dial tunes TCP keep-alive and TCP_NODELAY; nil uses the config file defaults
+	Dial *config.DialConfig
+	// Transport controls keep-alives and automatic compression
+	Transport config.TransportConfig
+	// OnAllUnhealthy is "fallback" (default), "fail" or "direct"
+	OnAllUnhealthy string
+	// AllowDirectFallback retries a request without a proxy after every proxy failed
+	AllowDirectFallback bool
+	// Bypass lists hosts reached directly, in NO_PROXY syntax
+	Bypass []string
+	// Routes send target hosts to the proxies whose Group they name
+	Routes []config.ProxyRoute
+	// Chain lists jump proxy URLs used to reach every proxy
+	Chain []string
+	// ConnectHeaders are added to CONNECT requests sent to HTTP(S) proxies
+	ConnectHeaders map[string]string
+	// SessionTTL keeps a generated {session} credential for this long
+	SessionTTL time.Duration
+	// RetryBudget caps retries to a share of recent requests; zero allows all
+	RetryBudget config.RetryBudgetConfig
+}
+
+// NewProxyPoolFromProxies builds a pool from proxies assembled at runtime,
+// without going through ProxyConfig. An empty list connects directly.
+func NewProxyPoolFromProxies(proxies []config.ParsedProxy, opts PoolOptions) (*ProxyPool, error) {
+	list := make([]config.ParsedProxy, len(proxies))
+	groups := make(map[string]bool)
+	for i, p := range proxies {
+		p.Type = strings.ToLower(p.Type)
+		if err := validateParsedProxy(p); err != nil {
+			return nil, fmt.Errorf("proxy %d: %w", i, err)
+		}
+		list[i] = p
+		groups[p.Group] = true
+	}
+	for i, r := range opts.Routes {
+		if r.Group == "" || !groups[r.Group] {
+			return nil, fmt.Errorf("route %d: no proxy in group %q", i, r.Group)
+		}
+	}
+	switch strings.ToLower(opts.OnAllUnhealthy) {
+	case "", "fallback", "fail", "direct":
+	default:
+		return nil, fmt.Errorf("unsupported on_all_unhealthy policy: %s", opts.OnAllUnhealthy)
+	}
+
+	dial := config.DefaultConfig().Proxy.Dial
+	if opts.Dial != nil {
+		dial = *opts.Dial
+	}
+	cfg := config.ProxyConfig{
+		Timeouts:            opts.Timeouts,
+		Dial:                dial,
+		Transport:           opts.Transport,
+		HealthCheck:         opts.HealthCheck,
+		OnAllUnhealthy:      opts.OnAllUnhealthy,
+		AllowDirectFallback: opts.AllowDirectFallback,
+		Bypass:              opts.Bypass,
+		Routes:              opts.Routes,
+		Chain:               opts.Chain,
+		ConnectHeaders:      opts.ConnectHeaders,
+		SessionTTLSeconds:   int(opts.SessionTTL / time.Second),
+		RetryBudget:         opts.RetryBudget,
+	}
+	return newProxyPool(list, cfg, opts.Selector)
+}
+
+func validateParsedProxy(p config.ParsedProxy) error {
+	switch p.Type {
+	case "direct":
+		return nil
+	case "socks5", "http", "https":
+	default:
+		return fmt.Errorf("unsupported proxy type: %q", p.Type)
+	}
+	if p.Address == "" {
+		return errors.New("missing proxy address")
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestNewProxyPoolFromProxies(t *testing.T) {
+	tests := []struct {
+		name     string
+		proxies  []config.ParsedProxy
+		opts     PoolOptions
+		wantSize int
+		wantErr  bool
+	}{
+		{name: "empty list is direct", wantSize: 1},
+		{
+			name: "mixed proxies",
+			proxies: []config.ParsedProxy{
+				{Type: "SOCKS5", Address: "proxy1:1080", Username: "user", Password: "pass"},
+				{Type: "http", Address: "proxy2:8080"},
+				{Type: "direct"},
+			},
+			opts:     PoolOptions{Selector: Random(), OnAllUnhealthy: "fail"},
+			wantSize: 3,
+		},
+		{name: "unknown type", proxies: []config.ParsedProxy{{Type: "ftp", Address: "proxy:21"}}, wantErr: true},
+		{name: "missing address", proxies: []config.ParsedProxy{{Type: "http"}}, wantErr: true},
+		{name: "bad policy", proxies: []config.ParsedProxy{{Type: "http", Address: "proxy:8080"}}, opts: PoolOptions{OnAllUnhealthy: "panic"}, wantErr: true},
+		{name: "bad chain", proxies: []config.ParsedProxy{{Type: "http", Address: "proxy:8080"}}, opts: PoolOptions{Chain: []string{"ftp://jump:21"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewProxyPoolFromProxies(tt.proxies, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewProxyPoolFromProxies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if pool.Size() != tt.wantSize {
+				t.Errorf("Size() = %d, want %d", pool.Size(), tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestNewProxyPoolFromProxies_RoundTrip(t *testing.T) {
+	proxies := []config.ParsedProxy{{Type: "HTTP", Address: "proxy1:8080"}, {Type: "http", Address: "proxy2:8080"}}
+	pool, err := NewProxyPoolFromProxies(proxies, PoolOptions{})
+	if err != nil {
+		t.Fatalf("NewProxyPoolFromProxies() error = %v", err)
+	}
+	if proxies[0].Type != "HTTP" {
+		t.Error("NewProxyPoolFromProxies() modified the caller's slice")
+	}
+	if got := pool.entries[0].proxy.Type; got != "http" {
+		t.Errorf("proxy type = %q, want http", got)
+	}
+
+	for _, e := range pool.entries {
+		e.transport = stubResponse(http.StatusOK, nil)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://target.example.com/", nil)
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryBudgetStatus describes the retry budget over its current window.
+type RetryBudgetStatus struct {
+	Requests int64
+	Retries  int64
+	// Exhausted counts retries refused since startup
+	Exhausted int64
+}
+
+// retryBudget allows retries up to percent of the requests seen in a sliding
+// window, plus minRetries, so a broad outage does not multiply upstream load.
+// Counts are kept in one-second buckets.
+type retryBudget struct {
+	mu         sync.Mutex
+	percent    int64
+	minRetries int64
+	// buckets is a ring indexed by unix second modulo its length
+	buckets   []retryBucket
+	exhausted int64
+	now       func() time.Time
+}
+
+type retryBucket struct {
+	second   int64
+	requests int64
+	retries  int64
+}
+
+// newRetryBudget returns nil when percent is 0, which allows every retry.
+func newRetryBudget(percent, windowSeconds, minRetries int) *retryBudget {
+	if percent <= 0 {
+		return nil
+	}
+	if windowSeconds <= 0 {
+		windowSeconds = 10
+	}
+	return &retryBudget{
+		percent:    int64(percent),
+		minRetries: int64(minRetries),
+		buckets:    make([]retryBucket, windowSeconds),
+		now:        time.Now,
+	}
+}
+
+// bucket returns the current second's bucket, clearing it if it is stale.
+// Callers hold b.mu.
+func (b *retryBudget) bucket() *retryBucket {
+	sec := b.now().Unix()
+	bk := &b.buckets[sec%int64(len(b.buckets))]
+	if bk.second != sec {
+		*bk = retryBucket{second: sec}
+	}
+	return bk
+}
+
+// totals sums the buckets inside the window. Callers hold b.mu.
+func (b *retryBudget) totals() (requests, retries int64) {
+	oldest := b.now().Unix() - int64(len(b.buckets)) + 1
+	for _, bk := range b.buckets {
+		if bk.second >= oldest {
+			requests += bk.requests
+			retries += bk.retries
+		}
+	}
+	return requests, retries
+}
+
+// request records a request entering the pool.
+func (b *retryBudget) request() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.bucket().requests++
+	b.mu.Unlock()
+}
+
+// allowRetry reports whether another attempt may be made, recording it if so.
+func (b *retryBudget) allowRetry() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	requests, retries := b.totals()
+	if retries >= b.minRetries+requests*b.percent/100 {
+		b.exhausted++
+		return false
+	}
+	b.bucket().retries++
+	return true
+}
+
+func (b *retryBudget) status() RetryBudgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	requests, retries := b.totals()
+	return RetryBudgetStatus{Requests: requests, Retries: retries, Exhausted: b.exhausted}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newRetryBudget(10, 10, 1)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 20; i++ {
+		b.request()
+	}
+	// 1 + 10% of 20 = 3 retries
+	for i := 0; i < 3; i++ {
+		if !b.allowRetry() {
+			t.Fatalf("retry %d refused, want allowed", i+1)
+		}
+	}
+	if b.allowRetry() {
+		t.Fatal("retry allowed beyond the budget")
+	}
+	if got := b.status(); got.Requests != 20 || got.Retries != 3 || got.Exhausted != 1 {
+		t.Errorf("status() = %+v, want 20 requests, 3 retries, 1 exhausted", got)
+	}
+
+	// Once the window has passed the budget is available again
+	now = now.Add(10 * time.Second)
+	if got := b.status(); got.Requests != 0 || got.Retries != 0 {
+		t.Errorf("status() after window = %+v, want empty window", got)
+	}
+	if !b.allowRetry() {
+		t.Error("min_retries should allow a retry in an empty window")
+	}
+}
+
+func TestRetryBudget_Disabled(t *testing.T) {
+	b := newRetryBudget(0, 10, 0)
+	if b != nil {
+		t.Fatal("newRetryBudget(0, ...) should return nil")
+	}
+	b.request()
+	if !b.allowRetry() {
+		t.Error("a nil budget should allow every retry")
+	}
+}
+
+func TestProxyPool_RetryBudget(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:        []string{"http://proxy1:8080", "http://proxy2:8080"},
+		RetryBudget: config.RetryBudgetConfig{Percent: 10, MinRetries: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	var attempts int
+	for _, e := range pool.entries {
+		e.transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			attempts++
+			return nil, &timeoutError{}
+		})
+	}
+	restore := func() {
+		for _, e := range pool.entries {
+			e.setHealthy(true, "")
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		restore()
+		req, _ := http.NewRequest(http.MethodGet, "http://target.example.com/", nil)
+		if _, err := pool.RoundTrip(req); err == nil {
+			t.Fatal("RoundTrip() error = nil, want timeout")
+		} else if !errors.As(err, new(*timeoutError)) {
+			t.Fatalf("RoundTrip() error = %v, want timeout", err)
+		}
+	}
+	// Only the first request may retry: 3 requests allow 1 + 10% of 3 = 1 retry
+	if attempts != 4 {
+		t.Errorf("attempts = %d, want 4", attempts)
+	}
+	status, ok := pool.RetryBudget()
+	if !ok {
+		t.Fatal("RetryBudget() ok = false, want true")
+	}
+	if status.Requests != 3 || status.Retries != 1 || status.Exhausted != 2 {
+		t.Errorf("RetryBudget() = %+v, want 3 requests, 1 retry, 2 exhausted", status)
+	}
+}
@@ -1,13 +1,21 @@
 package proxy
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"sockstream/internal/config"
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/errorpage"
 )
 
 // NewReverseProxy constructs a reverse proxy with header rewrites and custom transport.
@@ -16,44 +24,202 @@ func NewReverseProxy(target *url.URL, cfg config.Config, transport http.RoundTri
 	if transport != nil {
 		proxy.Transport = transport
 	}
+	if pool, ok := transport.(*ProxyPool); ok {
+		proxy.BufferPool = pool.BufferPool()
+	} else {
+		proxy.BufferPool = NewBufferPool(cfg.Proxy.BufferSizeKB << 10)
+	}
+	proxy.Transport = newStaleTransport(proxy.Transport, cfg.Cache, logger)
+	// text/event-stream and responses without Content-Length are always
+	// flushed immediately by ReverseProxy, whatever the interval. Mode
+	// "buffer" is applied by the server, which holds back those flushes
+	proxy.FlushInterval = time.Duration(cfg.Streaming.FlushIntervalMs) * time.Millisecond
+	if strings.EqualFold(cfg.Streaming.Mode, "stream") {
+		proxy.FlushInterval = -1
+	}
 
+	bodies := newBodyLogger(cfg.Debug, logger)
+	// Templates are checked by config validation, so this only fails for
+	// configs that skipped it; fall back to plain-text errors then.
+	pages, err := errorpage.New(cfg.ErrorPages)
+	if err != nil {
+		logger.Error("invalid error pages, using plain text", "error", err)
+	}
+
+	remap := newStatusRemap(cfg.StatusRemap)
+	profiles := newHeaderProfiles(cfg)
+	// Validated with the rest of the config; an unparsable URL disables the rewrite
+	var external *url.URL
+	if cfg.ExternalURL != "" {
+		if external, err = url.Parse(cfg.ExternalURL); err != nil {
+			logger.Error("invalid external_url, Location headers are not rewritten", "error", err)
+			external = nil
+		}
+	}
+	var uaTurn atomic.Uint64
 	origDirector := proxy.Director
 	proxy.Director = func(r *http.Request) {
+		// Resolve before the Host is rewritten
+		headers := profiles.forHost(r.Host)
 		origDirector(r)
-		applyRewrites(r, target, cfg.Headers)
-		applyAddHeaders(r, cfg.Headers.Add)
+		if bodies != nil {
+			bodies.wrapRequest(r)
+		}
+		applyRewrites(r, target, headers)
+		applyAddHeaders(r, headers.Add)
+		applyUserAgent(r, headers, &uaTurn)
 		if cfg.HostName != "" {
 			r.Host = cfg.HostName
 			r.Header.Set("Host", cfg.HostName)
 		}
 		// Set headers to nil to prevent ServeHTTP from adding them
 		// (ServeHTTP checks for nil and skips adding X-Forwarded-For if nil)
-		for _, h := range cfg.Headers.Delete {
+		for _, h := range headers.Delete {
 			if h = strings.TrimSpace(h); h != "" {
 				r.Header[http.CanonicalHeaderKey(h)] = nil
 			}
 		}
 	}
 
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if err := handleTrailingSlashRedirect(resp, strings.ToLower(cfg.Redirect.TrailingSlash), proxy.Transport, target, external); err != nil {
+			return err
+		}
+		if external != nil {
+			rewriteLocation(resp, target, cfg.HostName, external)
+		}
+		if to, ok := remap[resp.StatusCode]; ok {
+			remapStatus(resp, to, cfg.StatusRemapReplaceBody, pages)
+		}
+		if bodies != nil {
+			bodies.wrapResponse(resp)
+		}
+		return nil
+	}
+
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if ClientGone(r) {
+			logger.Debug("client cancelled request", "error", err, "url", r.URL.String())
+			return
+		}
 		logger.Error("proxy error", "error", err, "url", r.URL.String())
-		http.Error(w, "proxy error", http.StatusBadGateway)
+		status, msg := ErrorStatus(err)
+		pages.Error(w, r, msg, status)
 	}
 
 	return proxy
 }
 
+// newStatusRemap parses the configured status_remap keys. Keys are checked by
+// config validation; any that do not parse are skipped.
+func newStatusRemap(cfg map[string]int) map[int]int {
+	if len(cfg) == 0 {
+		return nil
+	}
+	remap := make(map[int]int, len(cfg))
+	for key, to := range cfg {
+		if from, err := strconv.Atoi(key); err == nil {
+			remap[from] = to
+		}
+	}
+	return remap
+}
+
+// remapStatus rewrites resp's status to status. With replaceBody the target's
+// body is discarded and the error page for the new status is sent instead.
+func remapStatus(resp *http.Response, status int, replaceBody bool, pages *errorpage.Pages) {
+	resp.StatusCode = status
+	resp.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	if !replaceBody {
+		return
+	}
+	contentType, body := pages.Render(resp.Request, http.StatusText(status), status)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	// Trailers belonged to the discarded body
+	resp.Trailer = nil
+	resp.Header.Del("Trailer")
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("X-Content-Type-Options", "nosniff")
+}
+
+// headerProfiles picks the header rules for a request by its Host, falling
+// back to the global headers section.
+type headerProfiles struct {
+	byHost   map[string]config.HeaderConfig
+	fallback config.HeaderConfig
+}
+
+func newHeaderProfiles(cfg config.Config) headerProfiles {
+	hp := headerProfiles{fallback: cfg.Headers}
+	for _, p := range cfg.HeaderProfiles {
+		for _, h := range p.Hosts {
+			if hp.byHost == nil {
+				hp.byHost = make(map[string]config.HeaderConfig)
+			}
+			hp.byHost[strings.ToLower(strings.TrimSpace(h))] = p.HeaderConfig
+		}
+	}
+	return hp
+}
+
+func (hp headerProfiles) forHost(host string) config.HeaderConfig {
+	if len(hp.byHost) == 0 {
+		return hp.fallback
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if hc, ok := hp.byHost[strings.ToLower(host)]; ok {
+		return hc
+	}
+	return hp.fallback
+}
+
 func applyRewrites(r *http.Request, target *url.URL, cfg config.HeaderConfig) {
 	if cfg.RewriteHost {
+		// Keep the host the client used for virtual hosts and absolute URLs
+		if r.Host != "" {
+			r.Header.Set("X-Forwarded-Host", r.Host)
+		}
 		r.Host = target.Host
 		r.Header.Set("Host", target.Host)
 	}
 	if cfg.RewriteOrigin && r.Header.Get("Origin") != "" {
-		r.Header.Set("Origin", target.String())
+		r.Header.Set("Origin", targetOrigin(target))
+	}
+	if ref := r.Header.Get("Referer"); cfg.RewriteReferer && ref != "" {
+		r.Header.Set("Referer", rewriteReferer(ref, target))
+	}
+}
+
+// targetOrigin returns target as an Origin value: scheme://host[:port], with
+// no path.
+func targetOrigin(target *url.URL) string {
+	return (&url.URL{Scheme: target.Scheme, Host: target.Host}).String()
+}
+
+// rewriteReferer points ref at target while keeping the referring page's path
+// and query, mapped under the target path the same way request paths are.
+func rewriteReferer(ref string, target *url.URL) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return targetOrigin(target)
+	}
+	out := url.URL{
+		Scheme:   target.Scheme,
+		Host:     target.Host,
+		Path:     strings.TrimSuffix(target.Path, "/") + u.Path,
+		RawQuery: u.RawQuery,
 	}
-	if cfg.RewriteReferer && r.Header.Get("Referer") != "" {
-		r.Header.Set("Referer", target.String())
+	if out.Path == "" {
+		out.Path = "/"
 	}
+	return out.String()
 }
 
 func applyAddHeaders(r *http.Request, headers []string) {
@@ -71,3 +237,131 @@ func applyAddHeaders(r *http.Request, headers []string) {
 	}
 }
 
+// applyUserAgent replaces or removes the User-Agent as configured, taking
+// the configured values in turn. A removed User-Agent is not replaced by Go's
+// default, since ReverseProxy sends an empty one instead.
+func applyUserAgent(r *http.Request, cfg config.HeaderConfig, turn *atomic.Uint64) {
+	switch {
+	case cfg.RemoveUserAgent:
+		r.Header.Del("User-Agent")
+	case len(cfg.UserAgent) > 0:
+		i := (turn.Add(1) - 1) % uint64(len(cfg.UserAgent))
+		r.Header.Set("User-Agent", cfg.UserAgent[i])
+	}
+}
+
+// handleTrailingSlashRedirect applies the configured policy to target redirects
+// that only add or remove a trailing slash from the requested path.
+func handleTrailingSlashRedirect(resp *http.Response, policy string, transport http.RoundTripper, target, external *url.URL) error {
+	if policy == "" || policy == "passthrough" {
+		return nil
+	}
+	loc, ok := trailingSlashLocation(resp)
+	if !ok {
+		return nil
+	}
+
+	switch policy {
+	case "rewrite":
+		// Keep the client on the proxy instead of following an absolute target URL
+		path, ok := externalPath(loc.Path, target, external)
+		if !ok {
+			return nil
+		}
+		rel := url.URL{Path: path, RawQuery: loc.RawQuery}
+		resp.Header.Set("Location", rel.RequestURI())
+	case "follow":
+		req := resp.Request
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			return nil
+		}
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		next := req.Clone(req.Context())
+		next.URL = loc
+		next.Host = req.Host
+		newResp, err := transport.RoundTrip(next)
+		if err != nil {
+			return fmt.Errorf("follow trailing slash redirect: %w", err)
+		}
+		if _, ok := trailingSlashLocation(newResp); ok {
+			// The target redirects back to the path first asked for
+			newResp.Body.Close()
+			return fmt.Errorf("follow trailing slash redirect: %s redirects back to %s", loc.Path, req.URL.Path)
+		}
+		resp.Body.Close()
+		*resp = *newResp
+	}
+	return nil
+}
+
+// rewriteLocation points an absolute Location at the target (or at hostName,
+// the Host sent to it) back to the proxy's external URL, so redirects keep
+// clients on the proxy instead of looping through the target host.
+func rewriteLocation(resp *http.Response, target *url.URL, hostName string, external *url.URL) {
+	raw := resp.Header.Get("Location")
+	if raw == "" {
+		return
+	}
+	loc, err := url.Parse(raw)
+	if err != nil || !loc.IsAbs() {
+		return
+	}
+	if !strings.EqualFold(loc.Host, target.Host) && (hostName == "" || !strings.EqualFold(loc.Host, hostName)) {
+		return
+	}
+	path, ok := externalPath(loc.Path, target, external)
+	if !ok {
+		return
+	}
+	loc.Scheme = external.Scheme
+	loc.Host = external.Host
+	loc.Path = path
+	loc.RawPath = ""
+	resp.Header.Set("Location", loc.String())
+}
+
+// externalPath maps a path on the target to the path clients use: the
+// target's path prefix is replaced by that of external, if any. It reports
+// false for paths outside the target prefix.
+func externalPath(path string, target, external *url.URL) (string, bool) {
+	if prefix := strings.TrimSuffix(target.Path, "/"); prefix != "" {
+		if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			return "", false
+		}
+		path = strings.TrimPrefix(path, prefix)
+	}
+	if external != nil {
+		path = strings.TrimSuffix(external.Path, "/") + path
+	}
+	if path == "" {
+		path = "/"
+	}
+	return path, true
+}
+
+// trailingSlashLocation returns the resolved Location when resp redirects to the
+// same target path with only the trailing slash added or removed.
+func trailingSlashLocation(resp *http.Response) (*url.URL, bool) {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, false
+	}
+	if resp.Request == nil || resp.Request.URL == nil {
+		return nil, false
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return nil, false
+	}
+	reqURL := resp.Request.URL
+	if !strings.EqualFold(loc.Host, reqURL.Host) {
+		return nil, false
+	}
+	if loc.Path == reqURL.Path || strings.TrimSuffix(loc.Path, "/") != strings.TrimSuffix(reqURL.Path, "/") {
+		return nil, false
+	}
+	return loc, true
+}
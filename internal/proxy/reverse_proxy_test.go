@@ -1,11 +1,21 @@
 package proxy
 
 import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"sockstream/internal/config"
+	"github.com/foxzi/SockStream/internal/config"
 )
 
 func TestApplyRewrites(t *testing.T) {
@@ -16,6 +26,7 @@ func TestApplyRewrites(t *testing.T) {
 		cfg        config.HeaderConfig
 		reqHeaders map[string]string
 		wantHost   string
+		wantFwd    string
 		wantOrigin string
 		wantRef    string
 	}{
@@ -26,6 +37,7 @@ func TestApplyRewrites(t *testing.T) {
 				"Host": "original.com",
 			},
 			wantHost: "target.example.com",
+			wantFwd:  "original.com",
 		},
 		{
 			name: "rewrite host disabled",
@@ -65,7 +77,7 @@ func TestApplyRewrites(t *testing.T) {
 			reqHeaders: map[string]string{
 				"Referer": "https://original.com/page",
 			},
-			wantRef: "https://target.example.com",
+			wantRef: "https://target.example.com/page",
 		},
 		{
 			name: "rewrite referer disabled",
@@ -96,8 +108,9 @@ func TestApplyRewrites(t *testing.T) {
 				"Referer": "https://original.com/page",
 			},
 			wantHost:   "target.example.com",
+			wantFwd:    "original.com",
 			wantOrigin: "https://target.example.com",
-			wantRef:    "https://target.example.com",
+			wantRef:    "https://target.example.com/page",
 		},
 	}
 
@@ -118,6 +131,9 @@ func TestApplyRewrites(t *testing.T) {
 			if tt.wantHost != "" && req.Host != tt.wantHost {
 				t.Errorf("Host = %q, want %q", req.Host, tt.wantHost)
 			}
+			if got := req.Header.Get("X-Forwarded-Host"); got != tt.wantFwd {
+				t.Errorf("X-Forwarded-Host = %q, want %q", got, tt.wantFwd)
+			}
 			if tt.wantOrigin != "" && req.Header.Get("Origin") != tt.wantOrigin {
 				t.Errorf("Origin = %q, want %q", req.Header.Get("Origin"), tt.wantOrigin)
 			}
@@ -128,6 +144,64 @@ func TestApplyRewrites(t *testing.T) {
 	}
 }
 
+func TestApplyRewrites_TargetURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		referer    string
+		wantOrigin string
+		wantRef    string
+	}{
+		{
+			name:       "target with path",
+			target:     "https://example.com/api",
+			referer:    "https://proxy.local/users?id=1",
+			wantOrigin: "https://example.com",
+			wantRef:    "https://example.com/api/users?id=1",
+		},
+		{
+			name:       "target with trailing slash",
+			target:     "https://example.com/api/",
+			referer:    "https://proxy.local/users",
+			wantOrigin: "https://example.com",
+			wantRef:    "https://example.com/api/users",
+		},
+		{
+			name:       "non-default port",
+			target:     "http://example.com:8443",
+			referer:    "https://proxy.local/page",
+			wantOrigin: "http://example.com:8443",
+			wantRef:    "http://example.com:8443/page",
+		},
+		{
+			name:       "referer without path",
+			target:     "https://example.com:8443/app",
+			referer:    "https://proxy.local",
+			wantOrigin: "https://example.com:8443",
+			wantRef:    "https://example.com:8443/app",
+		},
+	}
+
+	cfg := config.HeaderConfig{RewriteOrigin: true, RewriteReferer: true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, _ := url.Parse(tt.target)
+			req := &http.Request{Header: make(http.Header)}
+			req.Header.Set("Origin", "https://proxy.local")
+			req.Header.Set("Referer", tt.referer)
+
+			applyRewrites(req, target, cfg)
+
+			if got := req.Header.Get("Origin"); got != tt.wantOrigin {
+				t.Errorf("Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := req.Header.Get("Referer"); got != tt.wantRef {
+				t.Errorf("Referer = %q, want %q", got, tt.wantRef)
+			}
+		})
+	}
+}
+
 func TestApplyAddHeaders(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -208,3 +282,610 @@ func TestApplyAddHeaders(t *testing.T) {
 		})
 	}
 }
+
+// newTestBackendProxy starts backend and a reverse proxy in front of it,
+// returning the proxy server and the backend URL.
+func newTestBackendProxy(t *testing.T, backend http.Handler, cfg config.Config) (*httptest.Server, string) {
+	t.Helper()
+	upstream := httptest.NewServer(backend)
+	t.Cleanup(upstream.Close)
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Target = upstream.URL
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	front := httptest.NewServer(NewReverseProxy(target, cfg, nil, logger))
+	t.Cleanup(front.Close)
+	return front, upstream.URL
+}
+
+func noRedirectClient() *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func TestTrailingSlashRedirect(t *testing.T) {
+	var backendURL string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dir":
+			// Absolute URL to the target host, as produced by many backends
+			http.Redirect(w, r, backendURL+"/dir/?q=1", http.StatusMovedPermanently)
+		case "/dir/":
+			_, _ = io.WriteString(w, "listing")
+		case "/loop":
+			http.Redirect(w, r, "/loop/", http.StatusMovedPermanently)
+		case "/loop/":
+			http.Redirect(w, r, "/loop", http.StatusMovedPermanently)
+		case "/other":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		}
+	})
+
+	tests := []struct {
+		name         string
+		policy       string
+		path         string
+		wantStatus   int
+		wantLocation string
+		wantBody     string
+	}{
+		{
+			name:       "passthrough keeps redirect",
+			policy:     "",
+			path:       "/dir",
+			wantStatus: http.StatusMovedPermanently,
+		},
+		{
+			name:         "rewrite makes location relative",
+			policy:       "rewrite",
+			path:         "/dir",
+			wantStatus:   http.StatusMovedPermanently,
+			wantLocation: "/dir/?q=1",
+		},
+		{
+			name:       "follow resolves redirect",
+			policy:     "follow",
+			path:       "/dir",
+			wantStatus: http.StatusOK,
+			wantBody:   "listing",
+		},
+		{
+			name:       "follow refuses a redirect back",
+			policy:     "follow",
+			path:       "/loop",
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:         "unrelated redirect untouched",
+			policy:       "follow",
+			path:         "/other",
+			wantStatus:   http.StatusFound,
+			wantLocation: "/elsewhere",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.Redirect.TrailingSlash = tt.policy
+			front, upstreamURL := newTestBackendProxy(t, backend, cfg)
+			backendURL = upstreamURL
+
+			resp, err := noRedirectClient().Get(front.URL + tt.path)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantLocation != "" && resp.Header.Get("Location") != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", resp.Header.Get("Location"), tt.wantLocation)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestTrailingSlashRedirect_RewriteTargetPath(t *testing.T) {
+	tests := []struct {
+		name         string
+		target       string
+		external     string
+		wantLocation string
+	}{
+		{name: "target path stripped", target: "http://backend/app", wantLocation: "/a/?q=1"},
+		{name: "external path prepended", target: "http://backend/app/", external: "https://proxy.example.com/public", wantLocation: "/public/a/?q=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, _ := url.Parse(tt.target)
+			var external *url.URL
+			if tt.external != "" {
+				external, _ = url.Parse(tt.external)
+			}
+			resp := &http.Response{
+				StatusCode: http.StatusMovedPermanently,
+				Header:     http.Header{"Location": {"http://backend/app/a/?q=1"}},
+				Request:    httptest.NewRequest(http.MethodGet, "http://backend/app/a", nil),
+			}
+			if err := handleTrailingSlashRedirect(resp, "rewrite", nil, target, external); err != nil {
+				t.Fatalf("handleTrailingSlashRedirect() error = %v", err)
+			}
+			if got := resp.Header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestReverseProxy_NoProxyAvailable(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:           []string{"http://127.0.0.1:1"},
+		OnAllUnhealthy: "fail",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.entries[0].setHealthy(false, "test error")
+
+	target, _ := url.Parse("http://127.0.0.1:1")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rp := NewReverseProxy(target, config.DefaultConfig(), pool, logger)
+
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestReverseProxy_ErrorPage(t *testing.T) {
+	target, _ := url.Parse("http://127.0.0.1:1")
+	cfg := config.DefaultConfig()
+	cfg.ErrorPages.Pages = map[string]string{"503": "<h1>{{.Status}} {{.StatusText}}</h1>"}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rp := NewReverseProxy(target, cfg, nil, logger)
+
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	// Nothing listens on port 1, so the connection is refused
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if want := "<h1>503 Service Unavailable</h1>"; rec.Body.String() != want {
+		t.Errorf("body = %q, want %q", rec.Body.String(), want)
+	}
+}
+
+func TestReverseProxy_HeaderProfiles(t *testing.T) {
+	target, _ := url.Parse("https://target.example.com")
+	cfg := config.DefaultConfig()
+	cfg.Headers = config.HeaderConfig{Delete: []string{"X-Global"}}
+	cfg.HeaderProfiles = map[string]config.HeaderProfile{
+		"api": {
+			Hosts: []string{"API.example.com"},
+			HeaderConfig: config.HeaderConfig{
+				RewriteOrigin: true,
+				Add:           []string{"X-Profile: api"},
+				Delete:        []string{"Cookie"},
+			},
+		},
+	}
+
+	var got *http.Request
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		got = r
+		return stubResponse(http.StatusOK, nil)(r)
+	})
+	rp := NewReverseProxy(target, cfg, transport, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name        string
+		host        string
+		wantOrigin  string
+		wantProfile string
+		wantCookie  bool
+		wantGlobal  bool
+	}{
+		{name: "profile host with port", host: "api.example.com:8080", wantOrigin: "https://target.example.com", wantProfile: "api", wantGlobal: true},
+		{name: "other host uses global headers", host: "www.example.com", wantOrigin: "https://original.com", wantCookie: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			req.Header.Set("Origin", "https://original.com")
+			req.Header.Set("Cookie", "a=b")
+			req.Header.Set("X-Global", "1")
+			rp.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got == nil {
+				t.Fatal("request did not reach the transport")
+			}
+			if o := got.Header.Get("Origin"); o != tt.wantOrigin {
+				t.Errorf("Origin = %q, want %q", o, tt.wantOrigin)
+			}
+			if p := got.Header.Get("X-Profile"); p != tt.wantProfile {
+				t.Errorf("X-Profile = %q, want %q", p, tt.wantProfile)
+			}
+			if has := got.Header.Get("Cookie") != ""; has != tt.wantCookie {
+				t.Errorf("Cookie present = %v, want %v", has, tt.wantCookie)
+			}
+			if has := got.Header.Get("X-Global") != ""; has != tt.wantGlobal {
+				t.Errorf("X-Global present = %v, want %v", has, tt.wantGlobal)
+			}
+		})
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		hostName string
+		external string
+		location string
+		want     string
+	}{
+		{
+			name:     "target host",
+			target:   "http://backend.internal:8080",
+			external: "https://proxy.example.com",
+			location: "http://backend.internal:8080/docs/?page=2",
+			want:     "https://proxy.example.com/docs/?page=2",
+		},
+		{
+			name:     "host name override",
+			target:   "http://10.0.0.5",
+			hostName: "app.example.com",
+			external: "https://proxy.example.com",
+			location: "https://app.example.com/login",
+			want:     "https://proxy.example.com/login",
+		},
+		{
+			name:     "target and external paths",
+			target:   "https://backend.internal/api",
+			external: "https://proxy.example.com/public/",
+			location: "https://backend.internal/api/users/",
+			want:     "https://proxy.example.com/public/users/",
+		},
+		{
+			name:     "outside target path",
+			target:   "https://backend.internal/api",
+			external: "https://proxy.example.com",
+			location: "https://backend.internal/apiv2",
+			want:     "https://backend.internal/apiv2",
+		},
+		{
+			name:     "other host",
+			target:   "https://backend.internal",
+			external: "https://proxy.example.com",
+			location: "https://sso.example.com/login",
+			want:     "https://sso.example.com/login",
+		},
+		{
+			name:     "relative location",
+			target:   "https://backend.internal",
+			external: "https://proxy.example.com",
+			location: "/docs/",
+			want:     "/docs/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, _ := url.Parse(tt.target)
+			external, _ := url.Parse(tt.external)
+			resp := &http.Response{StatusCode: http.StatusMovedPermanently, Header: http.Header{"Location": {tt.location}}}
+
+			rewriteLocation(resp, target, tt.hostName, external)
+
+			if got := resp.Header.Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReverseProxy_ExternalURL(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://"+r.Host+"/docs/", http.StatusMovedPermanently)
+	}))
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL)
+	cfg := config.DefaultConfig()
+	cfg.Headers.RewriteHost = true
+	cfg.ExternalURL = "https://proxy.example.com"
+	rp := NewReverseProxy(target, cfg, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	if loc := rec.Header().Get("Location"); loc != "https://proxy.example.com/docs/" {
+		t.Errorf("Location = %q, want %q", loc, "https://proxy.example.com/docs/")
+	}
+}
+
+func TestReverseProxy_StatusRemap(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = io.WriteString(w, "backend internals")
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	tests := []struct {
+		name        string
+		replaceBody bool
+		pages       map[string]string
+		wantBody    string
+	}{
+		{name: "body preserved", wantBody: "backend internals"},
+		{name: "body replaced with status text", replaceBody: true, wantBody: "Service Unavailable\n"},
+		{
+			name:        "body replaced with error page",
+			replaceBody: true,
+			pages:       map[string]string{"503": "<h1>{{.Status}}</h1>"},
+			wantBody:    "<h1>503</h1>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.StatusRemap = map[string]int{"418": http.StatusServiceUnavailable}
+			cfg.StatusRemapReplaceBody = tt.replaceBody
+			cfg.ErrorPages.Pages = tt.pages
+			rp := NewReverseProxy(target, cfg, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+			rec := httptest.NewRecorder()
+			rp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestReverseProxy_ClientCancelWritesNothing(t *testing.T) {
+	target, _ := url.Parse("http://127.0.0.1:1")
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, r.Context().Err()
+	})
+	rp := NewReverseProxy(target, config.DefaultConfig(), transport, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if rec.Body.Len() != 0 {
+		t.Errorf("body = %q, want nothing written", rec.Body.String())
+	}
+}
+
+func TestReverseProxy_Trailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if te := r.Header.Get("Te"); te != "trailers" {
+			t.Errorf("backend TE = %q, want trailers", te)
+		}
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("Content-Type", "application/grpc-web")
+		_, _ = io.WriteString(w, "payload")
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	pool, err := NewProxyPool(config.ProxyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transports := map[string]http.RoundTripper{"default": nil, "pool": pool}
+
+	for name, transport := range transports {
+		t.Run(name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.Debug.LogBodies = true
+			rp := NewReverseProxy(target, cfg, transport, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			front := httptest.NewServer(rp)
+			defer front.Close()
+
+			req, _ := http.NewRequest(http.MethodPost, front.URL+"/svc/Method", strings.NewReader("request"))
+			req.Header.Set("TE", "trailers")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request error = %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "payload" {
+				t.Errorf("body = %q, want payload", body)
+			}
+			if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+				t.Errorf("Grpc-Status trailer = %q, want 0 (trailers %v)", got, resp.Trailer)
+			}
+			if got := resp.Trailer.Get("Grpc-Message"); got != "ok" {
+				t.Errorf("Grpc-Message trailer = %q, want ok", got)
+			}
+		})
+	}
+}
+
+func TestReverseProxy_UserAgent(t *testing.T) {
+	got := make(chan []string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Values("User-Agent")
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	tests := []struct {
+		name    string
+		headers config.HeaderConfig
+		client  string
+		want    [][]string
+	}{
+		{name: "not configured", client: "curl/8.0", want: [][]string{{"curl/8.0"}}},
+		{name: "not configured, no client value", want: [][]string{nil}},
+		{
+			name:    "override",
+			headers: config.HeaderConfig{UserAgent: []string{"Mozilla/5.0"}, Add: []string{"User-Agent: added"}},
+			client:  "curl/8.0",
+			want:    [][]string{{"Mozilla/5.0"}},
+		},
+		{
+			name:    "rotation",
+			headers: config.HeaderConfig{UserAgent: []string{"ua-1", "ua-2"}},
+			client:  "curl/8.0",
+			want:    [][]string{{"ua-1"}, {"ua-2"}, {"ua-1"}},
+		},
+		{
+			name:    "remove",
+			headers: config.HeaderConfig{RemoveUserAgent: true},
+			client:  "curl/8.0",
+			want:    [][]string{nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.Headers = tt.headers
+			rp := NewReverseProxy(target, cfg, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			for i, want := range tt.want {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				if tt.client != "" {
+					req.Header.Set("User-Agent", tt.client)
+				}
+				rp.ServeHTTP(httptest.NewRecorder(), req)
+				if ua := <-got; !slices.Equal(ua, want) {
+					t.Errorf("request %d: User-Agent = %q, want %q", i+1, ua, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReverseProxy_ClientDisconnectCancelsUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		// respond makes the target send headers and a first chunk before it
+		// waits; otherwise it stalls before responding
+		respond bool
+	}{
+		{
+			name:    "streaming response",
+			request: "GET /stream HTTP/1.1\r\nHost: front\r\n\r\n",
+			respond: true,
+		},
+		{
+			name:    "buffered body before response",
+			request: "POST /upload HTTP/1.1\r\nHost: front\r\nContent-Length: 5\r\n\r\nhello",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			cancelled := make(chan struct{})
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				_, _ = io.Copy(io.Discard, r.Body)
+				if tt.respond {
+					_, _ = io.WriteString(w, "first chunk\n")
+					w.(http.Flusher).Flush()
+				}
+				select {
+				case <-r.Context().Done():
+					close(cancelled)
+				case <-time.After(5 * time.Second):
+				}
+			}))
+			defer backend.Close()
+
+			// Two entries, so a retry after the disconnect would show up as a second hit
+			pool, err := NewProxyPool(config.ProxyConfig{URLs: []string{"direct://", "direct://"}})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			target, _ := url.Parse(backend.URL)
+			front := httptest.NewServer(NewReverseProxy(target, config.DefaultConfig(), pool, slog.New(slog.NewTextHandler(io.Discard, nil))))
+			defer front.Close()
+
+			conn, err := net.Dial("tcp", front.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(conn, tt.request); err != nil {
+				t.Fatal(err)
+			}
+			if tt.respond {
+				br := bufio.NewReader(conn)
+				if _, err := http.ReadResponse(br, nil); err != nil {
+					t.Fatalf("read response: %v", err)
+				}
+			} else {
+				// Let the request reach the target before hanging up
+				deadline := time.Now().Add(2 * time.Second)
+				for hits.Load() == 0 && time.Now().Before(deadline) {
+					time.Sleep(5 * time.Millisecond)
+				}
+			}
+			conn.Close()
+
+			select {
+			case <-cancelled:
+			case <-time.After(2 * time.Second):
+				t.Fatal("upstream request not cancelled after the client disconnected")
+			}
+			time.Sleep(50 * time.Millisecond)
+			if got := hits.Load(); got != 1 {
+				t.Errorf("target hit %d times, want 1", got)
+			}
+			if got := pool.HealthyCount(); got != 2 {
+				t.Errorf("HealthyCount() = %d, want 2: a client disconnect says nothing about the proxies", got)
+			}
+		})
+	}
+}
+
+func TestNewReverseProxy_StreamingMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		ms   int
+		want time.Duration
+	}{
+		{mode: "", ms: 100, want: 100 * time.Millisecond},
+		{mode: "auto", ms: 0, want: 0},
+		{mode: "stream", ms: 100, want: -1},
+		// Buffering is done by the server's writer
+		{mode: "buffer", ms: 100, want: 100 * time.Millisecond},
+	}
+	target, _ := url.Parse("http://127.0.0.1:1")
+	for _, tt := range tests {
+		cfg := config.DefaultConfig()
+		cfg.Streaming = config.StreamingConfig{Mode: tt.mode, FlushIntervalMs: tt.ms}
+		rp := NewReverseProxy(target, cfg, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if rp.FlushInterval != tt.want {
+			t.Errorf("mode %q: FlushInterval = %v, want %v", tt.mode, rp.FlushInterval, tt.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// hostRoute sends the hosts it matches to the proxies of one group, or to
+// a named pool when pool is set.
+type hostRoute struct {
+	hosts *bypassList
+	group string
+	pool  *ProxyPool
+}
+
+// newHostRoutes parses routes, keeping their order. Hosts use the NO_PROXY
+// syntax of the bypass list; pools holds the named pools routes may use.
+func newHostRoutes(routes []config.ProxyRoute, pools map[string]*ProxyPool) ([]hostRoute, error) {
+	out := make([]hostRoute, 0, len(routes))
+	for i, r := range routes {
+		hosts, err := newBypassList(r.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("proxy route %d: %w", i+1, err)
+		}
+		if hosts == nil {
+			continue
+		}
+		route := hostRoute{hosts: hosts, group: r.Group}
+		if r.Pool != "" {
+			if route.pool = pools[r.Pool]; route.pool == nil {
+				return nil, fmt.Errorf("proxy route %d: unknown pool %q", i+1, r.Pool)
+			}
+		}
+		out = append(out, route)
+	}
+	return out, nil
+}
+
+// route returns the first route matching u, or the zero route when none does.
+func (p *ProxyPool) route(u *url.URL) hostRoute {
+	for _, r := range p.routes {
+		if r.hosts.match(u) {
+			return r
+		}
+	}
+	return hostRoute{}
+}
+
+// routeGroup returns the group of the route matching u, or "" when none does.
+func (p *ProxyPool) routeGroup(u *url.URL) string {
+	return p.route(u).group
+}
+
+// routedPool returns the named pool serving u, or nil when p does. Hosts on
+// p's bypass list stay with p, which sends them directly.
+func (p *ProxyPool) routedPool(u *url.URL) *ProxyPool {
+	if len(p.pools) == 0 || (p.bypass != nil && p.bypass.match(u)) {
+		return nil
+	}
+	return p.route(u).pool
+}
+
+// inGroup reports whether e serves requests routed to group. Unrouted hosts
+// use the ungrouped proxies, or every proxy when all of them are grouped.
+func (p *ProxyPool) inGroup(e *proxyEntry, group string) bool {
+	return e.group == group || (group == "" && !p.ungrouped)
+}
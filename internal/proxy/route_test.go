@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// stubEntries makes every entry answer with its address in X-Proxy and
+// accept tunnels, recording the address in dialed.
+func stubEntries(pool *ProxyPool, dialed *[]string) {
+	for _, e := range pool.entries {
+		addr := e.proxy.Address
+		e.transport = stubResponse(http.StatusOK, http.Header{"X-Proxy": {addr}})
+		e.dial = func(ctx context.Context, network, target string) (net.Conn, error) {
+			*dialed = append(*dialed, addr)
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}
+	}
+}
+
+func TestProxyPool_Routes(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs: []string{"http://default:8080"},
+		Groups: map[string][]string{
+			"residential": {"http://res1:8080", "http://res2:8080"},
+		},
+		Routes: []config.ProxyRoute{{Hosts: []string{".shop.example", "10.9.0.0/16"}, Group: "residential"}},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	var dialed []string
+	stubEntries(pool, &dialed)
+
+	via := func(target string) string {
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		resp, err := pool.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip(%s) error = %v", target, err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("X-Proxy")
+	}
+
+	for i := 0; i < 4; i++ {
+		if got := via("https://www.shop.example/cart"); got != "res1:8080" && got != "res2:8080" {
+			t.Errorf("routed host went through %s, want a residential proxy", got)
+		}
+		if got := via("http://10.9.1.1/"); got != "res1:8080" && got != "res2:8080" {
+			t.Errorf("routed cidr went through %s, want a residential proxy", got)
+		}
+		if got := via("https://other.example/"); got != "default:8080" {
+			t.Errorf("unrouted host went through %s, want default:8080", got)
+		}
+	}
+
+	conn, err := pool.DialContext(context.Background(), "tcp", "api.shop.example:443")
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	conn.Close()
+	if len(dialed) != 1 || dialed[0] == "default:8080" {
+		t.Errorf("tunnel went through %v, want a residential proxy", dialed)
+	}
+
+	// Falling back while the group is down stays within the group
+	for _, e := range pool.entries {
+		if e.group == "residential" {
+			e.setHealthy(false, "down")
+		}
+	}
+	if got := via("https://www.shop.example/"); got != "res1:8080" && got != "res2:8080" {
+		t.Errorf("fallback went through %s, want a residential proxy", got)
+	}
+}
+
+func TestProxyPool_RoutesWithoutDefault(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		Groups: map[string][]string{
+			"a": {"http://a:8080"},
+			"b": {"http://b:8080"},
+		},
+		Routes: []config.ProxyRoute{{Hosts: []string{"a.example"}, Group: "a"}},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	var dialed []string
+	stubEntries(pool, &dialed)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://other.example/", nil)
+		resp, err := pool.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip() error = %v", err)
+		}
+		resp.Body.Close()
+		seen[resp.Header.Get("X-Proxy")] = true
+	}
+	if !seen["a:8080"] || !seen["b:8080"] {
+		t.Errorf("unrouted hosts used %v, want every proxy when all are grouped", seen)
+	}
+	if status := pool.GetStatus(); status[0].Group != "a" || status[1].Group != "b" {
+		t.Errorf("GetStatus() groups = %q, %q, want a, b", status[0].Group, status[1].Group)
+	}
+}
+
+func TestNewProxyPoolFromProxies_UnknownRouteGroup(t *testing.T) {
+	_, err := NewProxyPoolFromProxies([]config.ParsedProxy{{Type: "http", Address: "a:8080"}}, PoolOptions{
+		Routes: []config.ProxyRoute{{Hosts: []string{"*"}, Group: "missing"}},
+	})
+	if err == nil {
+		t.Error("route to a group without proxies should fail")
+	}
+}
+
+func TestProxyPool_NamedPools(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:   []string{"http://default:8080"},
+		Bypass: []string{"internal.example"},
+		Pools: map[string]config.ProxyConfig{
+			"eu": {URLs: []string{"http://eu1:8080", "http://eu2:8080"}, Rotation: "least-conn"},
+		},
+		Routes: []config.ProxyRoute{{Hosts: []string{".eu.example", "internal.example"}, Pool: "eu"}},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	eu := pool.Pools()["eu"]
+	if eu == nil || eu.Size() != 2 || pool.Size() != 1 {
+		t.Fatalf("Pools() = %v, want eu with 2 proxies next to 1 default proxy", pool.Pools())
+	}
+	var dialed []string
+	stubEntries(pool, &dialed)
+	stubEntries(eu, &dialed)
+
+	via := func(target string) string {
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		resp, err := pool.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip(%s) error = %v", target, err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("X-Proxy")
+	}
+	if got := via("https://shop.eu.example/"); got != "eu1:8080" && got != "eu2:8080" {
+		t.Errorf("routed host went through %s, want an eu proxy", got)
+	}
+	if got := via("https://other.example/"); got != "default:8080" {
+		t.Errorf("unrouted host went through %s, want default:8080", got)
+	}
+
+	conn, err := pool.DialContext(context.Background(), "tcp", "api.eu.example:443")
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	conn.Close()
+	if len(dialed) != 1 || dialed[0] == "default:8080" {
+		t.Errorf("tunnel went through %v, want an eu proxy", dialed)
+	}
+
+	// The default pool's bypass list is checked before routes
+	if sub := pool.routedPool(&url.URL{Scheme: "https", Host: "internal.example"}); sub != nil {
+		t.Error("bypassed host should stay with the default pool")
+	}
+
+	if err := pool.SetDisabled("eu2:8080", true); err != nil {
+		t.Fatalf("SetDisabled() on a named pool proxy error = %v", err)
+	}
+	if !eu.GetStatus()[1].Disabled {
+		t.Error("SetDisabled() should reach the named pool")
+	}
+	if err := pool.SetDisabled("missing:1", true); !errors.Is(err, ErrUnknownProxy) {
+		t.Errorf("SetDisabled(missing) error = %v, want ErrUnknownProxy", err)
+	}
+}
+
+func TestProxyPool_NamedPoolsInherit(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		Security:    config.SecurityConfig{BlockPrivateTargets: true},
+		HealthCheck: config.HealthCheckConfig{WarmUpURL: "https://target.example/"},
+		Pools: map[string]config.ProxyConfig{
+			"eu": {URLs: []string{"http://eu1:8080"}, HealthCheck: config.HealthCheckConfig{WarmUp: true}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	eu := pool.Pools()["eu"]
+	if g := eu.entries[0].guard; g == nil || !g.private {
+		t.Error("named pool should inherit the target address guard")
+	}
+	if eu.warmUpURL != "https://target.example/" {
+		t.Errorf("warmUpURL = %q, want the parent's", eu.warmUpURL)
+	}
+}
+
+func TestProxyPool_NamedPoolsHealthCheck(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		Pools: map[string]config.ProxyConfig{
+			"eu": {URLs: []string{"http://eu1:8080"}},
+			"us": {URLs: []string{"http://us1:8080"}},
+		},
+		Routes: []config.ProxyRoute{{Hosts: []string{".eu.example"}, Pool: "eu"}},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	var mu sync.Mutex
+	checked := make(map[string]bool)
+	for name, sub := range pool.Pools() {
+		sub.probe = func(ctx context.Context, e *proxyEntry) {
+			mu.Lock()
+			checked[name+"/"+e.proxy.Address] = true
+			mu.Unlock()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pool.StartHealthCheck(ctx)
+	cancel()
+
+	if !checked["eu/eu1:8080"] || !checked["us/us1:8080"] {
+		t.Errorf("checked = %v, want every named pool checked", checked)
+	}
+	for name, sub := range pool.Pools() {
+		select {
+		case <-sub.ctx.Done():
+		case <-time.After(time.Second):
+			t.Errorf("pool %s health check still running after cancel", name)
+		}
+	}
+}
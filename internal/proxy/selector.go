@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// Selector picks the proxy that serves a request. Select is called with the
+// proxies that may still be tried, in configuration order, and returns an
+// index into candidates or -1 to try none of them. req is nil for tunnels
+// opened with DialContext. Implementations must be safe for concurrent use.
+type Selector interface {
+	Select(candidates []Candidate, req *http.Request) int
+}
+
+// Candidate describes a proxy offered to a Selector.
+type Candidate struct {
+	Proxy config.ParsedProxy
+	// Position is the proxy's fixed place in the configured list; it does
+	// not shift when other proxies become unavailable or are ejected
+	Position int
+	// Active counts the requests and tunnels in flight through the proxy
+	Active int
+}
+
+// RoundRobin returns a selector that walks the configured list in order,
+// skipping proxies that are not candidates, so each available proxy gets an
+// even share however the healthy set changes.
+func RoundRobin() Selector {
+	return &roundRobin{}
+}
+
+// Random returns a selector that picks a candidate uniformly at random.
+func Random() Selector {
+	return random{}
+}
+
+// selectorFor maps the proxy.rotation setting to a built-in selector.
+func selectorFor(rotation string) (Selector, error) {
+	switch strings.ToLower(rotation) {
+	case "", "round-robin":
+		return RoundRobin(), nil
+	case "random":
+		return Random(), nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy rotation: %s", rotation)
+	}
+}
+
+// ranker narrows candidates to the indexes of the ones it ranks best. A
+// rotation list runs its rankers in order and lets the final selector choose
+// among the candidates still tied.
+type ranker interface {
+	best(candidates []Candidate) []int
+}
+
+// rotationFor maps the proxy.rotation list to rankers and the selector that
+// breaks their remaining ties, round-robin unless the list ends in another.
+func rotationFor(rotation config.Rotation) ([]ranker, Selector, error) {
+	names := rotation.Strategies()
+	var rankers []ranker
+	for i, name := range names {
+		switch name {
+		case "least-conn":
+			rankers = append(rankers, leastConn{})
+		default:
+			if i != len(names)-1 {
+				return nil, nil, fmt.Errorf("proxy rotation %s must be the last strategy", name)
+			}
+			sel, err := selectorFor(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			return rankers, sel, nil
+		}
+	}
+	return rankers, RoundRobin(), nil
+}
+
+// leastConn ranks the candidates with the fewest requests in flight best.
+type leastConn struct{}
+
+func (leastConn) best(candidates []Candidate) []int {
+	var best []int
+	for i, c := range candidates {
+		switch {
+		case len(best) == 0 || c.Active < candidates[best[0]].Active:
+			best = append(best[:0], i)
+		case c.Active == candidates[best[0]].Active:
+			best = append(best, i)
+		}
+	}
+	return best
+}
+
+type roundRobin struct {
+	// next is the position to try next
+	next atomic.Int64
+}
+
+// Select picks the first candidate at or after the cursor, wrapping to the
+// lowest position, and moves the cursor past it.
+func (s *roundRobin) Select(candidates []Candidate, _ *http.Request) int {
+	if len(candidates) == 0 {
+		return -1
+	}
+	for {
+		cursor := s.next.Load()
+		best, wrap := -1, -1
+		for i, c := range candidates {
+			pos := int64(c.Position)
+			if pos >= cursor && (best < 0 || pos < int64(candidates[best].Position)) {
+				best = i
+			}
+			if wrap < 0 || pos < int64(candidates[wrap].Position) {
+				wrap = i
+			}
+		}
+		if best < 0 {
+			best = wrap
+		}
+		if s.next.CompareAndSwap(cursor, int64(candidates[best].Position)+1) {
+			return best
+		}
+	}
+}
+
+type random struct{}
+
+// Select draws from math/rand/v2's per-thread source, so concurrent
+// requests do not contend on a shared lock.
+func (random) Select(candidates []Candidate, _ *http.Request) int {
+	if len(candidates) == 0 {
+		return -1
+	}
+	return rand.IntN(len(candidates))
+}
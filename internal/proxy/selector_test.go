@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestSelectorFor(t *testing.T) {
+	tests := []struct {
+		rotation string
+		want     string
+		wantErr  bool
+	}{
+		{rotation: "", want: "*proxy.roundRobin"},
+		{rotation: "round-robin", want: "*proxy.roundRobin"},
+		{rotation: "Random", want: "proxy.random"},
+		{rotation: "weighted", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rotation, func(t *testing.T) {
+			got, err := selectorFor(tt.rotation)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectorFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && fmt.Sprintf("%T", got) != tt.want {
+				t.Errorf("selectorFor() = %T, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundRobin_Select(t *testing.T) {
+	candidates := func(positions ...int) []Candidate {
+		c := make([]Candidate, len(positions))
+		for i, p := range positions {
+			c[i] = Candidate{Position: p}
+		}
+		return c
+	}
+
+	s := RoundRobin()
+	// Positions 1 and 2 are unavailable; 0 and 3 alternate
+	var got []int
+	for i := 0; i < 4; i++ {
+		c := candidates(0, 3)
+		got = append(got, c[s.Select(c, nil)].Position)
+	}
+	// Position 1 comes back and takes its turn after 0
+	for i := 0; i < 3; i++ {
+		c := candidates(0, 1, 3)
+		got = append(got, c[s.Select(c, nil)].Position)
+	}
+	want := []int{0, 3, 0, 3, 0, 1, 3}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Select() positions = %v, want %v", got, want)
+		}
+	}
+
+	if idx := s.Select(nil, nil); idx != -1 {
+		t.Errorf("Select(nil) = %d, want -1", idx)
+	}
+}
+
+func TestRandom_Select(t *testing.T) {
+	s := Random()
+	c := []Candidate{{Position: 0}, {Position: 1}, {Position: 2}}
+	seen := make(map[int]bool)
+	for i := 0; i < 200; i++ {
+		idx := s.Select(c, nil)
+		if idx < 0 || idx >= len(c) {
+			t.Fatalf("Select() = %d, out of range", idx)
+		}
+		seen[idx] = true
+	}
+	if len(seen) != len(c) {
+		t.Errorf("Select() chose %d distinct candidates in 200 draws, want %d", len(seen), len(c))
+	}
+}
+
+// hostSelector pins each target host to a proxy address.
+type hostSelector map[string]string
+
+func (s hostSelector) Select(candidates []Candidate, req *http.Request) int {
+	if req == nil {
+		return 0
+	}
+	for i, c := range candidates {
+		if c.Proxy.Address == s[req.URL.Hostname()] {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestNewProxyPoolWithSelector(t *testing.T) {
+	pool, err := NewProxyPoolWithSelector(config.ProxyConfig{
+		URLs: []string{"http://proxy1:8080", "http://proxy2:8080"},
+	}, hostSelector{"a.example.com": "proxy2:8080", "b.example.com": "proxy1:8080"})
+	if err != nil {
+		t.Fatalf("NewProxyPoolWithSelector() error = %v", err)
+	}
+	var hits [2]int
+	for i, e := range pool.entries {
+		e.transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			hits[i]++
+			return stubResponse(http.StatusOK, nil)(r)
+		})
+	}
+
+	for _, host := range []string{"a.example.com", "a.example.com", "b.example.com"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		resp, err := pool.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip(%s) error = %v", host, err)
+		}
+		resp.Body.Close()
+	}
+	if hits != [2]int{1, 2} {
+		t.Errorf("proxy hits = %v, want [1 2]", hits)
+	}
+
+	// A selector declining every candidate leaves nothing to try
+	req, _ := http.NewRequest(http.MethodGet, "http://c.example.com/", nil)
+	if _, err := pool.RoundTrip(req); !errors.Is(err, ErrNoProxyAvailable) {
+		t.Errorf("RoundTrip() error = %v, want ErrNoProxyAvailable", err)
+	}
+}
+
+func TestRotationFor(t *testing.T) {
+	tests := []struct {
+		rotation config.Rotation
+		rankers  int
+		want     string
+		wantErr  bool
+	}{
+		{rotation: "", want: "*proxy.roundRobin"},
+		{rotation: "random", want: "proxy.random"},
+		{rotation: "least-conn", rankers: 1, want: "*proxy.roundRobin"},
+		{rotation: "least-conn, Random", rankers: 1, want: "proxy.random"},
+		{rotation: "round-robin,least-conn", wantErr: true},
+		{rotation: "least-conn,weighted", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.rotation), func(t *testing.T) {
+			rankers, sel, err := rotationFor(tt.rotation)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rotationFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(rankers) != tt.rankers {
+				t.Errorf("rotationFor() rankers = %d, want %d", len(rankers), tt.rankers)
+			}
+			if fmt.Sprintf("%T", sel) != tt.want {
+				t.Errorf("rotationFor() selector = %T, want %s", sel, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyPool_LeastConnRotation(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:     []string{"http://proxy1:8080", "http://proxy2:8080", "http://proxy3:8080"},
+		Rotation: "least-conn,round-robin",
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	var hits [3]int
+	for i, e := range pool.entries {
+		e.transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			hits[i]++
+			return stubResponse(http.StatusOK, nil)(r)
+		})
+	}
+	get := func() *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		resp, err := pool.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip() error = %v", err)
+		}
+		return resp
+	}
+
+	// proxy1 and proxy2 keep a response open, so proxy3 has the fewest
+	// requests in flight and wins until the others finish
+	held := []*http.Response{get(), get()}
+	get().Body.Close()
+	get().Body.Close()
+	if hits != [3]int{1, 1, 2} {
+		t.Fatalf("proxy hits = %v, want [1 1 2]", hits)
+	}
+
+	// With all tied again, round-robin breaks the tie and moves on from proxy3
+	for _, resp := range held {
+		resp.Body.Close()
+	}
+	get().Body.Close()
+	if hits != [3]int{2, 1, 2} {
+		t.Errorf("proxy hits = %v, want [2 1 2]", hits)
+	}
+	for _, e := range pool.entries {
+		if n := e.active.Load(); n != 0 {
+			t.Errorf("%s active = %d after all bodies closed, want 0", e.proxy.Address, n)
+		}
+	}
+}
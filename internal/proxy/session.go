@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// sessionCredentials expands {session} and {rand} in proxy credentials, as
+// used by residential proxy vendors to pick or rotate the exit IP.
+// {session} is kept for ttl; {rand} is new every time credentials are built.
+type sessionCredentials struct {
+	username string
+	password string
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	session string
+	expires time.Time
+}
+
+func hasSessionPlaceholder(s string) bool {
+	return strings.Contains(s, "{session}") || strings.Contains(s, "{rand}")
+}
+
+// newSessionCredentials returns nil when the credentials have no placeholders.
+func newSessionCredentials(p config.ParsedProxy, ttl time.Duration) *sessionCredentials {
+	if !hasSessionPlaceholder(p.Username) && !hasSessionPlaceholder(p.Password) {
+		return nil
+	}
+	return &sessionCredentials{username: p.Username, password: p.Password, ttl: ttl}
+}
+
+// next returns the credentials for a new upstream connection.
+func (c *sessionCredentials) next() (username, password string) {
+	r := strings.NewReplacer("{session}", c.currentSession(time.Now()), "{rand}", randomToken())
+	return r.Replace(c.username), r.Replace(c.password)
+}
+
+func (c *sessionCredentials) currentSession(now time.Time) string {
+	if c.ttl <= 0 {
+		return randomToken()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == "" || !now.Before(c.expires) {
+		c.session = randomToken()
+		c.expires = now.Add(c.ttl)
+	}
+	return c.session
+}
+
+func randomToken() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
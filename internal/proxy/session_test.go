@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestSessionCredentials(t *testing.T) {
+	if c := newSessionCredentials(config.ParsedProxy{Username: "user", Password: "pass"}, 0); c != nil {
+		t.Error("credentials without placeholders should not be templated")
+	}
+
+	c := newSessionCredentials(config.ParsedProxy{Username: "user-session-{session}", Password: "pw-{rand}"}, time.Minute)
+	now := time.Now()
+	first := c.currentSession(now)
+	if got := c.currentSession(now.Add(30 * time.Second)); got != first {
+		t.Errorf("session changed within ttl: %q -> %q", first, got)
+	}
+	if got := c.currentSession(now.Add(2 * time.Minute)); got == first {
+		t.Error("session should rotate after ttl")
+	}
+
+	user, pass := c.next()
+	if !strings.HasPrefix(user, "user-session-") || strings.Contains(user, "{") {
+		t.Errorf("username = %q, want expanded session", user)
+	}
+	if _, pass2 := c.next(); pass == pass2 || strings.Contains(pass, "{") {
+		t.Errorf("{rand} should be new every time, got %q and %q", pass, pass2)
+	}
+}
+
+func TestProxyPool_SessionRotation(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name     string
+		ttl      int
+		wantSame bool
+	}{
+		{name: "new session per request", ttl: 0, wantSame: false},
+		{name: "sticky session", ttl: 60, wantSame: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestProxy(t)
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs:              []string{"http://user-session-{session}:secret@" + tp.addr()},
+				SessionTTLSeconds: tt.ttl,
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+				resp, err := pool.RoundTrip(req)
+				if err != nil {
+					t.Fatalf("RoundTrip() error = %v", err)
+				}
+				resp.Body.Close()
+			}
+
+			tp.mu.Lock()
+			defer tp.mu.Unlock()
+			if len(tp.headers) != 2 {
+				t.Fatalf("proxy saw %d requests, want 2", len(tp.headers))
+			}
+			var users []string
+			for _, h := range tp.headers {
+				raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(h.Get("Proxy-Authorization"), "Basic "))
+				user, _, _ := strings.Cut(string(raw), ":")
+				if !strings.HasPrefix(user, "user-session-") || strings.Contains(user, "{") {
+					t.Fatalf("proxy username = %q, want expanded session", user)
+				}
+				users = append(users, user)
+			}
+			if same := users[0] == users[1]; same != tt.wantSame {
+				t.Errorf("usernames %q and %q: same = %v, want %v", users[0], users[1], same, tt.wantSame)
+			}
+		})
+	}
+}
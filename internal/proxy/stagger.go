@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// staggerOffsets returns n start offsets evenly spaced over spread, shifted
+// by a random phase so that rounds, and pools, do not line up.
+func staggerOffsets(n int, spread time.Duration) []time.Duration {
+	if n == 0 || spread <= 0 {
+		return make([]time.Duration, n)
+	}
+	step := spread / time.Duration(n)
+	phase := time.Duration(rand.Int64N(int64(step) + 1))
+	offsets := make([]time.Duration, n)
+	for i := range offsets {
+		offsets[i] = phase + time.Duration(i)*step
+	}
+	return offsets
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestStaggerOffsets(t *testing.T) {
+	const spread = time.Minute
+	for i := 0; i < 20; i++ {
+		offsets := staggerOffsets(4, spread)
+		step := spread / 4
+		for j, off := range offsets {
+			if off < 0 || off > spread {
+				t.Fatalf("offset %d = %v, outside [0, %v]", j, off, spread)
+			}
+			if j > 0 && off-offsets[j-1] != step {
+				t.Fatalf("offsets %v are not %v apart", offsets, step)
+			}
+		}
+	}
+	if got := staggerOffsets(3, 0); len(got) != 3 || got[2] != 0 {
+		t.Errorf("staggerOffsets(3, 0) = %v, want three zero offsets", got)
+	}
+	if got := staggerOffsets(0, spread); len(got) != 0 {
+		t.Errorf("staggerOffsets(0) = %v, want none", got)
+	}
+}
+
+func TestProxyPool_CheckProxiesStaggered(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs: []string{"http://proxy1:8080", "http://proxy2:8080", "http://proxy3:8080", "http://proxy4:8080"},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	var mu sync.Mutex
+	var started []time.Time
+	pool.probe = func(_ context.Context, e *proxyEntry) {
+		mu.Lock()
+		started = append(started, time.Now())
+		mu.Unlock()
+	}
+
+	const spread = 200 * time.Millisecond
+	begin := time.Now()
+	pool.checkProxies(context.Background(), spread)
+
+	if len(started) != 4 {
+		t.Fatalf("probed %d proxies, want 4", len(started))
+	}
+	// Four probes a quarter of the spread apart span at least three quarters of it
+	if span := started[3].Sub(started[0]); span < spread*3/4-10*time.Millisecond {
+		t.Errorf("probes spanned %v, want them staggered over %v", span, spread)
+	}
+	if took := time.Since(begin); took > 2*spread {
+		t.Errorf("round took %v, want about %v", took, spread)
+	}
+}
+
+func TestProxyPool_CheckProxiesStaggeredCancel(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs: []string{"http://proxy1:8080", "http://proxy2:8080"},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	probed := make(chan struct{}, 2)
+	pool.probe = func(_ context.Context, e *proxyEntry) { probed <- struct{}{} }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	pool.checkProxies(ctx, time.Hour)
+
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("cancelled round took %v, want it to stop waiting", took)
+	}
+	if len(probed) > 1 {
+		t.Errorf("probed %d proxies, want the later ones skipped after cancel", len(probed))
+	}
+}
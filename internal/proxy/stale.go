@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+const (
+	defaultStaleEntries = 1000
+	defaultStaleBodyKB  = 1024
+	// staleWarning is the RFC 7234 warning added to responses served stale
+	staleWarning = `110 - "Response is Stale"`
+)
+
+// staleTransport remembers the last good response to each cacheable GET and
+// returns it, marked stale, when the next transport fails.
+type staleTransport struct {
+	next     http.RoundTripper
+	logger   *slog.Logger
+	maxBody  int64
+	maxStale time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	max     int
+	order   *list.List // most recently stored first
+	entries map[string]*list.Element
+}
+
+type staleEntry struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+}
+
+// newStaleTransport returns next unchanged when serving stale responses is off.
+func newStaleTransport(next http.RoundTripper, cfg config.CacheConfig, logger *slog.Logger) http.RoundTripper {
+	if !cfg.ServeStaleOnError {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	t := &staleTransport{
+		next:     next,
+		logger:   logger,
+		maxBody:  int64(cfg.MaxBodyKB) << 10,
+		maxStale: time.Duration(cfg.MaxStaleSeconds) * time.Second,
+		now:      time.Now,
+		max:      cfg.MaxEntries,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	if t.max == 0 {
+		t.max = defaultStaleEntries
+	}
+	if t.maxBody == 0 {
+		t.maxBody = defaultStaleBodyKB << 10
+	}
+	return t
+}
+
+func (t *staleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !staleCacheable(req) {
+		return t.next.RoundTrip(req)
+	}
+	key := staleKey(req)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		if stale := t.lookup(key, req); stale != nil {
+			if t.logger != nil {
+				t.logger.Warn("upstream failed, serving stale response",
+					"url", req.URL.String(), "error", err)
+			}
+			return stale, nil
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK && staleStorable(resp) {
+		// Cloned now, before ModifyResponse rewrites it, since a stale copy
+		// goes through ModifyResponse again
+		header := resp.Header.Clone()
+		resp.Body = &staleCapture{
+			ReadCloser: resp.Body,
+			limit:      t.maxBody,
+			done: func(body []byte) {
+				t.store(key, http.StatusOK, header, body)
+			},
+		}
+	}
+	return resp, nil
+}
+
+// staleCacheable reports whether req may be answered from the store: plain
+// GETs that carry no credentials or cookies and ask for the whole resource.
+// The key holds neither, so a personalised page would reach other clients.
+func staleCacheable(req *http.Request) bool {
+	return req.Method == http.MethodGet &&
+		req.Header.Get("Authorization") == "" &&
+		req.Header.Get("Proxy-Authorization") == "" &&
+		req.Header.Get("Cookie") == "" &&
+		req.Header.Get("Range") == ""
+}
+
+// staleStorable reports whether resp may be kept for other clients.
+func staleStorable(resp *http.Response) bool {
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" && !strings.EqualFold(f, "Accept-Encoding") {
+				return false
+			}
+		}
+	}
+	for _, v := range resp.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d == "no-store" || d == "private" || strings.HasPrefix(d, "private=") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// staleKey identifies a response by URL and, since a stored body may be
+// compressed, by the encodings the client accepts.
+func staleKey(req *http.Request) string {
+	return req.URL.String() + "\x00" + req.Header.Get("Accept-Encoding")
+}
+
+func (t *staleTransport) store(key string, status int, header http.Header, body []byte) {
+	e := &staleEntry{key: key, status: status, header: header, body: body, stored: t.now()}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.entries[key]; ok {
+		el.Value = e
+		t.order.MoveToFront(el)
+		return
+	}
+	t.entries[key] = t.order.PushFront(e)
+	for t.order.Len() > t.max {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.entries, oldest.Value.(*staleEntry).key)
+	}
+}
+
+// lookup builds a response from the stored entry for key, or returns nil
+// when there is none or it is older than maxStale.
+func (t *staleTransport) lookup(key string, req *http.Request) *http.Response {
+	t.mu.Lock()
+	el, ok := t.entries[key]
+	t.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*staleEntry)
+	age := t.now().Sub(e.stored)
+	if t.maxStale > 0 && age > t.maxStale {
+		return nil
+	}
+	header := e.header.Clone()
+	header.Add("Warning", staleWarning)
+	header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	header.Set("Content-Length", strconv.Itoa(len(e.body)))
+	return &http.Response{
+		Status:        strconv.Itoa(e.status) + " " + http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// staleCapture copies a response body as it is read and hands it to done
+// once it has been read to the end within limit bytes.
+type staleCapture struct {
+	io.ReadCloser
+	limit int64
+	buf   bytes.Buffer
+	over  bool
+	done  func([]byte)
+}
+
+func (c *staleCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if !c.over {
+		if int64(c.buf.Len()+n) > c.limit {
+			c.over = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !c.over && c.done != nil {
+		c.done(c.buf.Bytes())
+		c.done = nil
+	}
+	return n, err
+}
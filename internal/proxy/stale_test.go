@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestReverseProxy_ServeStaleOnError(t *testing.T) {
+	target, _ := url.Parse("http://target.example.com")
+	cfg := config.DefaultConfig()
+	cfg.Cache = config.CacheConfig{ServeStaleOnError: true, MaxStaleSeconds: 60}
+
+	down := false
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		resp, _ := textResponse(http.StatusOK, "fresh "+r.URL.Path)(r)
+		if r.URL.Path == "/private" {
+			resp.Header.Set("Cache-Control", "private")
+		}
+		return resp, nil
+	})
+	rp := NewReverseProxy(target, cfg, transport, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	st := rp.Transport.(*staleTransport)
+	now := time.Now()
+	st.now = func() time.Time { return now }
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		rp.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+	for _, path := range []string{"/page", "/private"} {
+		if rec := serve(http.MethodGet, path); rec.Code != http.StatusOK || rec.Header().Get("Warning") != "" {
+			t.Fatalf("GET %s while up = %d, Warning %q", path, rec.Code, rec.Header().Get("Warning"))
+		}
+	}
+	personal := httptest.NewRequest(http.MethodGet, "/account", nil)
+	personal.Header.Set("Cookie", "session=alice")
+	rp.ServeHTTP(httptest.NewRecorder(), personal)
+
+	down = true
+	now = now.Add(30 * time.Second)
+	rec := serve(http.MethodGet, "/page")
+	if rec.Code != http.StatusOK || rec.Body.String() != "fresh /page" {
+		t.Fatalf("stale GET = %d %q, want 200 %q", rec.Code, rec.Body.String(), "fresh /page")
+	}
+	if got := rec.Header().Get("Warning"); got != staleWarning {
+		t.Errorf("Warning = %q, want %q", got, staleWarning)
+	}
+	if got := rec.Header().Get("Age"); got != "30" {
+		t.Errorf("Age = %q, want 30", got)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{name: "not stored", method: http.MethodGet, path: "/other"},
+		{name: "private", method: http.MethodGet, path: "/private"},
+		{name: "requested with cookie", method: http.MethodGet, path: "/account"},
+		{name: "not a GET", method: http.MethodPost, path: "/page"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := serve(tt.method, tt.path); rec.Code != http.StatusBadGateway {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, rec.Code, http.StatusBadGateway)
+			}
+		})
+	}
+
+	now = now.Add(time.Minute)
+	if rec := serve(http.MethodGet, "/page"); rec.Code != http.StatusBadGateway {
+		t.Errorf("GET past max_stale_seconds = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestStaleTransport_Limits(t *testing.T) {
+	body := "0123456789"
+	st := newStaleTransport(textResponse(http.StatusOK, body), config.CacheConfig{ServeStaleOnError: true, MaxEntries: 1}, nil).(*staleTransport)
+	st.maxBody = int64(len(body) - 1)
+
+	req := httptest.NewRequest(http.MethodGet, "http://target.example.com/a", nil)
+	resp, _ := st.RoundTrip(req)
+	_, _ = io.ReadAll(resp.Body)
+	if len(st.entries) != 0 {
+		t.Errorf("entries = %d, want body over max_body_kb skipped", len(st.entries))
+	}
+
+	st.maxBody = 1 << 10
+	for _, path := range []string{"/a", "/b"} {
+		resp, _ := st.RoundTrip(httptest.NewRequest(http.MethodGet, "http://target.example.com"+path, nil))
+		_, _ = io.ReadAll(resp.Body)
+	}
+	if len(st.entries) != 1 || st.lookup(staleKey(httptest.NewRequest(http.MethodGet, "http://target.example.com/b", nil)), req) == nil {
+		t.Errorf("entries = %d, want only the newest kept", len(st.entries))
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// poolState is the on-disk representation of proxy health
+type poolState struct {
+	Proxies map[string]entryState `json:"proxies"`
+}
+
+type entryState struct {
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+	DownSince time.Time `json:"down_since,omitzero"`
+}
+
+// loadState applies persisted health to matching entries and marks those
+// checked within the last health check interval as restored. A missing file
+// is not an error; entries keep their defaults when it fails.
+func (p *ProxyPool) loadState() error {
+	data, err := os.ReadFile(p.statePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read proxy state: %w", err)
+	}
+
+	var state poolState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("parse proxy state %s: %w", p.statePath, err)
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, e := range p.entries {
+		saved, ok := state.Proxies[fmt.Sprintf("%s://%s", e.proxy.Type, e.proxy.Address)]
+		if !ok {
+			continue
+		}
+		e.mu.Lock()
+		e.healthy.Store(saved.Healthy)
+		e.lastCheck = saved.LastCheck
+		e.lastError = saved.LastError
+		e.downSince = saved.DownSince
+		e.mu.Unlock()
+		if time.Since(saved.LastCheck) < defaultHealthCheckInterval {
+			if p.restored == nil {
+				p.restored = make(map[*proxyEntry]bool)
+			}
+			p.restored[e] = true
+		}
+	}
+	return nil
+}
+
+// saveState writes current health to the state file atomically
+func (p *ProxyPool) saveState() error {
+	state := poolState{Proxies: make(map[string]entryState)}
+
+	p.mu.RLock()
+	for _, e := range p.entries {
+		e.mu.RLock()
+		state.Proxies[fmt.Sprintf("%s://%s", e.proxy.Type, e.proxy.Address)] = entryState{
+			Healthy:   e.isHealthy(),
+			LastCheck: e.lastCheck,
+			LastError: e.lastError,
+			DownSince: e.downSince,
+		}
+		e.mu.RUnlock()
+	}
+	p.mu.RUnlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode proxy state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.statePath), ".proxy-state-*")
+	if err != nil {
+		return fmt.Errorf("create temp state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write proxy state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write proxy state: %w", err)
+	}
+	return os.Rename(tmp.Name(), p.statePath)
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestProxyPool_StatePersistence(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	cfg := config.ProxyConfig{
+		URLs: []string{
+			"http://proxy1:8080",
+			"http://proxy2:8080",
+		},
+		StateFile: statePath,
+	}
+
+	pool, err := NewProxyPool(cfg)
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	pool.entries[1].setHealthy(false, "connection refused")
+	downSince := pool.entries[1].downSince
+	if err := pool.saveState(); err != nil {
+		t.Fatalf("saveState() error = %v", err)
+	}
+
+	// Simulate restart
+	restarted, err := NewProxyPool(cfg)
+	if err != nil {
+		t.Fatalf("NewProxyPool() after restart error = %v", err)
+	}
+
+	if !restarted.entries[0].isHealthy() {
+		t.Error("proxy1 should stay healthy after restart")
+	}
+	if restarted.entries[1].isHealthy() {
+		t.Error("proxy2 should be loaded as unhealthy after restart")
+	}
+	if !restarted.entries[1].downSince.Equal(downSince) {
+		t.Errorf("downSince = %v, want %v", restarted.entries[1].downSince, downSince)
+	}
+	if restarted.HealthyCount() != 1 {
+		t.Errorf("HealthyCount() = %d, want 1", restarted.HealthyCount())
+	}
+
+	// A successful probe overrides the loaded state
+	restarted.entries[1].setHealthy(true, "")
+	if !restarted.entries[1].isHealthy() || !restarted.entries[1].downSince.IsZero() {
+		t.Error("probe result should replace loaded state")
+	}
+}
+
+func TestProxyPool_StateFileMissing(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:      []string{"http://proxy1:8080"},
+		StateFile: filepath.Join(t.TempDir(), "missing.json"),
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	if pool.HealthyCount() != 1 {
+		t.Errorf("HealthyCount() = %d, want 1", pool.HealthyCount())
+	}
+}
+
+func TestProxyPool_StateFileCorrupt(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(statePath, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:      []string{"http://proxy1:8080"},
+		StateFile: statePath,
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v, want the corrupt state file ignored", err)
+	}
+	if pool.HealthyCount() != 1 {
+		t.Errorf("HealthyCount() = %d, want 1", pool.HealthyCount())
+	}
+
+	var logs strings.Builder
+	pool.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	if !strings.Contains(logs.String(), "ignoring proxy state file") {
+		t.Errorf("SetLogger() should warn about the corrupt state file, logged %q", logs.String())
+	}
+}
+
+func TestProxyEntry_DownSince(t *testing.T) {
+	e := &proxyEntry{}
+	e.setHealthy(false, "first")
+	first := e.downSince
+	if first.IsZero() {
+		t.Fatal("downSince should be set when proxy goes down")
+	}
+	time.Sleep(time.Millisecond)
+	e.setHealthy(false, "second")
+	if !e.downSince.Equal(first) {
+		t.Error("downSince should not move while proxy stays down")
+	}
+	e.setHealthy(true, "")
+	if !e.downSince.IsZero() {
+		t.Error("downSince should reset when proxy recovers")
+	}
+}
+
+func TestProxyPool_StateSkipsInitialCheck(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	cfg := config.ProxyConfig{
+		URLs: []string{
+			"http://proxy1:8080",
+			"http://proxy2:8080",
+		},
+		StateFile: statePath,
+	}
+
+	pool, err := NewProxyPool(cfg)
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	pool.entries[0].setHealthy(false, "connection refused")
+	pool.entries[0].lastCheck = time.Now()
+	// Checked too long ago to be trusted
+	pool.entries[1].setHealthy(false, "connection refused")
+	pool.entries[1].lastCheck = time.Now().Add(-2 * defaultHealthCheckInterval)
+	if err := pool.saveState(); err != nil {
+		t.Fatalf("saveState() error = %v", err)
+	}
+
+	restarted, err := NewProxyPool(cfg)
+	if err != nil {
+		t.Fatalf("NewProxyPool() after restart error = %v", err)
+	}
+	var probed []string
+	restarted.probe = func(ctx context.Context, e *proxyEntry) {
+		probed = append(probed, e.proxy.Address)
+		e.setHealthy(true, "")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restarted.StartHealthCheck(ctx)
+
+	if len(probed) != 1 || probed[0] != "proxy2:8080" {
+		t.Errorf("initial check probed %v, want only proxy2:8080", probed)
+	}
+	if restarted.entries[0].isHealthy() {
+		t.Error("proxy1 should keep its restored unhealthy state until the next round")
+	}
+	if !restarted.entries[1].isHealthy() {
+		t.Error("proxy2 with stale state should be probed at startup")
+	}
+}
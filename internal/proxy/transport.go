@@ -3,50 +3,207 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"math/rand"
+	"maps"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/proxy"
 
-	"sockstream/internal/config"
+	"github.com/foxzi/SockStream/internal/config"
 )
 
+// ProxySelectHeader names the proxy a request must use when
+// proxy.allow_header_selection is on. It is always removed before forwarding.
+const ProxySelectHeader = "X-Sockstream-Proxy"
+
 const (
 	defaultHealthCheckInterval = 5 * time.Minute
 	defaultHealthCheckTimeout  = 10 * time.Second
 	healthCheckURL             = "https://www.google.com/generate_204"
+	maxRetryAfter              = time.Hour
+	// maxHealthCheckBody bounds how much body expect_body searches
+	maxHealthCheckBody = 64 << 10
 )
 
 // proxyEntry holds a proxy transport and its health status
 type proxyEntry struct {
 	transport http.RoundTripper
-	proxy     config.ParsedProxy
-	healthy   atomic.Bool
-	lastCheck time.Time
-	lastError string
-	mu        sync.RWMutex
+	// checkTransport, when set, is used for health checks instead of transport
+	checkTransport http.RoundTripper
+	proxy          config.ParsedProxy
+	healthy        atomic.Bool
+	lastCheck      time.Time
+	lastError      string
+	downSince      time.Time
+	mu             sync.RWMutex
+	// coolUntil is a unix-nano deadline set from upstream Retry-After
+	coolUntil atomic.Int64
+	// disabled is set by an operator and takes the entry out of rotation
+	// regardless of its health
+	disabled atomic.Bool
+	latency  latencyWindow
+	// exitIP is the address seen by the exit IP endpoint, guarded by mu
+	exitIP string
+	// dial opens a raw connection through the entry for CONNECT tunnels
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// pos is the entry's place in the round-robin ring, fixed at creation
+	pos int
+	// warm is set once the request transport holds a connection to the
+	// warm-up URL; cleared when the entry fails a check
+	warm atomic.Bool
+	// guard checks targets before they are handed to the proxy; direct
+	// entries check in their dialer instead
+	guard *targetGuard
+	// sent and received count request and response body bytes
+	sent     atomic.Int64
+	received atomic.Int64
+	// active counts requests until their response body is closed, and
+	// tunnels until the connection is closed
+	active atomic.Int64
+	// group is the proxy.groups entry the proxy belongs to, empty for proxy.urls
+	group string
+}
+
+// roundTrip sends req through the entry, recording the time to response headers.
+func (e *proxyEntry) roundTrip(req *http.Request) (*http.Response, error) {
+	if err := e.guard.checkHost(req.Context(), req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		out := *req
+		out.Body = &countedBody{ReadCloser: req.Body, n: &e.sent}
+		req = &out
+	}
+	e.active.Add(1)
+	start := time.Now()
+	resp, err := e.transport.RoundTrip(req)
+	if err != nil {
+		e.active.Add(-1)
+		return nil, err
+	}
+	e.latency.observe(time.Since(start))
+	rwc, upgraded := resp.Body.(io.ReadWriteCloser)
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		resp.Body = &activeBody{ReadCloser: &countedBody{ReadCloser: resp.Body, n: &e.received}, done: e.release()}
+	case upgraded:
+		// An upgraded connection's body must stay writable
+		resp.Body = &activeUpgrade{ReadWriteCloser: rwc, done: e.release()}
+	default:
+		e.active.Add(-1)
+	}
+	return resp, nil
+}
+
+// dialContext opens a tunnel through the entry, counted as active until
+// the connection is closed.
+func (e *proxyEntry) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	e.active.Add(1)
+	conn, err := e.dial(ctx, network, addr)
+	if err != nil {
+		e.active.Add(-1)
+		return nil, err
+	}
+	return &activeConn{Conn: conn, done: e.release()}, nil
+}
+
+// release returns a function that ends one active request or tunnel, however
+// often it is called.
+func (e *proxyEntry) release() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { e.active.Add(-1) })
+	}
+}
+
+type activeBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *activeBody) Close() error {
+	defer b.done()
+	return b.ReadCloser.Close()
+}
+
+type activeUpgrade struct {
+	io.ReadWriteCloser
+	done func()
+}
+
+func (b *activeUpgrade) Close() error {
+	defer b.done()
+	return b.ReadWriteCloser.Close()
+}
+
+type activeConn struct {
+	net.Conn
+	done func()
+}
+
+func (c *activeConn) Close() error {
+	defer c.done()
+	return c.Conn.Close()
+}
+
+// countedBody adds the bytes read through it to n.
+type countedBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *countedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+func (e *proxyEntry) healthTransport() http.RoundTripper {
+	if e.checkTransport != nil {
+		return e.checkTransport
+	}
+	return e.transport
 }
 
 func (e *proxyEntry) isHealthy() bool {
 	return e.healthy.Load()
 }
 
+func (e *proxyEntry) coolingDown(now time.Time) bool {
+	return now.UnixNano() < e.coolUntil.Load()
+}
+
+// available reports whether the entry may be selected for new requests
+func (e *proxyEntry) available(now time.Time) bool {
+	return !e.disabled.Load() && e.isHealthy() && !e.coolingDown(now)
+}
+
 func (e *proxyEntry) setHealthy(healthy bool, err string) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
+	now := time.Now()
+	if healthy {
+		e.downSince = time.Time{}
+	} else if e.downSince.IsZero() {
+		e.downSince = now
+	}
 	e.healthy.Store(healthy)
-	e.lastCheck = time.Now()
+	e.lastCheck = now
 	e.lastError = err
 }
 
@@ -59,75 +216,315 @@ func (e *proxyEntry) getLastError() string {
 // ProxyPool manages a pool of proxy transports with rotation and health checks
 type ProxyPool struct {
 	entries  []*proxyEntry
-	rotation string
-	counter  atomic.Uint64
+	selector Selector
+	// rankers narrow the candidates before selector picks one
+	rankers  []ranker
 	mu       sync.RWMutex
 	logger   *slog.Logger
-	stopCh   chan struct{}
 	isDirect bool
+	// ctx bounds health checks; cancelled by Stop or the StartHealthCheck context
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	degradedPercent int
+	onAllUnhealthy  string
+	directFallback  bool
+	// buffers holds request bodies for retries and backs response copies
+	buffers *BufferPool
+	// retryMemory is how much of a retried body is kept in memory before spilling to disk
+	retryMemory int64
+	// retryMaxBody is how much of a body is kept for retries at all
+	retryMaxBody int64
+	// retries limits retries to a share of recent requests; nil allows all
+	retries *retryBudget
+	// headerSelect lets ProxySelectHeader pick the entry
+	headerSelect bool
+	ejectAfter   time.Duration
+	statePath    string
+	// stateErr is why the state file was ignored, logged by SetLogger
+	stateErr error
+	// restored holds entries whose saved health is recent enough to skip
+	// the initial check
+	restored map[*proxyEntry]bool
+	workers  int
+	// jitter spreads periodic check rounds over this fraction of the interval
+	jitter float64
+	// direct serves requests when onAllUnhealthy is "direct", after every
+	// proxy failed and directFallback is set, or for bypassed hosts
+	direct *proxyEntry
+	bypass *bypassList
+	// routes send target hosts to a group of entries; ungrouped is set when
+	// some entries belong to no group and so serve unrouted hosts
+	routes    []hostRoute
+	ungrouped bool
+	// pools are the named pools of proxy.pools, each with its own rotation
+	// and health checks; routes send hosts to them
+	pools map[string]*ProxyPool
+	// healthURL is probed through each proxy; expectStatus and expectBody
+	// tighten the default "any 2xx" rule
+	healthURL    string
+	expectStatus int
+	expectBody   string
+	// exitIPURL, when set, is fetched through each proxy after a passing check
+	exitIPURL      string
+	rejectDirectIP bool
+	directProbe    http.RoundTripper
+	directIP       atomic.Pointer[string]
+	// warmUpURL, when set, is requested through each entry after it passes
+	// its first check or recovers
+	warmUpURL string
+	// probe checks a single entry; replaced in tests
+	probe func(context.Context, *proxyEntry)
 }
 
 // NewProxyPool creates a new proxy pool from config
 func NewProxyPool(cfg config.ProxyConfig) (*ProxyPool, error) {
+	return NewProxyPoolWithSelector(cfg, nil)
+}
+
+// NewProxyPoolWithSelector is like NewProxyPool but picks proxies with sel
+// instead of the strategy named by cfg.Rotation. A nil sel uses cfg.Rotation.
+func NewProxyPoolWithSelector(cfg config.ProxyConfig, sel Selector) (*ProxyPool, error) {
 	proxies, err := cfg.GetProxies()
 	if err != nil {
 		return nil, err
 	}
+	return newProxyPool(proxies, cfg, sel)
+}
+
+// newProxyPool builds a pool for proxies; cfg supplies everything but the
+// proxy list.
+func newProxyPool(proxies []config.ParsedProxy, cfg config.ProxyConfig, sel Selector) (*ProxyPool, error) {
+	var (
+		rankers []ranker
+		err     error
+	)
+	if sel == nil {
+		if rankers, sel, err = rotationFor(cfg.Rotation); err != nil {
+			return nil, err
+		}
+	}
 
 	pool := &ProxyPool{
-		rotation: strings.ToLower(cfg.Rotation),
-		stopCh:   make(chan struct{}),
+		selector:        sel,
+		rankers:         rankers,
+		degradedPercent: cfg.DegradedPercent,
+		onAllUnhealthy:  strings.ToLower(cfg.OnAllUnhealthy),
+		directFallback:  cfg.AllowDirectFallback,
+		headerSelect:    cfg.AllowHeaderSelection,
+		ejectAfter:      time.Duration(cfg.EjectAfterSeconds) * time.Second,
+		statePath:       cfg.StateFile,
+		workers:         cfg.HealthCheck.Workers,
+		jitter:          cfg.HealthCheck.Jitter,
+		healthURL:       cfg.HealthCheck.URL,
+		expectStatus:    cfg.HealthCheck.ExpectStatus,
+		expectBody:      cfg.HealthCheck.ExpectBody,
+		exitIPURL:       cfg.HealthCheck.ExitIPURL,
+		rejectDirectIP:  cfg.HealthCheck.RejectDirectExitIP,
+		buffers:         NewBufferPool(cfg.BufferSizeKB << 10),
+		retryMemory:     int64(cfg.RetryMemoryKB) << 10,
+		retryMaxBody:    int64(cfg.RetryMaxBodyMB) << 20,
+		retries:         newRetryBudget(cfg.RetryBudget.Percent, cfg.RetryBudget.WindowSeconds, cfg.RetryBudget.MinRetries),
 	}
+	pool.probe = pool.checkProxy
+	pool.ctx, pool.cancel = context.WithCancel(context.Background())
 
-	if pool.rotation == "" {
-		pool.rotation = "round-robin"
+	if pool.healthURL == "" {
+		pool.healthURL = healthCheckURL
+	}
+	if cfg.HealthCheck.WarmUp {
+		pool.warmUpURL = cfg.HealthCheck.WarmUpURL
+	}
+	if pool.onAllUnhealthy == "" {
+		pool.onAllUnhealthy = "fallback"
+	}
+
+	opts, err := newTransportOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Pools) > 0 {
+		pool.pools = make(map[string]*ProxyPool, len(cfg.Pools))
+		for name, pc := range cfg.Pools {
+			inheritPoolSettings(&pc, cfg)
+			if pool.pools[name], err = NewProxyPool(pc); err != nil {
+				return nil, fmt.Errorf("proxy pool %s: %w", name, err)
+			}
+		}
+	}
+	if pool.routes, err = newHostRoutes(cfg.Routes, pool.pools); err != nil {
+		return nil, err
+	}
+	if pool.bypass, err = newBypassList(cfg.Bypass); err != nil {
+		return nil, err
 	}
 
 	// If no proxies configured, use direct connection
 	if len(proxies) == 0 {
-		tr, err := newDirectTransport(cfg.Timeouts)
+		entry, err := newDirectEntry(opts)
 		if err != nil {
 			return nil, err
 		}
-		pool.entries = []*proxyEntry{{
-			transport: tr,
-			proxy:     config.ParsedProxy{Type: "direct", Address: "direct"},
-		}}
-		pool.entries[0].healthy.Store(true)
+		pool.entries = []*proxyEntry{entry}
 		pool.isDirect = true
+		pool.ungrouped = true
 		return pool, nil
 	}
 
 	// Create transport for each proxy
 	for _, p := range proxies {
-		tr, err := newProxyTransport(p, cfg.Timeouts)
+		// A "direct" URL rotates with the proxies and is health-checked like them
+		if p.Type == "direct" {
+			entry, err := newDirectEntry(opts)
+			if err != nil {
+				return nil, err
+			}
+			entry.group = p.Group
+			pool.entries = append(pool.entries, entry)
+			continue
+		}
+		tr, err := newProxyTransport(p, opts)
 		if err != nil {
 			return nil, fmt.Errorf("create transport for %s://%s: %w", p.Type, p.Address, err)
 		}
+		d, err := newEntryDialer(p, opts)
+		if err != nil {
+			return nil, fmt.Errorf("create dialer for %s://%s: %w", p.Type, p.Address, err)
+		}
 		entry := &proxyEntry{
 			transport: tr,
 			proxy:     p,
+			dial:      opts.guard.dial(d.DialContext),
+			guard:     opts.guard,
+			group:     p.Group,
 		}
 		entry.healthy.Store(true) // assume healthy until checked
 		pool.entries = append(pool.entries, entry)
 	}
+	for i, e := range pool.entries {
+		e.pos = i
+		if e.group == "" {
+			pool.ungrouped = true
+		}
+	}
+
+	if pool.onAllUnhealthy == "direct" || pool.directFallback || pool.bypass != nil {
+		if pool.direct, err = newDirectEntry(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if pool.rejectDirectIP {
+		if pool.directProbe, err = newDirectTransport(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if pool.statePath != "" {
+		// Saved health is only a head start; the checks rebuild it
+		pool.stateErr = pool.loadState()
+	}
 
 	return pool, nil
 }
 
-// SetLogger sets the logger for health check logging
+// SetLogger sets the logger for health check logging. Named pools log
+// with their name in the "pool" attribute.
 func (p *ProxyPool) SetLogger(logger *slog.Logger) {
 	p.logger = logger
+	if logger != nil && p.stateErr != nil {
+		logger.Warn("ignoring proxy state file", "path", p.statePath, "error", p.stateErr)
+		p.stateErr = nil
+	}
+	for name, sub := range p.pools {
+		if logger == nil {
+			sub.SetLogger(nil)
+		} else {
+			sub.SetLogger(logger.With("pool", name))
+		}
+	}
+}
+
+// inheritPoolSettings gives a named pool the settings of its parent that
+// are not configured per pool: the target address guard, the TLS
+// fingerprint, HTTP/2-only upstreams and the warm-up URL default.
+func inheritPoolSettings(pc *config.ProxyConfig, parent config.ProxyConfig) {
+	pc.Security = parent.Security
+	pc.Transport.TLSFingerprint = parent.Transport.TLSFingerprint
+	if parent.Transport.HTTP2Only {
+		pc.Transport.HTTP2Only = true
+	}
+	if pc.HealthCheck.WarmUpURL == "" {
+		pc.HealthCheck.WarmUpURL = parent.HealthCheck.WarmUpURL
+	}
+}
+
+// Pools returns the named pools of proxy.pools, or nil when there are none.
+func (p *ProxyPool) Pools() map[string]*ProxyPool {
+	return maps.Clone(p.pools)
 }
 
-// StartHealthCheck starts the health check routine
+// SetTargetServerName overrides the TLS SNI used for connections to the target.
+// Health checks keep the default SNI since they contact a different host.
+func (p *ProxyPool) SetTargetServerName(name string) {
+	if name == "" {
+		return
+	}
+	for _, sub := range p.pools {
+		sub.SetTargetServerName(name)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.entries {
+		e.setTargetServerName(name)
+	}
+	if p.direct != nil {
+		p.direct.setTargetServerName(name)
+	}
+}
+
+func (e *proxyEntry) setTargetServerName(name string) {
+	tr, ok := e.transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	if e.checkTransport == nil {
+		check := tr.Clone()
+		// A customConns TLS dialer reads tr's config; let the check
+		// transport handshake itself with the original server name
+		check.DialTLSContext = nil
+		e.checkTransport = check
+	}
+	if tr.Proxy != nil && e.proxy.Type != "direct" {
+		// http.Transport would also present the name to an https proxy,
+		// so tunnel to the target and leave the proxy handshake to the
+		// entry's dialer
+		tr.Proxy = nil
+		tr.DialContext = e.dial
+	}
+	tlsCfg := tr.TLSClientConfig.Clone()
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{}
+	}
+	tlsCfg.ServerName = name
+	tr.TLSClientConfig = tlsCfg
+}
+
+// StartHealthCheck starts the health check routine, and those of the named
+// pools. Cancelling ctx has the same effect as Stop.
 func (p *ProxyPool) StartHealthCheck(ctx context.Context) {
+	for _, name := range slices.Sorted(maps.Keys(p.pools)) {
+		p.pools[name].StartHealthCheck(ctx)
+	}
 	if p.isDirect {
 		return
 	}
+	context.AfterFunc(ctx, p.cancel)
 
-	// Initial health check
-	p.checkAllProxies()
+	// Initial health check. Entries restored from the state file keep their
+	// saved health until the first periodic round.
+	p.checkEntries(p.ctx, p.unrestoredEntries(), 0)
 
 	// Periodic health check
 	ticker := time.NewTicker(defaultHealthCheckInterval)
@@ -135,47 +532,166 @@ func (p *ProxyPool) StartHealthCheck(ctx context.Context) {
 		defer ticker.Stop()
 		for {
 			select {
-			case <-ctx.Done():
-				return
-			case <-p.stopCh:
+			case <-p.ctx.Done():
 				return
 			case <-ticker.C:
-				p.checkAllProxies()
+				p.checkProxies(p.ctx, time.Duration(p.jitter*float64(defaultHealthCheckInterval)))
 			}
 		}
 	}()
 }
 
-// Stop stops the health check routine
+// Stop stops the health check routines and aborts checks in flight
 func (p *ProxyPool) Stop() {
-	close(p.stopCh)
+	for _, sub := range p.pools {
+		sub.Stop()
+	}
+	p.cancel()
 }
 
-func (p *ProxyPool) checkAllProxies() {
+// checkAllProxies probes every entry at once, bounded only by p.workers.
+func (p *ProxyPool) checkAllProxies(ctx context.Context) {
+	p.checkProxies(ctx, 0)
+}
+
+// checkProxies probes every entry, staggering the probes in random order
+// over spread.
+func (p *ProxyPool) checkProxies(ctx context.Context, spread time.Duration) {
 	p.mu.RLock()
 	entries := make([]*proxyEntry, len(p.entries))
 	copy(entries, p.entries)
 	p.mu.RUnlock()
+	p.checkEntries(ctx, entries, spread)
+}
+
+// unrestoredEntries returns the entries not in p.restored.
+func (p *ProxyPool) unrestoredEntries() []*proxyEntry {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var entries []*proxyEntry
+	for _, e := range p.entries {
+		if !p.restored[e] {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// checkEntries probes entries, staggering the probes in random order over
+// spread. When ctx is cancelled, probes in flight are aborted, the
+// remaining entries are skipped and health, ejection and saved state are
+// left as they were.
+func (p *ProxyPool) checkEntries(ctx context.Context, entries []*proxyEntry, spread time.Duration) {
+	var offsets []time.Duration
+	if spread > 0 {
+		rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+		offsets = staggerOffsets(len(entries), spread)
+	}
+
+	if p.rejectDirectIP {
+		p.refreshDirectIP(ctx)
+	}
 
+	workers := p.workers
+	if workers <= 0 || workers > len(entries) {
+		workers = len(entries)
+	}
+
+	jobs := make(chan *proxyEntry)
 	var wg sync.WaitGroup
-	for _, entry := range entries {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func(e *proxyEntry) {
+		go func() {
 			defer wg.Done()
-			p.checkProxy(e)
-		}(entry)
+			for e := range jobs {
+				if ctx.Err() == nil {
+					p.probe(ctx, e)
+				}
+			}
+		}()
+	}
+	start := time.Now()
+feed:
+	for i, entry := range entries {
+		if offsets != nil {
+			wait := time.NewTimer(time.Until(start.Add(offsets[i])))
+			select {
+			case <-wait.C:
+			case <-ctx.Done():
+				wait.Stop()
+				break feed
+			}
+		}
+		select {
+		case jobs <- entry:
+		case <-ctx.Done():
+			break feed
+		}
 	}
+	close(jobs)
 	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	if p.ejectAfter > 0 {
+		p.ejectDeadProxies(time.Now())
+	}
 
 	// Log summary
 	p.logHealthSummary()
+
+	if p.statePath != "" {
+		if err := p.saveState(); err != nil && p.logger != nil {
+			p.logger.Warn("failed to save proxy state", "path", p.statePath, "error", err)
+		}
+	}
 }
 
-func (p *ProxyPool) checkProxy(entry *proxyEntry) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHealthCheckTimeout)
+// ejectDeadProxies permanently removes entries that have been unhealthy for
+// at least p.ejectAfter and closes their idle connections. Entries are only
+// ejected while their group has a healthy entry left: when all are down the
+// health URL or the network is more likely at fault, and the entries must
+// stay to come back once it recovers.
+func (p *ProxyPool) ejectDeadProxies(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	alive := make(map[string]bool)
+	for _, e := range p.entries {
+		if e.isHealthy() {
+			alive[e.group] = true
+		}
+	}
+	kept := make([]*proxyEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		e.mu.RLock()
+		downSince := e.downSince
+		e.mu.RUnlock()
+		if !alive[e.group] || e.isHealthy() || downSince.IsZero() || now.Sub(downSince) < p.ejectAfter {
+			kept = append(kept, e)
+			continue
+		}
+		for _, rt := range []http.RoundTripper{e.transport, e.checkTransport} {
+			if tr, ok := rt.(*http.Transport); ok {
+				tr.CloseIdleConnections()
+			}
+		}
+		if p.logger != nil {
+			p.logger.Warn("ejecting proxy after prolonged failure",
+				"proxy", fmt.Sprintf("%s://%s", e.proxy.Type, e.proxy.Address),
+				"down_since", downSince,
+				"last_error", e.getLastError())
+		}
+	}
+	p.entries = kept
+}
+
+func (p *ProxyPool) checkProxy(parent context.Context, entry *proxyEntry) {
+	ctx, cancel := context.WithTimeout(parent, defaultHealthCheckTimeout)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthCheckURL, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.healthURL, nil)
 	if err != nil {
 		entry.setHealthy(false, fmt.Sprintf("create request: %v", err))
 		p.logProxyStatus(entry, false, entry.getLastError())
@@ -183,32 +699,85 @@ func (p *ProxyPool) checkProxy(entry *proxyEntry) {
 	}
 
 	client := &http.Client{
-		Transport: entry.transport,
+		Transport: entry.healthTransport(),
 		Timeout:   defaultHealthCheckTimeout,
 	}
 
 	resp, err := client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		err = p.checkResponse(resp)
+	}
+	if err == nil && p.exitIPURL != "" {
+		err = p.checkExitIP(ctx, entry)
+	}
+	if err != nil && parent.Err() != nil {
+		// Shutting down: an aborted check says nothing about the proxy
+		return
+	}
 	if err != nil {
+		entry.warm.Store(false)
 		entry.setHealthy(false, err.Error())
 		p.logProxyStatus(entry, false, err.Error())
 		return
 	}
-	defer resp.Body.Close()
 
-	// Google's generate_204 returns 204, but any 2xx is OK
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		wasUnhealthy := !entry.isHealthy()
-		entry.setHealthy(true, "")
-		if wasUnhealthy {
-			p.logProxyStatus(entry, true, "recovered")
-		} else {
-			p.logProxyStatus(entry, true, "")
-		}
+	wasUnhealthy := !entry.isHealthy()
+	entry.setHealthy(true, "")
+	if wasUnhealthy {
+		p.logProxyStatus(entry, true, "recovered")
 	} else {
-		errMsg := fmt.Sprintf("unexpected status: %d", resp.StatusCode)
-		entry.setHealthy(false, errMsg)
-		p.logProxyStatus(entry, false, errMsg)
+		p.logProxyStatus(entry, true, "")
+	}
+	if p.warmUpURL != "" && !entry.warm.Load() {
+		p.warmUp(ctx, entry)
+	}
+}
+
+// warmUp opens a connection to p.warmUpURL through the entry's request
+// transport and leaves it idle for the first client request. A failure only
+// means the connection is opened on demand, so it does not affect health.
+func (p *ProxyPool) warmUp(ctx context.Context, entry *proxyEntry) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, p.warmUpURL, nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = entry.transport.RoundTrip(req); err == nil {
+			// Drain so the connection returns to the idle pool
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			entry.warm.Store(true)
+			return
+		}
+	}
+	if p.logger != nil && ctx.Err() == nil {
+		p.logger.Debug("proxy warm-up failed",
+			"proxy", fmt.Sprintf("%s://%s", entry.proxy.Type, entry.proxy.Address),
+			"error", err)
+	}
+}
+
+// checkResponse applies the health check expectations. By default any 2xx
+// passes (Google's generate_204 returns 204); expectStatus and expectBody
+// catch captive portals that answer with a 200 login page.
+func (p *ProxyPool) checkResponse(resp *http.Response) error {
+	if p.expectStatus != 0 {
+		if resp.StatusCode != p.expectStatus {
+			return fmt.Errorf("unexpected status: %d, want %d", resp.StatusCode, p.expectStatus)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
 	}
+	if p.expectBody == "" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+	if !bytes.Contains(body, []byte(p.expectBody)) {
+		return errors.New("response body does not contain expected text")
+	}
+	return nil
 }
 
 func (p *ProxyPool) logProxyStatus(entry *proxyEntry, healthy bool, errMsg string) {
@@ -255,49 +824,173 @@ func (p *ProxyPool) logHealthSummary() {
 
 // RoundTrip implements http.RoundTripper with proxy rotation and retry on timeout
 func (p *ProxyPool) RoundTrip(req *http.Request) (*http.Response, error) {
-	entries := p.getHealthyEntries()
+	if sub := p.routedPool(req.URL); sub != nil {
+		return sub.RoundTrip(req)
+	}
+	p.retries.request()
+	if selected := req.Header.Get(ProxySelectHeader); selected != "" {
+		// The header is meant for sockstream and never reaches the target
+		req = req.Clone(req.Context())
+		req.Header.Del(ProxySelectHeader)
+		if p.headerSelect && !p.isDirect {
+			return p.roundTripSelected(req, selected)
+		}
+	}
+	if p.bypass != nil && !p.isDirect && p.bypass.match(req.URL) {
+		return p.direct.transport.RoundTrip(req)
+	}
+	if p.directFallback && !p.isDirect {
+		return p.roundTripWithDirectFallback(req)
+	}
+	return p.roundTrip(req)
+}
+
+// BufferPool returns the pool's buffers for use as ReverseProxy.BufferPool.
+func (p *ProxyPool) BufferPool() *BufferPool {
+	return p.buffers
+}
+
+// roundTripSelected sends the request through the entry named by the
+// ProxySelectHeader value, bypassing rotation, bypass rules, routes and fallbacks.
+func (p *ProxyPool) roundTripSelected(req *http.Request, addr string) (*http.Response, error) {
+	p.mu.RLock()
+	entry := p.findEntry(addr)
+	p.mu.RUnlock()
+	if entry == nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProxy, addr)
+	}
+	if !entry.available(time.Now()) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("%w: %s", ErrProxyUnavailable, addr)
+	}
+	resp, err := entry.roundTrip(req)
+	if err == nil {
+		p.observeResponse(entry, resp)
+	}
+	return resp, err
+}
+
+// roundTripWithDirectFallback sends the request without a proxy once the
+// proxied attempt has failed. It is not used when no proxy could be tried at all.
+func (p *ProxyPool) roundTripWithDirectFallback(req *http.Request) (*http.Response, error) {
+	var body *replayBody
+	var unread *unreadBody
+	if req.Body != nil && req.Body != http.NoBody && p.streams(req) {
+		unread = &unreadBody{ReadCloser: req.Body}
+		req.Body = unread
+	} else if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = p.buffers.readBody(req.Body, p.retryMemory, p.retryMaxBody); err != nil {
+			return nil, fmt.Errorf("read request body: %w", err)
+		}
+		defer body.release()
+		unread = body.rest
+		req.Body = body.reader()
+	}
+
+	resp, err := p.roundTrip(req)
+	if err == nil || errors.Is(err, ErrNoProxyAvailable) || errors.Is(err, ErrBlockedTarget) ||
+		req.Context().Err() != nil {
+		return resp, err
+	}
+	if unread != nil && unread.started.Load() {
+		return nil, err
+	}
+	if !p.allowRetry(req) {
+		return nil, err
+	}
+
+	if p.logger != nil {
+		p.logger.Warn("proxy request failed, falling back to direct connection",
+			"url", req.URL.String(),
+			"error", err)
+	}
+	if body != nil {
+		req.Body = body.reader()
+	}
+	return p.direct.transport.RoundTrip(req)
+}
+
+func (p *ProxyPool) roundTrip(req *http.Request) (*http.Response, error) {
+	entries := p.healthyEntries(p.routeGroup(req.URL))
 	if len(entries) == 0 {
-		return nil, fmt.Errorf("no proxies available")
+		return nil, ErrNoProxyAvailable
 	}
 
 	// For single proxy or direct connection, no retry needed
 	if len(entries) == 1 || p.isDirect {
-		return entries[0].transport.RoundTrip(req)
+		resp, err := entries[0].roundTrip(req)
+		if err == nil && !p.isDirect && entries[0] != p.direct {
+			p.observeResponse(entries[0], resp)
+		}
+		return resp, err
 	}
 
-	// Buffer request body for potential retries
-	var bodyBytes []byte
-	if req.Body != nil && req.Body != http.NoBody {
+	// Buffer request body for potential retries, spilling large ones to
+	// disk. Reading the body of an Expect: 100-continue request would make
+	// the server send 100 Continue before any upstream agreed, gRPC bodies
+	// may be long-lived streams, and bodies past retryMaxBody would fill the
+	// disk, so such bodies stream and are only retried while still unread.
+	var body *replayBody
+	var unread *unreadBody
+	if req.Body != nil && req.Body != http.NoBody && p.streams(req) {
+		var ok bool
+		if unread, ok = req.Body.(*unreadBody); !ok {
+			unread = &unreadBody{ReadCloser: req.Body}
+			req.Body = unread
+		}
+	} else if req.Body != nil && req.Body != http.NoBody {
 		var err error
-		bodyBytes, err = io.ReadAll(req.Body)
-		req.Body.Close()
-		if err != nil {
+		if body, err = p.buffers.readBody(req.Body, p.retryMemory, p.retryMaxBody); err != nil {
 			return nil, fmt.Errorf("read request body: %w", err)
 		}
+		defer body.release()
+		unread = body.rest
 	}
 
 	tried := make(map[int]bool)
 	var lastErr error
 
 	for len(tried) < len(entries) {
-		idx := p.selectProxyIndex(entries, tried)
+		// A client that has gone away needs no further attempts
+		if err := req.Context().Err(); err != nil {
+			if lastErr == nil {
+				lastErr = err
+			}
+			return nil, lastErr
+		}
+		idx := p.selectProxyIndex(entries, tried, req)
 		if idx < 0 {
 			break
 		}
+		if len(tried) > 0 && !p.allowRetry(req) {
+			break
+		}
 		tried[idx] = true
 		entry := entries[idx]
 
 		// Restore body for retry
-		if bodyBytes != nil {
-			req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		if body != nil {
+			req.Body = body.reader()
 		}
 
-		resp, err := entry.transport.RoundTrip(req)
+		resp, err := entry.roundTrip(req)
 		if err == nil {
+			p.observeResponse(entry, resp)
 			return resp, nil
 		}
 
 		lastErr = err
+		if req.Context().Err() != nil {
+			// The client gave up; its cancellation or deadline says
+			// nothing about the proxy
+			return nil, err
+		}
 
 		// Only retry on timeout errors
 		if !isTimeoutError(err) {
@@ -317,52 +1010,274 @@ func (p *ProxyPool) RoundTrip(req *http.Request) (*http.Response, error) {
 				"total", len(entries))
 		}
 		entry.setHealthy(false, err.Error())
+		if unread != nil && unread.started.Load() {
+			return nil, err
+		}
+	}
+
+	if lastErr == nil {
+		return nil, ErrNoProxyAvailable
+	}
+	return nil, fmt.Errorf("all proxies failed: %w", lastErr)
+}
+
+// allowRetry reports whether the retry budget leaves room for another
+// attempt at req.
+func (p *ProxyPool) allowRetry(req *http.Request) bool {
+	if p.retries.allowRetry() {
+		return true
+	}
+	if p.logger != nil {
+		p.logger.Debug("retry budget exhausted, not retrying", "url", req.URL.String())
+	}
+	return false
+}
+
+// RetryBudget reports the retry budget over its window; ok is false when no
+// budget is configured.
+func (p *ProxyPool) RetryBudget() (status RetryBudgetStatus, ok bool) {
+	if p.retries == nil {
+		return RetryBudgetStatus{}, false
+	}
+	return p.retries.status(), true
+}
+
+// DialContext opens a TCP connection to addr through the pool, honouring
+// bypass rules and rotation. The next entry is tried when a dial fails.
+func (p *ProxyPool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if sub := p.routedPool(&url.URL{Host: addr}); sub != nil {
+		return sub.DialContext(ctx, network, addr)
+	}
+	if p.bypass != nil && !p.isDirect && p.bypass.match(&url.URL{Host: addr}) {
+		return p.direct.dial(ctx, network, addr)
+	}
+
+	entries := p.healthyEntries(p.routeGroup(&url.URL{Host: addr}))
+	if len(entries) == 0 {
+		return nil, ErrNoProxyAvailable
 	}
 
+	tried := make(map[int]bool)
+	var lastErr error
+	for len(tried) < len(entries) {
+		idx := p.selectProxyIndex(entries, tried, nil)
+		if idx < 0 {
+			break
+		}
+		tried[idx] = true
+		entry := entries[idx]
+
+		conn, err := entry.dialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil || errors.Is(err, ErrBlockedTarget) {
+			return nil, err
+		}
+		if p.logger != nil && len(entries) > 1 {
+			p.logger.Warn("proxy dial failed, trying next",
+				"proxy", fmt.Sprintf("%s://%s", entry.proxy.Type, entry.proxy.Address),
+				"error", err)
+		}
+	}
+	if lastErr == nil {
+		return nil, ErrNoProxyAvailable
+	}
+	if len(entries) == 1 {
+		return nil, lastErr
+	}
 	return nil, fmt.Errorf("all proxies failed: %w", lastErr)
 }
 
+func expectsContinue(req *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(req.Header.Get("Expect")), "100-continue")
+}
+
+// streamsBody reports whether req's body must be passed through unbuffered.
+func streamsBody(req *http.Request) bool {
+	return expectsContinue(req) || IsGRPC(req.Header)
+}
+
+// streams is streamsBody, plus bodies declared larger than p keeps for
+// retries.
+func (p *ProxyPool) streams(req *http.Request) bool {
+	max := p.retryMaxBody
+	if max <= 0 {
+		max = defaultRetryMaxBody
+	}
+	return streamsBody(req) || req.ContentLength > max
+}
+
+// IsGRPC reports whether h carries a gRPC content type, such as
+// application/grpc or application/grpc+proto.
+func IsGRPC(h http.Header) bool {
+	ct := strings.ToLower(h.Get("Content-Type"))
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") || strings.HasPrefix(ct, "application/grpc;")
+}
+
+// unreadBody passes a request body through without buffering and records
+// whether it was read. Until then Close is a no-op, so a failed attempt does
+// not close the body before the next one; the server closes the original.
+type unreadBody struct {
+	io.ReadCloser
+	started atomic.Bool
+}
+
+func (b *unreadBody) Read(p []byte) (int, error) {
+	b.started.Store(true)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *unreadBody) Close() error {
+	if !b.started.Load() {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// getHealthyEntries returns the entries for hosts that match no route.
 func (p *ProxyPool) getHealthyEntries() []*proxyEntry {
+	return p.healthyEntries("")
+}
+
+// healthyEntries returns the available entries of group, applying
+// onAllUnhealthy when there are none.
+func (p *ProxyPool) healthyEntries(group string) []*proxyEntry {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	var healthyEntries []*proxyEntry
+	now := time.Now()
+	var members, healthyEntries []*proxyEntry
 	for _, e := range p.entries {
-		if e.isHealthy() {
+		if !p.inGroup(e, group) {
+			continue
+		}
+		members = append(members, e)
+		if e.available(now) {
 			healthyEntries = append(healthyEntries, e)
 		}
 	}
 
-	// Fallback to all entries if none healthy
-	if len(healthyEntries) == 0 {
-		if p.logger != nil && len(p.entries) > 0 {
+	if len(healthyEntries) > 0 || len(members) == 0 {
+		return healthyEntries
+	}
+
+	switch p.onAllUnhealthy {
+	case "fail":
+		if p.logger != nil {
+			p.logger.Warn("no healthy proxies, failing request")
+		}
+		return nil
+	case "direct":
+		if p.logger != nil {
+			p.logger.Warn("no healthy proxies, connecting directly")
+		}
+		return []*proxyEntry{p.direct}
+	default:
+		// Fallback to all enabled entries
+		if p.logger != nil {
 			p.logger.Warn("no healthy proxies, using fallback")
 		}
-		return p.entries
+		var enabled []*proxyEntry
+		for _, e := range members {
+			if !e.disabled.Load() {
+				enabled = append(enabled, e)
+			}
+		}
+		return enabled
 	}
-	return healthyEntries
 }
 
-func (p *ProxyPool) selectProxyIndex(entries []*proxyEntry, tried map[int]bool) int {
-	available := make([]int, 0, len(entries))
-	for i := range entries {
+// enabledEntries returns the entries not disabled by an operator.
+// The caller must hold p.mu.
+func (p *ProxyPool) enabledEntries() []*proxyEntry {
+	var enabled []*proxyEntry
+	for _, e := range p.entries {
+		if !e.disabled.Load() {
+			enabled = append(enabled, e)
+		}
+	}
+	return enabled
+}
+
+// selectProxyIndex narrows the untried entries with each ranker in turn,
+// asks the selector for one of those left and returns its index in entries,
+// or -1 when none is left or chosen.
+func (p *ProxyPool) selectProxyIndex(entries []*proxyEntry, tried map[int]bool, req *http.Request) int {
+	candidates := make([]Candidate, 0, len(entries))
+	index := make([]int, 0, len(entries))
+	for i, e := range entries {
 		if !tried[i] {
-			available = append(available, i)
+			candidates = append(candidates, Candidate{Proxy: e.proxy, Position: e.pos, Active: int(e.active.Load())})
+			index = append(index, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return -1
+	}
+	for _, r := range p.rankers {
+		if len(candidates) == 1 {
+			break
+		}
+		best := r.best(candidates)
+		for j, k := range best {
+			candidates[j], index[j] = candidates[k], index[k]
 		}
+		candidates, index = candidates[:len(best)], index[:len(best)]
 	}
-	if len(available) == 0 {
+	i := p.selector.Select(candidates, req)
+	if i < 0 || i >= len(candidates) {
 		return -1
 	}
+	return index[i]
+}
 
-	switch p.rotation {
-	case "random":
-		return available[rand.Intn(len(available))]
-	default: // round-robin
-		idx := int(p.counter.Add(1)-1) % len(available)
-		return available[idx]
+// observeResponse puts the entry into cooldown when the upstream asks to back off
+func (p *ProxyPool) observeResponse(entry *proxyEntry, resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	now := time.Now()
+	until, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		return
+	}
+	entry.coolUntil.Store(until.UnixNano())
+	if p.logger != nil {
+		p.logger.Warn("proxy cooling down after Retry-After",
+			"proxy", fmt.Sprintf("%s://%s", entry.proxy.Type, entry.proxy.Address),
+			"status", resp.StatusCode,
+			"until", until)
 	}
 }
 
+// parseRetryAfter parses delay-seconds or an HTTP-date, capped at maxRetryAfter
+func parseRetryAfter(v string, now time.Time) (time.Time, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, false
+	}
+	var delay time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs <= 0 {
+			return time.Time{}, false
+		}
+		delay = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		delay = t.Sub(now)
+		if delay <= 0 {
+			return time.Time{}, false
+		}
+	} else {
+		return time.Time{}, false
+	}
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return now.Add(delay), true
+}
+
 // isTimeoutError checks if the error is a timeout
 func isTimeoutError(err error) bool {
 	if err == nil {
@@ -399,20 +1314,20 @@ func (p *ProxyPool) nextTransport() (http.RoundTripper, error) {
 	defer p.mu.RUnlock()
 
 	// Get healthy entries
+	now := time.Now()
 	var healthyEntries []*proxyEntry
 	for _, e := range p.entries {
-		if e.isHealthy() {
+		if e.available(now) {
 			healthyEntries = append(healthyEntries, e)
 		}
 	}
 
-	// If no healthy proxies, try all (fallback)
+	// If no healthy proxies, try all enabled ones (fallback)
 	if len(healthyEntries) == 0 {
-		if len(p.entries) == 0 {
+		healthyEntries = p.enabledEntries()
+		if len(healthyEntries) == 0 {
 			return nil, fmt.Errorf("no proxies available")
 		}
-		// Use any proxy as fallback
-		healthyEntries = p.entries
 		if p.logger != nil {
 			p.logger.Warn("no healthy proxies, using fallback")
 		}
@@ -422,14 +1337,10 @@ func (p *ProxyPool) nextTransport() (http.RoundTripper, error) {
 		return healthyEntries[0].transport, nil
 	}
 
-	var idx int
-	switch p.rotation {
-	case "random":
-		idx = rand.Intn(len(healthyEntries))
-	default: // round-robin
-		idx = int(p.counter.Add(1)-1) % len(healthyEntries)
+	idx := p.selectProxyIndex(healthyEntries, nil, nil)
+	if idx < 0 {
+		return nil, ErrNoProxyAvailable
 	}
-
 	return healthyEntries[idx].transport, nil
 }
 
@@ -454,6 +1365,27 @@ func (p *ProxyPool) HealthyCount() int {
 	return count
 }
 
+// Degraded reports whether the share of unhealthy proxies has reached the configured threshold
+func (p *ProxyPool) Degraded() bool {
+	if p.degradedPercent <= 0 || p.isDirect {
+		return false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.entries) == 0 {
+		return false
+	}
+	unhealthy := 0
+	for _, e := range p.entries {
+		if !e.isHealthy() {
+			unhealthy++
+		}
+	}
+	return unhealthy*100 >= p.degradedPercent*len(p.entries)
+}
+
 // GetStatus returns status of all proxies
 func (p *ProxyPool) GetStatus() []ProxyStatus {
 	p.mu.RLock()
@@ -461,12 +1393,25 @@ func (p *ProxyPool) GetStatus() []ProxyStatus {
 
 	var statuses []ProxyStatus
 	for _, e := range p.entries {
+		var latency *LatencyStats
+		if stats, ok := e.latency.stats(); ok {
+			latency = &stats
+		}
 		e.mu.RLock()
 		statuses = append(statuses, ProxyStatus{
 			Address:   fmt.Sprintf("%s://%s", e.proxy.Type, e.proxy.Address),
 			Healthy:   e.isHealthy(),
 			LastCheck: e.lastCheck,
 			LastError: e.lastError,
+			DownSince: e.downSince,
+			CoolUntil: coolUntil(e),
+			Disabled:  e.disabled.Load(),
+			ExitIP:    e.exitIP,
+			Latency:   latency,
+			Group:     e.group,
+
+			BytesSent:     e.sent.Load(),
+			BytesReceived: e.received.Load(),
 		})
 		e.mu.RUnlock()
 	}
@@ -475,10 +1420,76 @@ func (p *ProxyPool) GetStatus() []ProxyStatus {
 
 // ProxyStatus represents the status of a single proxy
 type ProxyStatus struct {
-	Address   string
-	Healthy   bool
-	LastCheck time.Time
-	LastError string
+	Address   string    `json:"address"`
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+	DownSince time.Time `json:"down_since,omitzero"`
+	CoolUntil time.Time `json:"cool_until,omitzero"`
+	Disabled  bool      `json:"disabled"`
+	// ExitIP is the address last reported by health_check.exit_ip_url
+	ExitIP string `json:"exit_ip,omitempty"`
+	// Group is the proxy.groups entry the proxy belongs to
+	Group string `json:"group,omitempty"`
+	// Latency covers recent successful requests; nil until one completes
+	Latency *LatencyStats `json:"latency,omitempty"`
+	// BytesSent and BytesReceived count request and response body bytes
+	// proxied through the entry
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+}
+
+// ErrNoProxyAvailable is returned by RoundTrip when no proxy may be used for the request
+var ErrNoProxyAvailable = errors.New("no proxies available")
+
+// ErrUnknownProxy is returned when an address does not match any proxy in the pool
+var ErrUnknownProxy = errors.New("unknown proxy")
+
+// ErrProxyUnavailable is returned when the proxy selected by header is
+// unhealthy, cooling down or disabled
+var ErrProxyUnavailable = errors.New("selected proxy unavailable")
+
+// SetDisabled takes the proxy matching addr out of rotation, or puts it back.
+// addr may be given as host:port or with its scheme, as shown by GetStatus.
+func (p *ProxyPool) SetDisabled(addr string, disabled bool) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	e := p.findEntry(addr)
+	if e == nil {
+		// Named pools are searched in name order
+		for _, name := range slices.Sorted(maps.Keys(p.pools)) {
+			if err := p.pools[name].SetDisabled(addr, disabled); !errors.Is(err, ErrUnknownProxy) {
+				return err
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrUnknownProxy, addr)
+	}
+	if e.disabled.Swap(disabled) != disabled && p.logger != nil {
+		p.logger.Info("proxy rotation changed",
+			"proxy", fmt.Sprintf("%s://%s", e.proxy.Type, e.proxy.Address),
+			"disabled", disabled)
+	}
+	return nil
+}
+
+// findEntry returns the entry whose address is addr, given as host:port or
+// scheme://host:port. The caller must hold p.mu.
+func (p *ProxyPool) findEntry(addr string) *proxyEntry {
+	for _, e := range p.entries {
+		if e.proxy.Address == addr || fmt.Sprintf("%s://%s", e.proxy.Type, e.proxy.Address) == addr {
+			return e
+		}
+	}
+	return nil
+}
+
+func coolUntil(e *proxyEntry) time.Time {
+	until := e.coolUntil.Load()
+	if until <= time.Now().UnixNano() {
+		return time.Time{}
+	}
+	return time.Unix(0, until)
 }
 
 // NewTransport builds an HTTP transport configured with optional upstream proxy.
@@ -487,57 +1498,289 @@ func NewTransport(cfg config.ProxyConfig) (http.RoundTripper, error) {
 	return NewProxyPool(cfg)
 }
 
-func newDirectTransport(timeouts config.TimeoutConfig) (*http.Transport, error) {
-	dialer := &net.Dialer{
-		Timeout:   durationFromSeconds(timeouts.ConnectSeconds, 10*time.Second),
-		KeepAlive: 30 * time.Second,
+// transportOptions carries settings shared by every transport in the pool
+type transportOptions struct {
+	timeouts  config.TimeoutConfig
+	dial      config.DialConfig
+	transport config.TransportConfig
+	chain     []config.ParsedProxy
+	// connectHeaders are sent to HTTP(S) proxies on every CONNECT request
+	connectHeaders http.Header
+	sessionTTL     time.Duration
+	// guard, when set, refuses non-public target addresses
+	guard *targetGuard
+}
+
+func newTransportOptions(cfg config.ProxyConfig) (transportOptions, error) {
+	opts := transportOptions{
+		timeouts:   cfg.Timeouts,
+		dial:       cfg.Dial,
+		transport:  cfg.Transport,
+		sessionTTL: time.Duration(cfg.SessionTTLSeconds) * time.Second,
+	}
+	guard, err := newTargetGuard(cfg.Security)
+	if err != nil {
+		return opts, err
+	}
+	opts.guard = guard
+	if fp := cfg.Transport.TLSFingerprint; fp != "" {
+		if _, ok := tlsFingerprints[strings.ToLower(fp)]; !ok {
+			return opts, fmt.Errorf("unknown tls fingerprint %q", fp)
+		}
+	}
+	if len(cfg.ConnectHeaders) > 0 {
+		opts.connectHeaders = make(http.Header, len(cfg.ConnectHeaders))
+		for k, v := range cfg.ConnectHeaders {
+			opts.connectHeaders.Set(k, v)
+		}
+	}
+	for _, raw := range cfg.Chain {
+		hop, err := config.ParseProxyURL(raw)
+		if err != nil {
+			return opts, fmt.Errorf("proxy chain: %w", err)
+		}
+		opts.chain = append(opts.chain, hop)
+	}
+	return opts, nil
+}
+
+func (o transportOptions) newDialer() contextDialer {
+	return o.dialer(nil)
+}
+
+// newTargetDialer returns a dialer for direct connections to targets, which
+// the guard checks after DNS resolution.
+func (o transportOptions) newTargetDialer() contextDialer {
+	if o.guard == nil {
+		return o.newDialer()
+	}
+	return o.dialer(o.guard.control)
+}
+
+func (o transportOptions) dialer(control func(network, address string, c syscall.RawConn) error) contextDialer {
+	d := &net.Dialer{
+		Control: control,
+		Timeout: durationFromSeconds(o.timeouts.ConnectSeconds, 10*time.Second),
+		// A negative value disables keep-alive; zero would mean Go's default
+		KeepAlive: -1,
+	}
+	if o.dial.KeepAliveSeconds > 0 {
+		d.KeepAlive = time.Duration(o.dial.KeepAliveSeconds) * time.Second
+	}
+	if o.dial.DisableNoDelay {
+		return nagleDialer{d}
+	}
+	return d
+}
+
+// nagleDialer turns TCP_NODELAY off on the connections it opens; Go turns it
+// on by default.
+type nagleDialer struct {
+	*net.Dialer
+}
+
+func (d nagleDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d nagleDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if err := tc.SetNoDelay(false); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
+	return conn, nil
+}
+
+// setProtocols restricts tr to HTTP/2 when HTTP2Only is set: h2 over TLS and
+// h2c with prior knowledge for http:// URLs.
+func (o transportOptions) setProtocols(tr *http.Transport) {
+	if !o.transport.HTTP2Only {
+		return
+	}
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	tr.Protocols = &protocols
+}
 
-	return &http.Transport{
+// targetConns reports whether the transports must hold the connection to the
+// target itself, rather than sending requests to HTTP proxies or using Go's
+// TLS: to speak h2c, reorder headers or present a TLS fingerprint.
+func (o transportOptions) targetConns() bool {
+	return o.transport.HTTP2Only || len(o.transport.HeaderOrder) > 0 || o.transport.TLSFingerprint != ""
+}
+
+// customConns applies HeaderOrder and TLSFingerprint to tr, dialing the
+// target through its DialContext and doing TLS itself. Upstream connections
+// are HTTP/1.1 only then, and environment proxies are not used.
+func (o transportOptions) customConns(tr *http.Transport) *http.Transport {
+	order, fingerprint := o.transport.HeaderOrder, o.transport.TLSFingerprint
+	if len(order) == 0 && fingerprint == "" {
+		return tr
+	}
+	wrap := func(conn net.Conn) net.Conn {
+		if len(order) > 0 {
+			return newOrderedConn(conn, order)
+		}
+		return conn
+	}
+	dial := tr.DialContext
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	tr.Protocols = &protocols
+	tr.Proxy = nil
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return wrap(conn), nil
+	}
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// Read at dial time so SetTargetServerName applies
+		cfg := tr.TLSClientConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				cfg.ServerName = host
+			}
+		}
+		if tr.TLSHandshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tr.TLSHandshakeTimeout)
+			defer cancel()
+		}
+		tc, err := handshakeTLS(ctx, conn, cfg, fingerprint)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return wrap(tc), nil
+	}
+	return tr
+}
+
+func newDirectTransport(opts transportOptions) (*http.Transport, error) {
+	dialer := opts.newTargetDialer()
+
+	tr := &http.Transport{
 		DialContext:           dialer.DialContext,
 		ForceAttemptHTTP2:     true,
 		MaxIdleConns:          100,
-		IdleConnTimeout:       durationFromSeconds(timeouts.IdleSeconds, 30*time.Second),
+		IdleConnTimeout:       durationFromSeconds(opts.timeouts.IdleSeconds, 30*time.Second),
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     opts.transport.DisableKeepAlives,
+		DisableCompression:    opts.transport.DisableCompression,
 		Proxy:                 http.ProxyFromEnvironment,
-	}, nil
+	}
+	if opts.guard != nil && opts.guard.private {
+		// An environment proxy would resolve targets out of the guard's sight
+		tr.Proxy = nil
+	}
+	opts.setProtocols(tr)
+	return opts.customConns(tr), nil
 }
 
-func newProxyTransport(p config.ParsedProxy, timeouts config.TimeoutConfig) (*http.Transport, error) {
-	dialer := &net.Dialer{
-		Timeout:   durationFromSeconds(timeouts.ConnectSeconds, 10*time.Second),
-		KeepAlive: 30 * time.Second,
+// newDirectEntry builds an entry that connects without a proxy.
+func newDirectEntry(opts transportOptions) (*proxyEntry, error) {
+	tr, err := newDirectTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+	entry := &proxyEntry{
+		transport: tr,
+		proxy:     config.ParsedProxy{Type: "direct", Address: "direct"},
+		dial:      opts.newTargetDialer().DialContext,
+	}
+	entry.healthy.Store(true)
+	return entry, nil
+}
+
+func newProxyTransport(p config.ParsedProxy, opts transportOptions) (*http.Transport, error) {
+	// Reach the proxy itself through any configured jump proxies
+	dialer, err := newChainDialer(opts.newDialer(), opts.chain)
+	if err != nil {
+		return nil, err
 	}
 
 	tr := &http.Transport{
 		DialContext:           dialer.DialContext,
 		ForceAttemptHTTP2:     true,
 		MaxIdleConns:          100,
-		IdleConnTimeout:       durationFromSeconds(timeouts.IdleSeconds, 30*time.Second),
+		IdleConnTimeout:       durationFromSeconds(opts.timeouts.IdleSeconds, 30*time.Second),
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     opts.transport.DisableKeepAlives,
+		DisableCompression:    opts.transport.DisableCompression,
 	}
+	opts.setProtocols(tr)
 
 	switch p.Type {
 	case "http", "https":
 		if p.Address == "" {
 			return nil, fmt.Errorf("proxy address required for http/https proxy")
 		}
+		if opts.targetConns() || p.AuthScheme == "ntlm" {
+			// h2c cannot be sent to a proxy as absolute-form requests,
+			// reordered headers and fingerprinted TLS need the connection
+			// to the target, and NTLM authenticates a connection rather
+			// than a request, so every connection is tunnelled with CONNECT
+			d, err := newEntryDialer(p, opts)
+			if err != nil {
+				return nil, err
+			}
+			tr.DialContext = d.DialContext
+			return opts.customConns(tr), nil
+		}
 		u, err := url.Parse(fmt.Sprintf("%s://%s", p.Type, p.Address))
 		if err != nil {
 			return nil, fmt.Errorf("parse proxy url: %w", err)
 		}
+		tr.ProxyConnectHeader = opts.connectHeaders
+		if creds := newSessionCredentials(p, opts.sessionTTL); creds != nil {
+			// Connections are pooled per proxy URL, so each session gets its own
+			tr.Proxy = func(*http.Request) (*url.URL, error) {
+				pu := *u
+				pu.User = url.UserPassword(creds.next())
+				return &pu, nil
+			}
+			return opts.customConns(tr), nil
+		}
 		if p.Username != "" {
 			u.User = url.UserPassword(p.Username, p.Password)
 		}
 		tr.Proxy = http.ProxyURL(u)
-		return tr, nil
+		return opts.customConns(tr), nil
 
 	case "socks5":
 		if p.Address == "" {
 			return nil, fmt.Errorf("proxy address required for socks5")
 		}
+		if creds := newSessionCredentials(p, opts.sessionTTL); creds != nil {
+			tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				user, pass := creds.next()
+				socksDialer, err := proxy.SOCKS5("tcp", p.Address, &proxy.Auth{User: user, Password: pass}, dialer)
+				if err != nil {
+					return nil, fmt.Errorf("create socks5 dialer: %w", err)
+				}
+				return dialContextFromDialer(socksDialer)(ctx, network, addr)
+			}
+			tr.Proxy = nil
+			return opts.customConns(tr), nil
+		}
 		var auth *proxy.Auth
 		if p.Username != "" {
 			auth = &proxy.Auth{
@@ -551,7 +1794,7 @@ func newProxyTransport(p config.ParsedProxy, timeouts config.TimeoutConfig) (*ht
 		}
 		tr.DialContext = dialContextFromDialer(socksDialer)
 		tr.Proxy = nil
-		return tr, nil
+		return opts.customConns(tr), nil
 
 	default:
 		return nil, fmt.Errorf("unknown proxy type: %s", p.Type)
@@ -2,13 +2,24 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"sockstream/internal/config"
+	"github.com/foxzi/SockStream/internal/config"
 )
 
 func TestNewTransport(t *testing.T) {
@@ -153,6 +164,71 @@ func TestDurationFromSeconds(t *testing.T) {
 	}
 }
 
+func TestTransportOptions_NewDialer(t *testing.T) {
+	tests := []struct {
+		name          string
+		dial          config.DialConfig
+		wantKeepAlive time.Duration
+		wantNagle     bool
+	}{
+		{
+			name:          "keep-alive interval",
+			dial:          config.DialConfig{KeepAliveSeconds: 15},
+			wantKeepAlive: 15 * time.Second,
+		},
+		{
+			name:          "zero disables keep-alive",
+			dial:          config.DialConfig{},
+			wantKeepAlive: -1,
+		},
+		{
+			name:          "disable no delay",
+			dial:          config.DialConfig{KeepAliveSeconds: 30, DisableNoDelay: true},
+			wantKeepAlive: 30 * time.Second,
+			wantNagle:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d *net.Dialer
+			nagle := false
+			switch got := (transportOptions{dial: tt.dial}).newDialer().(type) {
+			case *net.Dialer:
+				d = got
+			case nagleDialer:
+				d, nagle = got.Dialer, true
+			default:
+				t.Fatalf("newDialer() returned %T", got)
+			}
+			if nagle != tt.wantNagle {
+				t.Errorf("nagle = %v, want %v", nagle, tt.wantNagle)
+			}
+			if d.KeepAlive != tt.wantKeepAlive {
+				t.Errorf("KeepAlive = %v, want %v", d.KeepAlive, tt.wantKeepAlive)
+			}
+		})
+	}
+}
+
+func TestNewProxyPool_TransportConfig(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:                []string{"http://proxy1:8080", "socks5://proxy2:1080"},
+		AllowDirectFallback: true,
+		Transport:           config.TransportConfig{DisableKeepAlives: true, DisableCompression: true},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	for _, e := range append(pool.entries, pool.direct) {
+		tr := e.transport.(*http.Transport)
+		if !tr.DisableKeepAlives || !tr.DisableCompression {
+			t.Errorf("%s transport: DisableKeepAlives = %v, DisableCompression = %v, want both true",
+				e.proxy.Type, tr.DisableKeepAlives, tr.DisableCompression)
+		}
+	}
+}
+
 func TestNewProxyPool(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -506,7 +582,7 @@ func TestProxyPool_SelectProxyIndex(t *testing.T) {
 
 	// Test with empty tried map
 	tried := make(map[int]bool)
-	idx := pool.selectProxyIndex(entries, tried)
+	idx := pool.selectProxyIndex(entries, tried, nil)
 	if idx < 0 || idx >= len(entries) {
 		t.Errorf("selectProxyIndex() returned invalid index: %d", idx)
 	}
@@ -514,14 +590,14 @@ func TestProxyPool_SelectProxyIndex(t *testing.T) {
 	// Test with some tried
 	tried[0] = true
 	tried[1] = true
-	idx = pool.selectProxyIndex(entries, tried)
+	idx = pool.selectProxyIndex(entries, tried, nil)
 	if idx != 2 {
 		t.Errorf("selectProxyIndex() = %d, want 2 (only untried)", idx)
 	}
 
 	// Test with all tried
 	tried[2] = true
-	idx = pool.selectProxyIndex(entries, tried)
+	idx = pool.selectProxyIndex(entries, tried, nil)
 	if idx != -1 {
 		t.Errorf("selectProxyIndex() = %d, want -1 (all tried)", idx)
 	}
@@ -562,3 +638,1058 @@ func TestProxyPool_GetHealthyEntries(t *testing.T) {
 		t.Errorf("getHealthyEntries() fallback returned %d, want 3", len(entries))
 	}
 }
+
+func TestProxyPool_Degraded(t *testing.T) {
+	cfg := config.ProxyConfig{
+		URLs: []string{
+			"http://proxy1:8080",
+			"http://proxy2:8080",
+			"http://proxy3:8080",
+			"http://proxy4:8080",
+		},
+		DegradedPercent: 50,
+	}
+
+	pool, err := NewProxyPool(cfg)
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+
+	if pool.Degraded() {
+		t.Error("Degraded() = true with all proxies healthy")
+	}
+
+	pool.entries[0].setHealthy(false, "test error")
+	if pool.Degraded() {
+		t.Error("Degraded() = true with 25% unhealthy, threshold 50%")
+	}
+
+	pool.entries[1].setHealthy(false, "test error")
+	if !pool.Degraded() {
+		t.Error("Degraded() = false with 50% unhealthy, threshold 50%")
+	}
+
+	pool.entries[0].setHealthy(true, "")
+	if pool.Degraded() {
+		t.Error("Degraded() = true after proxy recovered below threshold")
+	}
+}
+
+func TestProxyPool_DegradedDisabled(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs: []string{"http://proxy1:8080", "http://proxy2:8080"},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+
+	for _, e := range pool.entries {
+		e.setHealthy(false, "test error")
+	}
+	if pool.Degraded() {
+		t.Error("Degraded() = true with threshold disabled")
+	}
+}
+
+func TestProxyPool_HealthCheckWorkers(t *testing.T) {
+	const total = 200
+	const workers = 8
+
+	urls := make([]string, total)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://proxy%d:8080", i)
+	}
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:        urls,
+		HealthCheck: config.HealthCheckConfig{Workers: workers},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+
+	var inFlight, maxInFlight, probed atomic.Int32
+	pool.probe = func(_ context.Context, e *proxyEntry) {
+		n := inFlight.Add(1)
+		for {
+			cur := maxInFlight.Load()
+			if n <= cur || maxInFlight.CompareAndSwap(cur, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		inFlight.Add(-1)
+		probed.Add(1)
+	}
+
+	pool.checkAllProxies(context.Background())
+
+	if got := probed.Load(); got != total {
+		t.Errorf("probed %d proxies, want %d", got, total)
+	}
+	if got := maxInFlight.Load(); got > workers {
+		t.Errorf("max concurrent probes = %d, want <= %d", got, workers)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func stubResponse(status int, header http.Header) roundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		if header == nil {
+			header = make(http.Header)
+		}
+		return &http.Response{StatusCode: status, Header: header, Body: http.NoBody, Request: r}, nil
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"seconds", "30", 30 * time.Second, true},
+		{"http date", now.Add(2 * time.Minute).Format(http.TimeFormat), 2 * time.Minute, true},
+		{"capped", "86400", maxRetryAfter, true},
+		{"empty", "", 0, false},
+		{"zero", "0", 0, false},
+		{"past date", now.Add(-time.Minute).Format(http.TimeFormat), 0, false},
+		{"garbage", "soon", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value, now)
+			if ok != tt.wantOK {
+				t.Fatalf("parseRetryAfter(%q) ok = %v, want %v", tt.value, ok, tt.wantOK)
+			}
+			if ok && got.Sub(now) != tt.want {
+				t.Errorf("parseRetryAfter(%q) delay = %v, want %v", tt.value, got.Sub(now), tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyPool_RetryAfterCooldown(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs: []string{"http://proxy1:8080", "http://proxy2:8080"},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+
+	limited := make(http.Header)
+	limited.Set("Retry-After", "60")
+	var hits [2]int
+	pool.entries[0].transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		hits[0]++
+		return stubResponse(http.StatusTooManyRequests, limited)(r)
+	})
+	pool.entries[1].transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		hits[1]++
+		return stubResponse(http.StatusOK, nil)(r)
+	})
+
+	for i := 0; i < 6; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://target.example.com/", nil)
+		resp, err := pool.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip() error = %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if hits[0] != 1 {
+		t.Errorf("rate-limited proxy hit %d times, want 1", hits[0])
+	}
+	if !pool.entries[0].coolingDown(time.Now()) {
+		t.Error("rate-limited proxy should be cooling down")
+	}
+	if status := pool.GetStatus(); status[0].CoolUntil.IsZero() {
+		t.Error("GetStatus() should report cooldown deadline")
+	}
+}
+
+func TestProxyPool_SetTargetServerName(t *testing.T) {
+	sni := make(chan string, 1)
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			select {
+			case sni <- hello.ServerName:
+			default:
+			}
+			return nil, nil
+		},
+	}
+	target.StartTLS()
+	defer target.Close()
+
+	pool, err := NewProxyPool(config.ProxyConfig{})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	pool.SetTargetServerName("internal.example.com")
+
+	req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+	if resp, err := pool.RoundTrip(req); err == nil {
+		resp.Body.Close()
+	}
+
+	select {
+	case got := <-sni:
+		if got != "internal.example.com" {
+			t.Errorf("SNI = %q, want %q", got, "internal.example.com")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target did not receive a ClientHello")
+	}
+
+	check, ok := pool.entries[0].healthTransport().(*http.Transport)
+	if !ok {
+		t.Fatal("health transport should be *http.Transport")
+	}
+	if check.TLSClientConfig != nil && check.TLSClientConfig.ServerName != "" {
+		t.Errorf("health check transport SNI = %q, want default", check.TLSClientConfig.ServerName)
+	}
+}
+
+func TestProxyPool_SetTargetServerNameHTTPSProxy(t *testing.T) {
+	proxySNI := make(chan string, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			select {
+			case proxySNI <- hello.ServerName:
+			default:
+			}
+			return nil, nil
+		},
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	targetSNI := make(chan string, 1)
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			select {
+			case targetSNI <- hello.ServerName:
+			default:
+			}
+			return nil, nil
+		},
+	}
+	target.StartTLS()
+	defer target.Close()
+
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:   []string{"https://" + upstream.Listener.Addr().String()},
+		Bypass: []string{"bypassed.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	pool.SetTargetServerName("internal.example.com")
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	if resp, err := pool.RoundTrip(req); err == nil {
+		resp.Body.Close()
+	}
+	select {
+	case got := <-proxySNI:
+		if got == "internal.example.com" {
+			t.Errorf("proxy handshake used the target server name")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy did not receive a ClientHello")
+	}
+
+	// Bypassed hosts go through the direct entry, which gets the name too
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	pool.direct.transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+	}
+	req, _ = http.NewRequest(http.MethodGet, "https://bypassed.example.com/", nil)
+	if resp, err := pool.RoundTrip(req); err == nil {
+		resp.Body.Close()
+	}
+	select {
+	case got := <-targetSNI:
+		if got != "internal.example.com" {
+			t.Errorf("direct SNI = %q, want %q", got, "internal.example.com")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target did not receive a ClientHello")
+	}
+}
+
+func TestProxyPool_SetDisabled(t *testing.T) {
+	cfg := config.ProxyConfig{
+		URLs: []string{
+			"http://proxy1:8080",
+			"http://proxy2:8080",
+		},
+	}
+
+	pool, err := NewProxyPool(cfg)
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+
+	if err := pool.SetDisabled("proxy1:8080", true); err != nil {
+		t.Fatalf("SetDisabled() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if entries := pool.getHealthyEntries(); len(entries) != 1 || entries[0] != pool.entries[1] {
+			t.Fatalf("getHealthyEntries() should skip the disabled proxy")
+		}
+	}
+
+	// Disabled entries stay out of the unhealthy fallback
+	pool.entries[1].setHealthy(false, "test error")
+	if entries := pool.getHealthyEntries(); len(entries) != 1 || entries[0] != pool.entries[1] {
+		t.Errorf("fallback should only use enabled proxies, got %d entries", len(entries))
+	}
+	if tr, err := pool.nextTransport(); err != nil || tr != pool.entries[1].transport {
+		t.Errorf("nextTransport() = %v, %v, want enabled proxy", tr, err)
+	}
+
+	statuses := pool.GetStatus()
+	if !statuses[0].Disabled || statuses[1].Disabled {
+		t.Errorf("GetStatus() disabled = %v/%v, want true/false", statuses[0].Disabled, statuses[1].Disabled)
+	}
+	if !statuses[0].Healthy {
+		t.Error("disabling should not change health status")
+	}
+
+	if err := pool.SetDisabled("http://proxy1:8080", false); err != nil {
+		t.Fatalf("SetDisabled() with scheme error = %v", err)
+	}
+	if pool.GetStatus()[0].Disabled {
+		t.Error("proxy should be enabled again")
+	}
+
+	if err := pool.SetDisabled("proxy9:8080", true); !errors.Is(err, ErrUnknownProxy) {
+		t.Errorf("SetDisabled() unknown error = %v, want ErrUnknownProxy", err)
+	}
+}
+
+func TestProxyPool_OnAllUnhealthy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		policy      string
+		wantEntries int
+		wantErr     error
+		wantStatus  int
+	}{
+		{policy: "", wantEntries: 2},
+		{policy: "fallback", wantEntries: 2},
+		{policy: "fail", wantEntries: 0, wantErr: ErrNoProxyAvailable},
+		{policy: "direct", wantEntries: 1, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs:           []string{"http://127.0.0.1:1", "http://127.0.0.1:2"},
+				OnAllUnhealthy: tt.policy,
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			for _, e := range pool.entries {
+				e.setHealthy(false, "test error")
+			}
+
+			if got := len(pool.getHealthyEntries()); got != tt.wantEntries {
+				t.Errorf("getHealthyEntries() = %d entries, want %d", got, tt.wantEntries)
+			}
+			if tt.wantErr == nil && tt.wantStatus == 0 {
+				return
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+			resp, err := pool.RoundTrip(req)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("RoundTrip() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestProxyPool_DirectFallback(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		wantErr  bool
+		wantBody string
+	}{
+		{name: "disabled", enabled: false, wantErr: true},
+		{name: "enabled", enabled: true, wantBody: "payload"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs:                []string{"http://127.0.0.1:1", "http://127.0.0.1:2"},
+				AllowDirectFallback: tt.enabled,
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			var logs syncBuffer
+			pool.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+
+			req, _ := http.NewRequest(http.MethodPost, backend.URL, strings.NewReader("payload"))
+			resp, err := pool.RoundTrip(req)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("RoundTrip() should fail without direct fallback")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+			if !strings.Contains(logs.String(), "falling back to direct connection") {
+				t.Errorf("direct fallback should be logged, got %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestProxyPool_EjectAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		ejectAfter int
+		allDown    bool
+		wantSize   int
+	}{
+		{name: "disabled keeps retrying", ejectAfter: 0, wantSize: 2},
+		{name: "ejects long-dead proxy", ejectAfter: 60, wantSize: 1},
+		{name: "keeps recently failed proxy", ejectAfter: 7200, wantSize: 2},
+		{name: "keeps every proxy while none is healthy", ejectAfter: 60, allDown: true, wantSize: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs:              []string{"http://proxy1:8080", "http://proxy2:8080"},
+				EjectAfterSeconds: tt.ejectAfter,
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			dead := pool.entries[0]
+			pool.probe = func(_ context.Context, e *proxyEntry) {
+				if e == dead || tt.allDown {
+					e.setHealthy(false, "connection refused")
+					return
+				}
+				e.setHealthy(true, "")
+			}
+			dead.setHealthy(false, "connection refused")
+			dead.mu.Lock()
+			dead.downSince = time.Now().Add(-time.Hour)
+			dead.mu.Unlock()
+
+			pool.checkAllProxies(context.Background())
+
+			if got := pool.Size(); got != tt.wantSize {
+				t.Errorf("Size() = %d, want %d", got, tt.wantSize)
+			}
+			if tt.wantSize == 1 {
+				if got := pool.GetStatus()[0].Address; got != "http://proxy2:8080" {
+					t.Errorf("remaining proxy = %s, want http://proxy2:8080", got)
+				}
+				if pool.HealthyCount() != 1 {
+					t.Errorf("HealthyCount() = %d, want 1", pool.HealthyCount())
+				}
+			}
+		})
+	}
+}
+
+// earlyReadBody flags reads that happen before the backend handler started,
+// i.e. before any upstream could have answered 100 Continue.
+type earlyReadBody struct {
+	r       io.Reader
+	started *atomic.Bool
+	early   atomic.Bool
+}
+
+func (b *earlyReadBody) Read(p []byte) (int, error) {
+	if !b.started.Load() {
+		b.early.Store(true)
+	}
+	return b.r.Read(p)
+}
+
+func TestProxyPool_ExpectContinue(t *testing.T) {
+	payload := strings.Repeat("x", 1<<20)
+	var handlerStarted atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerStarted.Store(true)
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprintf(w, "%d", n)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name     string
+		urls     func(t *testing.T) []string
+		fallback bool
+	}{
+		{
+			name: "multiple proxies",
+			urls: func(t *testing.T) []string {
+				return []string{"http://" + newTestProxy(t).addr(), "http://" + newTestProxy(t).addr()}
+			},
+		},
+		{
+			name: "direct fallback after dial failure",
+			urls: func(t *testing.T) []string {
+				return []string{"http://127.0.0.1:1", "http://127.0.0.1:2"}
+			},
+			fallback: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlerStarted.Store(false)
+			pool, err := NewProxyPool(config.ProxyConfig{URLs: tt.urls(t), AllowDirectFallback: tt.fallback})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+
+			body := &earlyReadBody{r: strings.NewReader(payload), started: &handlerStarted}
+			req, _ := http.NewRequest(http.MethodPut, backend.URL, io.NopCloser(body))
+			req.ContentLength = int64(len(payload))
+			req.Header.Set("Expect", "100-continue")
+
+			resp, err := pool.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			defer resp.Body.Close()
+			got, _ := io.ReadAll(resp.Body)
+			if want := fmt.Sprint(len(payload)); string(got) != want {
+				t.Errorf("backend received %s bytes, want %s", got, want)
+			}
+			if body.early.Load() {
+				t.Error("body was read before the upstream asked for it")
+			}
+		})
+	}
+}
+
+func TestProxyPool_HealthCheckExpectations(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         config.HealthCheckConfig
+		status      int
+		body        string
+		wantHealthy bool
+	}{
+		{name: "default accepts any 2xx", status: http.StatusOK, body: "<html>login</html>", wantHealthy: true},
+		{name: "default rejects 5xx", status: http.StatusBadGateway, wantHealthy: false},
+		{name: "exact status", cfg: config.HealthCheckConfig{ExpectStatus: 204}, status: http.StatusNoContent, wantHealthy: true},
+		{name: "captive portal status", cfg: config.HealthCheckConfig{ExpectStatus: 204}, status: http.StatusOK, body: "<html>login</html>", wantHealthy: false},
+		{name: "body matches", cfg: config.HealthCheckConfig{ExpectBody: "pong"}, status: http.StatusOK, body: "pong\n", wantHealthy: true},
+		{name: "captive portal body", cfg: config.HealthCheckConfig{ExpectBody: "pong"}, status: http.StatusOK, body: "<html>login</html>", wantHealthy: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.URL = "http://check.example/ping"
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs:        []string{"http://proxy1:8080"},
+				HealthCheck: tt.cfg,
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			var gotURL string
+			pool.entries[0].checkTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				gotURL = r.URL.String()
+				return textResponse(tt.status, tt.body)(r)
+			})
+
+			pool.checkProxy(context.Background(), pool.entries[0])
+
+			if gotURL != tt.cfg.URL {
+				t.Errorf("checked %q, want %q", gotURL, tt.cfg.URL)
+			}
+			if got := pool.entries[0].isHealthy(); got != tt.wantHealthy {
+				t.Errorf("healthy = %v, want %v (last error %q)", got, tt.wantHealthy, pool.entries[0].getLastError())
+			}
+		})
+	}
+}
+
+func TestProxyPool_WarmUp(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs: []string{"http://proxy1:8080"},
+		HealthCheck: config.HealthCheckConfig{
+			URL:       "http://check.example/ping",
+			WarmUp:    true,
+			WarmUpURL: "http://target.example/",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	entry := pool.entries[0]
+	checkStatus := http.StatusNoContent
+	entry.checkTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return textResponse(checkStatus, "")(r)
+	})
+	var warmUps []string
+	entry.transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		warmUps = append(warmUps, r.Method+" "+r.URL.String())
+		return textResponse(http.StatusOK, "")(r)
+	})
+
+	pool.checkProxy(context.Background(), entry)
+	pool.checkProxy(context.Background(), entry)
+	if want := []string{"HEAD http://target.example/"}; !slices.Equal(warmUps, want) {
+		t.Fatalf("warm-ups after passing checks = %v, want %v", warmUps, want)
+	}
+
+	checkStatus = http.StatusBadGateway
+	pool.checkProxy(context.Background(), entry)
+	checkStatus = http.StatusNoContent
+	pool.checkProxy(context.Background(), entry)
+	if len(warmUps) != 2 {
+		t.Errorf("warm-ups after recovery = %d, want 2", len(warmUps))
+	}
+}
+
+func TestProxyPool_DirectEntryInRotation(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "direct")
+	}))
+	defer backend.Close()
+
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs: []string{"http://127.0.0.1:1", "direct"},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	if pool.isDirect || pool.Size() != 2 {
+		t.Fatalf("isDirect = %v, size = %d; want a rotated pool of 2", pool.isDirect, pool.Size())
+	}
+	if got := pool.GetStatus()[1].Address; got != "direct://direct" {
+		t.Errorf("direct entry address = %q", got)
+	}
+
+	// With the proxy down, rotation only has the direct entry left
+	pool.entries[0].setHealthy(false, "down")
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "direct" {
+		t.Errorf("body = %q, want direct", body)
+	}
+
+	// The direct entry is probed like any proxy
+	var probed []string
+	pool.probe = func(_ context.Context, e *proxyEntry) { probed = append(probed, e.proxy.Type) }
+	pool.workers = 1
+	pool.checkAllProxies(context.Background())
+	if len(probed) != 2 {
+		t.Errorf("probed %v, want both entries", probed)
+	}
+}
+
+func TestProxyPool_HeaderSelection(t *testing.T) {
+	tests := []struct {
+		name      string
+		allow     bool
+		header    string
+		unhealthy bool
+		wantHits  [2]int
+		wantErr   error
+	}{
+		{name: "selected by address", allow: true, header: "proxy2:8080", wantHits: [2]int{0, 3}},
+		{name: "selected by url", allow: true, header: "http://proxy1:8080", wantHits: [2]int{3, 0}},
+		{name: "unknown proxy", allow: true, header: "proxy9:8080", wantErr: ErrUnknownProxy},
+		{name: "unhealthy proxy", allow: true, header: "proxy2:8080", unhealthy: true, wantErr: ErrProxyUnavailable},
+		{name: "disabled by config", header: "proxy2:8080", wantHits: [2]int{2, 1}},
+		{name: "no header", allow: true, wantHits: [2]int{2, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs:                 []string{"http://proxy1:8080", "http://proxy2:8080"},
+				AllowHeaderSelection: tt.allow,
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			var hits [2]int
+			for i := range pool.entries {
+				pool.entries[i].transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+					if r.Header.Get(ProxySelectHeader) != "" {
+						t.Errorf("%s forwarded upstream", ProxySelectHeader)
+					}
+					hits[i]++
+					return stubResponse(http.StatusOK, nil)(r)
+				})
+			}
+			if tt.unhealthy {
+				pool.entries[1].setHealthy(false, "test error")
+			}
+
+			for i := 0; i < 3; i++ {
+				req, _ := http.NewRequest(http.MethodGet, "http://target.example.com/", nil)
+				if tt.header != "" {
+					req.Header.Set(ProxySelectHeader, tt.header)
+				}
+				resp, err := pool.RoundTrip(req)
+				if tt.wantErr != nil {
+					if !errors.Is(err, tt.wantErr) {
+						t.Fatalf("RoundTrip() error = %v, want %v", err, tt.wantErr)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("RoundTrip() error = %v", err)
+				}
+				resp.Body.Close()
+				if req.Header.Get(ProxySelectHeader) != tt.header {
+					t.Error("RoundTrip() modified the caller's request headers")
+				}
+			}
+			if hits != tt.wantHits {
+				t.Errorf("proxy hits = %v, want %v", hits, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestProxyPool_StopAbortsHealthCheck(t *testing.T) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:        []string{"http://proxy1:8080", "http://proxy2:8080", "http://proxy3:8080"},
+		HealthCheck: config.HealthCheckConfig{Workers: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	started := make(chan struct{}, len(pool.entries))
+	for _, e := range pool.entries {
+		e.checkTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			started <- struct{}{}
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pool.StartHealthCheck(ctx)
+		close(done)
+	}()
+
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("StartHealthCheck() still running after the context was cancelled")
+	}
+
+	if len(started) != 0 {
+		t.Errorf("%d more proxies probed after cancellation", len(started))
+	}
+	for _, s := range pool.GetStatus() {
+		if !s.Healthy {
+			t.Errorf("%s marked unhealthy by an aborted check", s.Address)
+		}
+	}
+	pool.Stop()
+}
+
+func TestProxyPool_RoundRobinFairness(t *testing.T) {
+	tests := []struct {
+		name      string
+		unhealthy []int
+		flapping  int // toggled every few picks, -1 for none
+	}{
+		{name: "stable mixed set", unhealthy: []int{1, 2}, flapping: -1},
+		{name: "flapping proxy", unhealthy: []int{1}, flapping: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs: []string{
+					"http://proxy0:8080", "http://proxy1:8080", "http://proxy2:8080",
+					"http://proxy3:8080", "http://proxy4:8080", "http://proxy5:8080",
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			for _, i := range tt.unhealthy {
+				pool.entries[i].setHealthy(false, "test error")
+			}
+
+			counts := make(map[*proxyEntry]int)
+			for n := 0; n < 1200; n++ {
+				if tt.flapping >= 0 && n%7 == 0 {
+					e := pool.entries[tt.flapping]
+					e.setHealthy(!e.isHealthy(), "test error")
+				}
+				entries := pool.getHealthyEntries()
+				counts[entries[pool.selectProxyIndex(entries, nil, nil)]]++
+			}
+
+			var steady []int
+			for i, e := range pool.entries {
+				if i == tt.flapping || slices.Contains(tt.unhealthy, i) {
+					if slices.Contains(tt.unhealthy, i) && counts[e] != 0 {
+						t.Errorf("unhealthy proxy%d picked %d times", i, counts[e])
+					}
+					continue
+				}
+				steady = append(steady, counts[e])
+			}
+			lo, hi := slices.Min(steady), slices.Max(steady)
+			if float64(hi-lo) > 0.1*float64(hi) {
+				t.Errorf("uneven rotation across healthy proxies: %v", steady)
+			}
+		})
+	}
+}
+
+// BenchmarkProxyPool_RandomParallel measures random selection from many
+// goroutines. "locked" draws from a mutex-guarded source, as the seeded
+// global math/rand does, for comparison with the pool's lock-free selection.
+func BenchmarkProxyPool_RandomParallel(b *testing.B) {
+	pool, err := NewProxyPool(config.ProxyConfig{
+		URLs:     []string{"http://proxy1:8080", "http://proxy2:8080", "http://proxy3:8080", "http://proxy4:8080"},
+		Rotation: "random",
+	})
+	if err != nil {
+		b.Fatalf("NewProxyPool() error = %v", err)
+	}
+	entries := pool.getHealthyEntries()
+
+	b.Run("pool", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_ = pool.selectProxyIndex(entries, nil, nil)
+			}
+		})
+	})
+	b.Run("locked", func(b *testing.B) {
+		var mu sync.Mutex
+		rng := rand.New(rand.NewPCG(1, 2))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				mu.Lock()
+				_ = rng.IntN(len(entries))
+				mu.Unlock()
+			}
+		})
+	})
+}
+
+func TestProxyPool_ClientCancelStopsRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		ctx      func() (context.Context, context.CancelFunc)
+		wantHits int
+		wantErr  error
+	}{
+		{
+			name: "cancelled before start",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx, cancel
+			},
+			wantHits: 0,
+			wantErr:  context.Canceled,
+		},
+		{
+			name: "client deadline during attempt",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 20*time.Millisecond)
+			},
+			wantHits: 1,
+			wantErr:  context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs: []string{"http://proxy1:8080", "http://proxy2:8080", "http://proxy3:8080"},
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			var hits atomic.Int32
+			for _, e := range pool.entries {
+				e.transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+					hits.Add(1)
+					<-r.Context().Done()
+					return nil, r.Context().Err()
+				})
+			}
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://target.example.com/", nil)
+			if _, err := pool.RoundTrip(req); !errors.Is(err, tt.wantErr) {
+				t.Errorf("RoundTrip() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := int(hits.Load()); got != tt.wantHits {
+				t.Errorf("proxies tried = %d, want %d", got, tt.wantHits)
+			}
+			if got := pool.HealthyCount(); got != len(pool.entries) {
+				t.Errorf("HealthyCount() = %d, want %d: client cancellation must not mark proxies unhealthy", got, len(pool.entries))
+			}
+		})
+	}
+}
+
+func TestProxyPool_HTTP2Only(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		_, _ = io.WriteString(w, r.Proto)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	backend.Config.Protocols = &protocols
+	backend.Start()
+	defer backend.Close()
+
+	px := newTestProxy(t)
+	tests := []struct {
+		name string
+		urls []string
+	}{
+		{name: "direct"},
+		{name: "http proxy", urls: []string{"http://" + px.addr()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewProxyPool(config.ProxyConfig{
+				URLs:      tt.urls,
+				Transport: config.TransportConfig{HTTP2Only: true},
+			})
+			if err != nil {
+				t.Fatalf("NewProxyPool() error = %v", err)
+			}
+			req, _ := http.NewRequest(http.MethodPost, backend.URL+"/pkg.Service/Method", strings.NewReader("request"))
+			req.Header.Set("Content-Type", "application/grpc")
+			resp, err := pool.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "HTTP/2.0" {
+				t.Errorf("backend saw %q, want HTTP/2.0", body)
+			}
+			if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+				t.Errorf("Grpc-Status trailer = %q, want 0", got)
+			}
+		})
+	}
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if len(px.connects) != 1 {
+		t.Errorf("proxy CONNECTs = %v, want one tunnel", px.connects)
+	}
+}
+
+func TestIsGRPC(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/grpc", true},
+		{"application/grpc+proto", true},
+		{"Application/GRPC; charset=utf-8", true},
+		{"application/grpc-web", false},
+		{"application/json", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Content-Type": {tt.contentType}}
+		if got := IsGRPC(h); got != tt.want {
+			t.Errorf("IsGRPC(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestProxyPool_TrafficCounters(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, "response body")
+	}))
+	defer target.Close()
+	tp := newTestProxy(t)
+
+	pool, err := NewProxyPool(config.ProxyConfig{URLs: []string{tp.URL}})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, target.URL, strings.NewReader("request"))
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	st := pool.GetStatus()[0]
+	if st.BytesSent != int64(len("request")) || st.BytesReceived != int64(len("response body")) {
+		t.Errorf("BytesSent, BytesReceived = %d, %d; want %d, %d",
+			st.BytesSent, st.BytesReceived, len("request"), len("response body"))
+	}
+}
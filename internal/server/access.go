@@ -1,53 +1,253 @@
 package server
 
 import (
+	"bufio"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
-	"sockstream/internal/config"
+	"github.com/foxzi/SockStream/internal/config"
 )
 
 type AccessControl struct {
+	cfg   config.AccessConfig
+	lists atomic.Pointer[ipLists]
+	paths []pathRule
+}
+
+// ipLists holds the global allow/block lists, swapped atomically on reload.
+type ipLists struct {
 	allow []*net.IPNet
 	block []*net.IPNet
 }
 
+// pathRule holds allow/block lists scoped to a path prefix.
+type pathRule struct {
+	prefix string
+	allow  []*net.IPNet
+	block  []*net.IPNet
+}
+
+// matches reports whether path is the rule's prefix or lies below it, so
+// /admin covers /admin/users but not /administrator.
+func (r pathRule) matches(path string) bool {
+	return path == r.prefix || strings.HasPrefix(path, strings.TrimSuffix(r.prefix, "/")+"/")
+}
+
 func NewAccessControl(cfg config.AccessConfig) (*AccessControl, error) {
-	ac := &AccessControl{}
-	for _, cidr := range cfg.AllowCIDRs {
-		_, n, err := net.ParseCIDR(cidr)
+	ac := &AccessControl{cfg: cfg}
+	if err := ac.Reload(); err != nil {
+		return nil, err
+	}
+	var err error
+	for _, rule := range cfg.Paths {
+		pr := pathRule{prefix: rule.PathPrefix}
+		if pr.allow, err = parseCIDRs("allow", rule.AllowCIDRs); err != nil {
+			return nil, fmt.Errorf("path %s: %w", rule.PathPrefix, err)
+		}
+		if pr.block, err = parseCIDRs("block", rule.BlockCIDRs); err != nil {
+			return nil, fmt.Errorf("path %s: %w", rule.PathPrefix, err)
+		}
+		ac.paths = append(ac.paths, pr)
+	}
+	// Longest prefix first so the most specific rule matches
+	sort.SliceStable(ac.paths, func(i, j int) bool {
+		return len(ac.paths[i].prefix) > len(ac.paths[j].prefix)
+	})
+	return ac, nil
+}
+
+// Reload rebuilds the global lists from config and the allow/block files.
+// The previous lists stay in effect when reading or parsing fails.
+func (a *AccessControl) Reload() error {
+	allow, err := parseCIDRs("allow", a.cfg.AllowCIDRs)
+	if err != nil {
+		return err
+	}
+	block, err := parseCIDRs("block", a.cfg.BlockCIDRs)
+	if err != nil {
+		return err
+	}
+	if a.cfg.AllowFile != "" {
+		nets, err := readIPFile(a.cfg.AllowFile)
 		if err != nil {
-			return nil, fmt.Errorf("parse allow cidr %s: %w", cidr, err)
+			return err
 		}
-		ac.allow = append(ac.allow, n)
+		allow = append(allow, nets...)
 	}
-	for _, cidr := range cfg.BlockCIDRs {
-		_, n, err := net.ParseCIDR(cidr)
+	if a.cfg.BlockFile != "" {
+		nets, err := readIPFile(a.cfg.BlockFile)
 		if err != nil {
-			return nil, fmt.Errorf("parse block cidr %s: %w", cidr, err)
+			return err
 		}
-		ac.block = append(ac.block, n)
+		block = append(block, nets...)
 	}
-	return ac, nil
+	a.lists.Store(&ipLists{allow: allow, block: block})
+	return nil
+}
+
+// HasFiles reports whether any list is backed by a file that can be reloaded.
+func (a *AccessControl) HasFiles() bool {
+	return a.cfg.AllowFile != "" || a.cfg.BlockFile != ""
+}
+
+// readIPFile parses one IP or CIDR per line, skipping blank lines and # comments.
+func readIPFile(path string) ([]*net.IPNet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open ip list: %w", err)
+	}
+	defer f.Close()
+
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		n, err := parseIPOrCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		nets = append(nets, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read ip list %s: %w", path, err)
+	}
+	return nets, nil
+}
+
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(stripZone(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s", s)
+		}
+		return n, nil
+	}
+	ip := parseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", s)
+	}
+	bits := 128
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits = v4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func parseCIDRs(kind string, cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(stripZone(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("parse %s cidr %s: %w", kind, cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
 }
 
 // Allowed returns true when the client IP is permitted by allow/block lists.
 func (a *AccessControl) Allowed(ip net.IP) bool {
+	lists := a.lists.Load()
+	return allowedBy(lists.allow, lists.block, ip)
+}
+
+// AllowedPath checks the IP against the rule with the longest matching path
+// prefix, falling back to the global lists when no rule matches.
+func (a *AccessControl) AllowedPath(path string, ip net.IP) bool {
+	for _, rule := range a.paths {
+		if rule.matches(path) {
+			return allowedBy(rule.allow, rule.block, ip)
+		}
+	}
+	return a.Allowed(ip)
+}
+
+// AllowedRequest checks the client address of r with AllowedPath and, with
+// check_full_xff_chain, refuses r when any X-Forwarded-For entry is on the
+// block list that applies to its path.
+func (a *AccessControl) AllowedRequest(r *http.Request) bool {
+	if !a.AllowedPath(r.URL.Path, clientIP(r)) {
+		return false
+	}
+	if !a.cfg.CheckFullXFFChain {
+		return true
+	}
+	block := a.lists.Load().block
+	for _, rule := range a.paths {
+		if rule.matches(r.URL.Path) {
+			block = rule.block
+			break
+		}
+	}
+	for _, ip := range forwardedIPs(r) {
+		for _, n := range block {
+			if n.Contains(ip) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// deniedResponse returns the status and message for refused requests.
+func (a *AccessControl) deniedResponse() (int, string) {
+	status := a.cfg.DeniedStatus
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	msg := a.cfg.DeniedBody
+	if msg == "" {
+		msg = strings.ToLower(http.StatusText(status))
+	}
+	if msg == "" {
+		msg = strconv.Itoa(status)
+	}
+	return status, msg
+}
+
+// forwardedIPs returns every address in the X-Forwarded-For headers of r.
+// Entries that are not addresses, such as "unknown", are skipped.
+func forwardedIPs(r *http.Request) []net.IP {
+	var ips []net.IP
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, part := range strings.Split(v, ",") {
+			if ip := parseIP(strings.TrimSpace(part)); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+func allowedBy(allow, block []*net.IPNet, ip net.IP) bool {
 	if ip == nil {
 		return false
 	}
 
-	for _, n := range a.block {
+	for _, n := range block {
 		if n.Contains(ip) {
 			return false
 		}
 	}
-	if len(a.allow) == 0 {
+	if len(allow) == 0 {
 		return true
 	}
-	for _, n := range a.allow {
+	for _, n := range allow {
 		if n.Contains(ip) {
 			return true
 		}
@@ -55,18 +255,86 @@ func (a *AccessControl) Allowed(ip net.IP) bool {
 	return false
 }
 
+// UserAgentFilter matches the User-Agent header against allow/block patterns.
+type UserAgentFilter struct {
+	allow []*regexp.Regexp
+	block []*regexp.Regexp
+}
+
+func NewUserAgentFilter(cfg config.AccessConfig) (*UserAgentFilter, error) {
+	f := &UserAgentFilter{}
+	for _, p := range cfg.AllowUserAgents {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("parse allow user agent %s: %w", p, err)
+		}
+		f.allow = append(f.allow, re)
+	}
+	for _, p := range cfg.BlockUserAgents {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("parse block user agent %s: %w", p, err)
+		}
+		f.block = append(f.block, re)
+	}
+	return f, nil
+}
+
+// Allowed returns true when the user agent is permitted by allow/block patterns.
+func (f *UserAgentFilter) Allowed(ua string) bool {
+	for _, re := range f.block {
+		if re.MatchString(ua) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, re := range f.allow {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+	return false
+}
+
 func clientIP(r *http.Request) net.IP {
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 		parts := strings.Split(xff, ",")
 		if len(parts) > 0 {
-			if ip := net.ParseIP(strings.TrimSpace(parts[0])); ip != nil {
+			if ip := parseIP(strings.TrimSpace(parts[0])); ip != nil {
 				return ip
 			}
 		}
 	}
+	return peerIP(r)
+}
+
+// peerIP returns the address of the connection r arrived on, ignoring
+// X-Forwarded-For, which any client can set.
+func peerIP(r *http.Request) net.IP {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return net.ParseIP(r.RemoteAddr)
+		return parseIP(r.RemoteAddr)
+	}
+	return parseIP(host)
+}
+
+// parseIP is net.ParseIP for addresses that may carry an IPv6 zone, as
+// link-local peers do (fe80::1%eth0). The zone is dropped: lists match
+// addresses, not interfaces.
+func parseIP(s string) net.IP {
+	return net.ParseIP(stripZone(s))
+}
+
+// stripZone removes the zone from an address or CIDR such as fe80::%eth0/64.
+func stripZone(s string) string {
+	i := strings.IndexByte(s, '%')
+	if i < 0 {
+		return s
+	}
+	if j := strings.IndexByte(s[i:], '/'); j >= 0 {
+		return s[:i] + s[i+j:]
 	}
-	return net.ParseIP(host)
+	return s[:i]
 }
@@ -1,11 +1,15 @@
 package server
 
 import (
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
-	"sockstream/internal/config"
+	"github.com/foxzi/SockStream/internal/config"
 )
 
 func TestNewAccessControl(t *testing.T) {
@@ -130,6 +134,20 @@ func TestAccessControl_Allowed(t *testing.T) {
 			ip:    "2001:db8::1",
 			want:  false,
 		},
+		{
+			name:  "link-local address with zone allowed",
+			allow: []string{"fe80::/10"},
+			block: []string{},
+			ip:    "fe80::1%eth0",
+			want:  true,
+		},
+		{
+			name:  "zoned CIDR in block list",
+			allow: []string{},
+			block: []string{"fe80::%eth0/64"},
+			ip:    "fe80::1%eth1",
+			want:  false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -144,7 +162,7 @@ func TestAccessControl_Allowed(t *testing.T) {
 
 			var ip net.IP
 			if tt.ip != "" {
-				ip = net.ParseIP(tt.ip)
+				ip = parseIP(tt.ip)
 			}
 
 			if got := ac.Allowed(ip); got != tt.want {
@@ -203,6 +221,24 @@ func TestClientIP(t *testing.T) {
 			xff:        "2001:db8::1",
 			wantIP:     "2001:db8::1",
 		},
+		{
+			name:       "link-local RemoteAddr with zone",
+			remoteAddr: "[fe80::1%eth0]:12345",
+			xff:        "",
+			wantIP:     "fe80::1",
+		},
+		{
+			name:       "link-local RemoteAddr with zone and no port",
+			remoteAddr: "fe80::1%eth0",
+			xff:        "",
+			wantIP:     "fe80::1",
+		},
+		{
+			name:       "link-local X-Forwarded-For with zone",
+			remoteAddr: "127.0.0.1:12345",
+			xff:        "fe80::abcd%en0, 203.0.113.50",
+			wantIP:     "fe80::abcd",
+		},
 	}
 
 	for _, tt := range tests {
@@ -224,3 +260,335 @@ func TestClientIP(t *testing.T) {
 		})
 	}
 }
+
+func TestUserAgentFilter_Allowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		block []string
+		ua    string
+		want  bool
+	}{
+		{
+			name: "empty lists allow all",
+			ua:   "Mozilla/5.0",
+			want: true,
+		},
+		{
+			name:  "blocked by pattern",
+			block: []string{`(?i)bot`, `^curl/`},
+			ua:    "Googlebot/2.1",
+			want:  false,
+		},
+		{
+			name:  "not matching block",
+			block: []string{`^curl/`},
+			ua:    "Mozilla/5.0",
+			want:  true,
+		},
+		{
+			name:  "in allow list",
+			allow: []string{`^Mozilla/`},
+			ua:    "Mozilla/5.0 (X11; Linux x86_64)",
+			want:  true,
+		},
+		{
+			name:  "not in allow list",
+			allow: []string{`^Mozilla/`},
+			ua:    "python-requests/2.31",
+			want:  false,
+		},
+		{
+			name:  "block takes precedence over allow",
+			allow: []string{`^Mozilla/`},
+			block: []string{`HeadlessChrome`},
+			ua:    "Mozilla/5.0 HeadlessChrome/120.0",
+			want:  false,
+		},
+		{
+			name:  "empty user agent with allow list",
+			allow: []string{`^Mozilla/`},
+			ua:    "",
+			want:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewUserAgentFilter(config.AccessConfig{
+				AllowUserAgents: tt.allow,
+				BlockUserAgents: tt.block,
+			})
+			if err != nil {
+				t.Fatalf("NewUserAgentFilter() error = %v", err)
+			}
+			if got := f.Allowed(tt.ua); got != tt.want {
+				t.Errorf("Allowed(%q) = %v, want %v", tt.ua, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewUserAgentFilter_InvalidPattern(t *testing.T) {
+	_, err := NewUserAgentFilter(config.AccessConfig{BlockUserAgents: []string{"("}})
+	if err == nil {
+		t.Error("NewUserAgentFilter() expected error for invalid pattern")
+	}
+}
+
+func TestAccessControl_AllowedPath(t *testing.T) {
+	ac, err := NewAccessControl(config.AccessConfig{
+		BlockCIDRs: []string{"203.0.113.0/24"},
+		Paths: []config.PathAccessRule{
+			{PathPrefix: "/admin", AllowCIDRs: []string{"10.0.0.0/8"}},
+			{PathPrefix: "/admin/public", AllowCIDRs: []string{"0.0.0.0/0"}},
+			{PathPrefix: "/internal", BlockCIDRs: []string{"0.0.0.0/0"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewAccessControl() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		ip   string
+		want bool
+	}{
+		{"public path allowed", "/", "198.51.100.1", true},
+		{"public path global block", "/", "203.0.113.5", false},
+		{"admin from internal", "/admin/users", "10.1.2.3", true},
+		{"admin from external", "/admin/users", "198.51.100.1", false},
+		{"longest prefix wins", "/admin/public/info", "198.51.100.1", true},
+		{"path rule replaces global block", "/admin/public", "203.0.113.5", true},
+		{"blocked path", "/internal/metrics", "10.1.2.3", false},
+		{"nil ip", "/admin", "", false},
+		{"exact prefix", "/admin", "198.51.100.1", false},
+		{"prefix is a path segment", "/administrator", "198.51.100.1", true},
+		{"prefix is a path segment under a longer rule", "/admin/publication", "198.51.100.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ip net.IP
+			if tt.ip != "" {
+				ip = net.ParseIP(tt.ip)
+			}
+			if got := ac.AllowedPath(tt.path, ip); got != tt.want {
+				t.Errorf("AllowedPath(%q, %s) = %v, want %v", tt.path, tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessControl_AllowedRequest_FullXFFChain(t *testing.T) {
+	access := config.AccessConfig{
+		BlockCIDRs: []string{"203.0.113.0/24"},
+		Paths: []config.PathAccessRule{
+			{PathPrefix: "/open", AllowCIDRs: []string{"0.0.0.0/0"}},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		xff       []string
+		fullChain bool
+		want      bool
+	}{
+		{"first hop only", "/", []string{"198.51.100.1, 203.0.113.7"}, false, true},
+		{"blocked intermediary", "/", []string{"198.51.100.1, 203.0.113.7"}, true, false},
+		{"blocked hop in repeated header", "/", []string{"198.51.100.1", "unknown, 203.0.113.7"}, true, false},
+		{"clean chain", "/", []string{"198.51.100.1, 192.0.2.10"}, true, true},
+		{"path rule without block list", "/open", []string{"198.51.100.1, 203.0.113.7"}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := access
+			cfg.CheckFullXFFChain = tt.fullChain
+			ac, err := NewAccessControl(cfg)
+			if err != nil {
+				t.Fatalf("NewAccessControl() error = %v", err)
+			}
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = "192.0.2.1:12345"
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := ac.AllowedRequest(req); got != tt.want {
+				t.Errorf("AllowedRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAccessControl_InvalidPathCIDR(t *testing.T) {
+	_, err := NewAccessControl(config.AccessConfig{
+		Paths: []config.PathAccessRule{{PathPrefix: "/admin", AllowCIDRs: []string{"bad"}}},
+	})
+	if err == nil {
+		t.Error("NewAccessControl() expected error for invalid path CIDR")
+	}
+}
+
+func TestAccessControl_ReloadFromFile(t *testing.T) {
+	blockFile := filepath.Join(t.TempDir(), "block.txt")
+	writeFile := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(blockFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("# threat feed\n203.0.113.7\n198.51.100.0/24 # bad subnet\n\n2001:db8::1\n")
+
+	ac, err := NewAccessControl(config.AccessConfig{
+		BlockCIDRs: []string{"192.0.2.0/24"},
+		BlockFile:  blockFile,
+	})
+	if err != nil {
+		t.Fatalf("NewAccessControl() error = %v", err)
+	}
+
+	blocked := []string{"203.0.113.7", "198.51.100.42", "2001:db8::1", "192.0.2.1"}
+	for _, ip := range blocked {
+		if ac.Allowed(net.ParseIP(ip)) {
+			t.Errorf("Allowed(%s) = true, want false", ip)
+		}
+	}
+	if !ac.Allowed(net.ParseIP("203.0.113.8")) {
+		t.Error("plain IP entry should only block that address")
+	}
+
+	writeFile("203.0.113.8\n")
+	if err := ac.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if !ac.Allowed(net.ParseIP("203.0.113.7")) {
+		t.Error("203.0.113.7 should be allowed after reload")
+	}
+	if ac.Allowed(net.ParseIP("203.0.113.8")) {
+		t.Error("203.0.113.8 should be blocked after reload")
+	}
+	if ac.Allowed(net.ParseIP("192.0.2.1")) {
+		t.Error("static block list should survive reload")
+	}
+
+	// Invalid content keeps the previous lists
+	writeFile("not-an-ip\n")
+	if err := ac.Reload(); err == nil {
+		t.Error("Reload() expected error for invalid entry")
+	}
+	if ac.Allowed(net.ParseIP("203.0.113.8")) {
+		t.Error("failed reload should keep previous lists")
+	}
+}
+
+func TestNewAccessControl_MissingFile(t *testing.T) {
+	_, err := NewAccessControl(config.AccessConfig{
+		AllowFile: filepath.Join(t.TempDir(), "missing.txt"),
+	})
+	if err == nil {
+		t.Error("NewAccessControl() expected error for missing allow file")
+	}
+}
+
+func TestServiceAccess(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Access.HealthAllowCIDRs = []string{"10.0.0.0/8"}
+	cfg.Admin.Listen = ""
+	proxied := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "proxied")
+	})
+	srv, err := New(cfg, discardLogger(), proxied, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		xff        string
+		wantStatus int
+	}{
+		{name: "healthz from load balancer", path: "/healthz", remoteAddr: "10.1.2.3:1234", wantStatus: http.StatusOK},
+		{name: "spoofed forwarded for", path: "/healthz", remoteAddr: "203.0.113.5:1234", xff: "10.1.2.3", wantStatus: http.StatusForbidden},
+		{name: "healthz from elsewhere", path: "/healthz", remoteAddr: "203.0.113.5:1234", wantStatus: http.StatusForbidden},
+		{name: "status from elsewhere", path: "/status", remoteAddr: "203.0.113.5:1234", wantStatus: http.StatusForbidden},
+		{name: "proxied path unaffected", path: "/app", remoteAddr: "203.0.113.5:1234", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			rec := httptest.NewRecorder()
+			srv.handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	cfg.Admin.Listen = "127.0.0.1:9090"
+	srv, err = New(cfg, discardLogger(), proxied, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	rec := httptest.NewRecorder()
+	srv.admin.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("admin listener status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestNew_InvalidHealthAllowCIDR(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Access.HealthAllowCIDRs = []string{"10.0.0.0/33"}
+	if _, err := New(cfg, discardLogger(), http.NotFoundHandler(), nil); err == nil {
+		t.Error("New() should reject an invalid health_allow_cidrs entry")
+	}
+}
+
+func TestAccessMiddleware_DeniedStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "default", wantStatus: http.StatusForbidden, wantBody: "forbidden\n"},
+		{name: "not found", status: http.StatusNotFound, wantStatus: http.StatusNotFound, wantBody: "not found\n"},
+		{name: "custom body", status: http.StatusNotFound, body: "nothing here", wantStatus: http.StatusNotFound, wantBody: "nothing here\n"},
+		{name: "code without status text", status: 444, wantStatus: 444, wantBody: "444\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.Access.BlockCIDRs = []string{"10.0.0.0/8"}
+			cfg.Access.DeniedStatus = tt.status
+			cfg.Access.DeniedBody = tt.body
+			srv := newTestServer(t, cfg, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "10.1.2.3:1234"
+			rec := httptest.NewRecorder()
+			srv.handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+// activationListeners returns the sockets passed by systemd socket activation
+// (LISTEN_PID and LISTEN_FDS), in the order the socket unit lists them, and
+// clears those variables so child processes do not pick them up. It returns
+// nil when the process was not socket-activated.
+func activationListeners() ([]net.Listener, error) {
+	n := activationCount(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	if n == 0 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return listenersFromFDs(listenFDsStart, n)
+}
+
+// activationCount returns how many sockets were passed to the process with
+// the given pid, or 0 when the variables are unset or meant for another process.
+func activationCount(listenPID, listenFDs string, pid int) int {
+	p, err := strconv.Atoi(listenPID)
+	if err != nil || p != pid {
+		return 0
+	}
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// listenersFromFDs wraps n consecutive listening descriptors starting at
+// start. net.FileListener duplicates each descriptor, so the originals are
+// closed.
+func listenersFromFDs(start, n int) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, n)
+	for fd := start; fd < start+n; fd++ {
+		f := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestActivationCount(t *testing.T) {
+	tests := []struct {
+		name      string
+		listenPID string
+		listenFDs string
+		want      int
+	}{
+		{name: "not activated", want: 0},
+		{name: "two sockets", listenPID: "42", listenFDs: "2", want: 2},
+		{name: "other process", listenPID: "7", listenFDs: "2", want: 0},
+		{name: "bad count", listenPID: "42", listenFDs: "x", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := activationCount(tt.listenPID, tt.listenFDs, 42); got != tt.want {
+				t.Errorf("activationCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_ServesInheritedListener(t *testing.T) {
+	orig, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := orig.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := orig.Addr().String()
+	orig.Close()
+	// listenersFromFDs closes the descriptor it is given, so hand it a copy;
+	// f would otherwise close the same number again once it is finalized
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inherited, err := listenersFromFDs(fd, 1)
+	if err != nil {
+		t.Fatalf("listenersFromFDs() error = %v", err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Target = "https://example.com"
+	// The configured address is ignored in favour of the passed socket
+	cfg.Listen = "127.0.0.1:1"
+	srv := newTestServer(t, cfg, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	servers := []*http.Server{srv.newHTTPServer(cfg.Listen)}
+	go func() { done <- srv.serveAll(ctx, servers, inherited) }()
+
+	resp, err := http.Get("http://" + addr + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz on inherited socket: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("body = %q, want ok", body)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != http.ErrServerClosed {
+			t.Errorf("serveAll() error = %v, want http.ErrServerClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveAll() did not return after cancel")
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/foxzi/SockStream/internal/proxy"
+)
+
+type adminProxyResponse struct {
+	Address  string `json:"address"`
+	Disabled bool   `json:"disabled"`
+}
+
+// registerAdmin adds the operator endpoints to mux. Nothing is registered
+// without a token so the paths keep reaching the target by default.
+func registerAdmin(mux *http.ServeMux, token string, pool *proxy.ProxyPool) {
+	if token == "" {
+		return
+	}
+	auth := adminAuthMiddleware(token)
+	mux.Handle("POST /admin/proxies/{addr}/disable", auth(setProxyDisabledHandler(pool, true)))
+	mux.Handle("POST /admin/proxies/{addr}/enable", auth(setProxyDisabledHandler(pool, false)))
+}
+
+// registerPprof adds the net/http/pprof handlers to mux, behind token when
+// one is set. Config validation requires one on the main listener. The
+// cmdline handler is left out: the command line may carry credentials.
+func registerPprof(mux *http.ServeMux, token string) {
+	wrap := func(h http.Handler) http.Handler { return h }
+	if token != "" {
+		wrap = adminAuthMiddleware(token)
+	}
+	mux.Handle("/debug/pprof/", wrap(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/profile", wrap(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", wrap(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", wrap(http.HandlerFunc(pprof.Trace)))
+}
+
+// adminAuthMiddleware requires "Authorization: Bearer <token>".
+func adminAuthMiddleware(token string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// setProxyDisabledHandler takes the proxy named in the path out of rotation
+// or puts it back. Health checks keep running while it is disabled.
+func setProxyDisabledHandler(pool *proxy.ProxyPool, disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr := r.PathValue("addr")
+		if pool == nil {
+			http.Error(w, "no proxy pool configured", http.StatusNotFound)
+			return
+		}
+		if err := pool.SetDisabled(addr, disabled); err != nil {
+			if errors.Is(err, proxy.ErrUnknownProxy) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(adminProxyResponse{Address: addr, Disabled: disabled})
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/proxy"
+)
+
+func TestAdminProxyEndpoints(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Admin.Token = "s3cret"
+	// Serve the admin API on the main listener, where other methods reach the target
+	cfg.Admin.Listen = ""
+	cfg.Proxy.URLs = []string{"http://proxy1:8080", "http://proxy2:8080"}
+	pool, err := proxy.NewProxyPool(cfg.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, cfg, pool)
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		token        string
+		wantStatus   int
+		wantDisabled bool
+	}{
+		{name: "missing token", method: http.MethodPost, path: "/admin/proxies/proxy1:8080/disable", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodPost, path: "/admin/proxies/proxy1:8080/disable", token: "nope", wantStatus: http.StatusUnauthorized},
+		{name: "unknown proxy", method: http.MethodPost, path: "/admin/proxies/proxy9:8080/disable", token: "s3cret", wantStatus: http.StatusNotFound},
+		{name: "disable", method: http.MethodPost, path: "/admin/proxies/proxy1:8080/disable", token: "s3cret", wantStatus: http.StatusOK, wantDisabled: true},
+		{name: "get falls through to target", method: http.MethodGet, path: "/admin/proxies/proxy1:8080/enable", token: "s3cret", wantStatus: http.StatusOK, wantDisabled: true},
+		{name: "enable by escaped url", method: http.MethodPost, path: "/admin/proxies/http:%2F%2Fproxy1:8080/enable", token: "s3cret", wantStatus: http.StatusOK, wantDisabled: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			srv.handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := pool.GetStatus()[0].Disabled; got != tt.wantDisabled {
+				t.Errorf("disabled = %v, want %v", got, tt.wantDisabled)
+			}
+		})
+	}
+}
+
+func TestAdminProxyEndpoints_NoToken(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Admin.Listen = ""
+	cfg.Proxy.URLs = []string{"http://proxy1:8080"}
+	pool, err := proxy.NewProxyPool(cfg.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, cfg, pool)
+
+	rec := httptest.NewRecorder()
+	srv.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/proxies/proxy1:8080/disable", nil))
+	if pool.GetStatus()[0].Disabled {
+		t.Error("admin endpoints must not be registered without a token")
+	}
+
+	rec = httptest.NewRecorder()
+	srv.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status statusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if len(status.Proxies) != 1 || status.Proxies[0].Disabled {
+		t.Errorf("status proxies = %+v", status.Proxies)
+	}
+}
+
+func TestAdminListener_SeparatesServiceEndpoints(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Admin.Token = "s3cret"
+	cfg.Proxy.URLs = []string{"http://proxy1:8080"}
+	pool, err := proxy.NewProxyPool(cfg.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxied := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "proxied")
+	})
+	srv, err := New(cfg, discardLogger(), proxied, pool)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if srv.admin == nil {
+		t.Fatal("admin handler not created for admin.listen")
+	}
+
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		method   string
+		path     string
+		wantBody string
+	}{
+		{name: "main healthz", handler: srv.handler, method: http.MethodGet, path: "/healthz", wantBody: "ok"},
+		{name: "main status proxied", handler: srv.handler, method: http.MethodGet, path: "/status", wantBody: "proxied"},
+		{name: "main metrics proxied", handler: srv.handler, method: http.MethodGet, path: "/metrics", wantBody: "proxied"},
+		{name: "main admin proxied", handler: srv.handler, method: http.MethodPost, path: "/admin/proxies/proxy1:8080/disable", wantBody: "proxied"},
+		{name: "admin healthz", handler: srv.admin, method: http.MethodGet, path: "/healthz", wantBody: "ok"},
+		{name: "admin metrics", handler: srv.admin, method: http.MethodGet, path: "/metrics", wantBody: "# HELP sockstream_"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer s3cret")
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, req)
+			if !strings.HasPrefix(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want prefix %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+	if pool.GetStatus()[0].Disabled {
+		t.Fatal("admin API must not be served on the main listener")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/proxies/proxy1:8080/disable", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	srv.admin.ServeHTTP(httptest.NewRecorder(), req)
+	if !pool.GetStatus()[0].Disabled {
+		t.Error("admin API on the admin listener did not disable the proxy")
+	}
+}
+
+func TestPprof(t *testing.T) {
+	proxied := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "proxied")
+	})
+	newServer := func(t *testing.T, pprof bool, adminListen string) *Server {
+		t.Helper()
+		cfg := config.DefaultConfig()
+		cfg.Debug.Pprof = pprof
+		cfg.Admin.Token = "s3cret"
+		cfg.Admin.Listen = adminListen
+		srv, err := New(cfg, discardLogger(), proxied, nil)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		return srv
+	}
+	get := func(h http.Handler, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/debug/pprof/symbol", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("disabled is proxied", func(t *testing.T) {
+		srv := newServer(t, false, "")
+		if body := get(srv.handler, "s3cret").Body.String(); body != "proxied" {
+			t.Errorf("body = %q, want proxied", body)
+		}
+	})
+	t.Run("admin listener", func(t *testing.T) {
+		srv := newServer(t, true, "127.0.0.1:9090")
+		if rec := get(srv.admin, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("admin pprof status without token = %d, want %d", rec.Code, http.StatusUnauthorized)
+		}
+		if rec := get(srv.admin, "s3cret"); rec.Code != http.StatusOK || rec.Body.String() == "proxied" {
+			t.Errorf("admin pprof status = %d, body = %q", rec.Code, rec.Body.String())
+		}
+		if body := get(srv.handler, "s3cret").Body.String(); body != "proxied" {
+			t.Errorf("main listener body = %q, want proxied", body)
+		}
+	})
+	t.Run("main listener requires token", func(t *testing.T) {
+		srv := newServer(t, true, "")
+		if rec := get(srv.handler, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("status without token = %d, want %d", rec.Code, http.StatusUnauthorized)
+		}
+		if rec := get(srv.handler, "s3cret"); rec.Code != http.StatusOK || rec.Body.String() == "proxied" {
+			t.Errorf("status with token = %d, body = %q", rec.Code, rec.Body.String())
+		}
+	})
+	t.Run("no cmdline", func(t *testing.T) {
+		srv := newServer(t, true, "127.0.0.1:9090")
+		req := httptest.NewRequest(http.MethodGet, "/debug/pprof/cmdline", nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rec := httptest.NewRecorder()
+		srv.admin.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), os.Args[0]) {
+			t.Errorf("cmdline status = %d, body = %q", rec.Code, rec.Body.String())
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+const defaultResponseBufferKB = 64
+
+// responseBufferMiddleware implements streaming.mode "buffer": response
+// bodies are written to the client in buffer_kb pieces, and flushes asked
+// for by the proxy, even for event streams, are held back.
+func responseBufferMiddleware(cfg config.StreamingConfig) middleware {
+	return func(next http.Handler) http.Handler {
+		if !strings.EqualFold(cfg.Mode, "buffer") {
+			return next
+		}
+		size := cfg.BufferKB << 10
+		if size == 0 {
+			size = defaultResponseBufferKB << 10
+		}
+		writers := sync.Pool{New: func() any { return bufio.NewWriterSize(nil, size) }}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buf := writers.Get().(*bufio.Writer)
+			buf.Reset(w)
+			bw := &bufferedWriter{ResponseWriter: w, buf: buf}
+			next.ServeHTTP(bw, r)
+			// Fails harmlessly when the connection was hijacked
+			_ = buf.Flush()
+			buf.Reset(nil)
+			writers.Put(buf)
+		})
+	}
+}
+
+// bufferedWriter passes body writes through buf.
+type bufferedWriter struct {
+	http.ResponseWriter
+	buf         *bufio.Writer
+	wroteHeader bool
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	// 1xx responses other than 101 may precede the final one
+	if status >= http.StatusOK || status == http.StatusSwitchingProtocols {
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *bufferedWriter) Write(p []byte) (int, error) {
+	// Send the headers as they are now, as an unbuffered writer would
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.buf.Write(p)
+}
+
+// FlushError is what http.ResponseController calls to flush; the data stays
+// buffered.
+func (w *bufferedWriter) FlushError() error {
+	return nil
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController, for
+// hijacking upgraded connections.
+func (w *bufferedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
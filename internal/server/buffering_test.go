@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestResponseBufferMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		bufferKB  int
+		chunk     int
+		wantEarly bool
+	}{
+		{name: "auto flushes", mode: "", chunk: 10, wantEarly: true},
+		{name: "buffer holds flushes", mode: "buffer", chunk: 10, wantEarly: false},
+		{name: "buffer writes when full", mode: "buffer", bufferKB: 4, chunk: 64 << 10, wantEarly: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.WriteHeader(http.StatusOK)
+				_, _ = io.WriteString(w, strings.Repeat("x", tt.chunk))
+				_ = http.NewResponseController(w).Flush()
+				<-release
+				_, _ = io.WriteString(w, "end")
+			})
+			cfg := config.DefaultConfig()
+			cfg.Streaming = config.StreamingConfig{Mode: tt.mode, BufferKB: tt.bufferKB}
+			srv, err := New(cfg, discardLogger(), backend, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			front := httptest.NewServer(srv.handler)
+			defer front.Close()
+
+			// In buffer mode even the headers wait for the body
+			got := make(chan error, 1)
+			go func() {
+				resp, err := http.Get(front.URL + "/events")
+				if err != nil {
+					got <- err
+					return
+				}
+				defer resp.Body.Close()
+				_, err = bufio.NewReader(resp.Body).ReadByte()
+				got <- err
+			}()
+			select {
+			case err := <-got:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !tt.wantEarly {
+					t.Error("body arrived before the response was complete")
+				}
+				close(release)
+				return
+			case <-time.After(200 * time.Millisecond):
+				if tt.wantEarly {
+					t.Error("body held back while the response was in progress")
+				}
+			}
+			close(release)
+			if err := <-got; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
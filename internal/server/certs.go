@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certReloader serves a certificate loaded from disk and reloads it when the
+// certificate or key file changes, so renewals are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+	cert     atomic.Pointer[tls.Certificate]
+	// onChange is called with each newly loaded certificate
+	onChange func(tls.Certificate)
+
+	mu       sync.Mutex
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string, logger *slog.Logger) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Reload loads the key pair when either file changed since the last load.
+// A pair that fails to load or whose key does not match leaves the current
+// certificate in place.
+func (r *certReloader) Reload() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false, fmt.Errorf("stat tls certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("stat tls key: %w", err)
+	}
+	if r.cert.Load() != nil && certInfo.ModTime().Equal(r.certTime) && keyInfo.ModTime().Equal(r.keyTime) {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("load tls certificate: %w", err)
+	}
+	first := r.cert.Load() == nil
+	r.cert.Store(&cert)
+	r.certTime, r.keyTime = certInfo.ModTime(), keyInfo.ModTime()
+	if !first && r.onChange != nil {
+		r.onChange(cert)
+	}
+	return !first, nil
+}
+
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.reloadWithLog()
+			}
+		}
+	}()
+}
+
+func (r *certReloader) reloadWithLog() {
+	changed, err := r.Reload()
+	if err != nil {
+		r.logger.Error("failed to reload tls certificate", "error", err)
+		return
+	}
+	if changed {
+		leaf := r.cert.Load().Leaf
+		r.logger.Info("tls certificate reloaded", "subject", leaf.Subject.CommonName, "not_after", leaf.NotAfter)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate for name to certFile/keyFile,
+// setting both modification times to mtime.
+func writeKeyPair(t *testing.T, certFile, keyFile, name string, mtime time.Time) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(certFile, mtime, mtime)
+	_ = os.Chtimes(keyFile, mtime, mtime)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeKeyPair(t, certFile, keyFile, "old.example.com", start)
+
+	r, err := newCertReloader(certFile, keyFile, discardLogger())
+	if err != nil {
+		t.Fatalf("newCertReloader() error = %v", err)
+	}
+	var notified []string
+	r.onChange = func(c tls.Certificate) {
+		notified = append(notified, c.Leaf.Subject.CommonName)
+	}
+
+	if changed, err := r.Reload(); err != nil || changed {
+		t.Fatalf("Reload() unchanged files = %v, %v", changed, err)
+	}
+
+	writeKeyPair(t, certFile, keyFile, "new.example.com", start.Add(time.Minute))
+	if changed, err := r.Reload(); err != nil || !changed {
+		t.Fatalf("Reload() after renewal = %v, %v", changed, err)
+	}
+	if cert, _ := r.getCertificate(nil); cert.Leaf.Subject.CommonName != "new.example.com" {
+		t.Errorf("serving %q, want new.example.com", cert.Leaf.Subject.CommonName)
+	}
+	if len(notified) != 1 || notified[0] != "new.example.com" {
+		t.Errorf("onChange calls = %v", notified)
+	}
+
+	// A key that does not match the certificate is rejected
+	other := filepath.Join(dir, "other.pem")
+	writeKeyPair(t, other, keyFile, "mismatch.example.com", start.Add(2*time.Minute))
+	if _, err := r.Reload(); err == nil {
+		t.Fatal("Reload() should fail for mismatched key")
+	}
+	if cert, _ := r.getCertificate(nil); cert.Leaf.Subject.CommonName != "new.example.com" {
+		t.Errorf("failed reload replaced certificate with %q", cert.Leaf.Subject.CommonName)
+	}
+}
+
+func TestNewCertReloader_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertReloader(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "missing.key"), discardLogger()); err == nil {
+		t.Fatal("expected error for missing files")
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/errorpage"
+)
+
+// concurrencyLimiter bounds the number of requests proxied at the same time.
+// It always counts in-flight requests so they can be exported as a metric.
+type concurrencyLimiter struct {
+	// slots is nil when the number of requests is not limited
+	slots    chan struct{}
+	wait     time.Duration
+	inFlight atomic.Int64
+	// queued counts requests waiting for a slot; waits and waitNanos add up
+	// every finished wait, whether it got a slot or not
+	queued    atomic.Int64
+	waits     atomic.Int64
+	waitNanos atomic.Int64
+}
+
+func newConcurrencyLimiter(max int, wait time.Duration) *concurrencyLimiter {
+	l := &concurrencyLimiter{wait: wait}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+// acquire takes a slot, waiting up to l.wait for one to free up.
+func (l *concurrencyLimiter) acquire(r *http.Request) bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+	l.queued.Add(1)
+	start := time.Now()
+	defer func() {
+		l.queued.Add(-1)
+		l.waits.Add(1)
+		l.waitNanos.Add(int64(time.Since(start)))
+	}()
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// InFlight returns the number of requests currently being proxied.
+func (l *concurrencyLimiter) InFlight() int64 {
+	return l.inFlight.Load()
+}
+
+// Queued returns the number of requests waiting for a slot.
+func (l *concurrencyLimiter) Queued() int64 {
+	return l.queued.Load()
+}
+
+// QueueWait returns how many requests have waited for a slot and their total
+// wait time.
+func (l *concurrencyLimiter) QueueWait() (int64, time.Duration) {
+	return l.waits.Load(), time.Duration(l.waitNanos.Load())
+}
+
+// concurrencyMiddleware answers 503 when no slot frees up in time.
+func concurrencyMiddleware(l *concurrencyLimiter, pages *errorpage.Pages) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !l.acquire(r) {
+				w.Header().Set("Retry-After", "1")
+				pages.Error(w, r, "too many concurrent requests", http.StatusServiceUnavailable)
+				return
+			}
+			defer l.release()
+			l.inFlight.Add(1)
+			defer l.inFlight.Add(-1)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// perIPLimiter bounds concurrent requests per client IP. Entries are removed
+// once a client has no requests left, so the map only holds active clients.
+type perIPLimiter struct {
+	max    int
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newPerIPLimiter(max int) *perIPLimiter {
+	return &perIPLimiter{max: max, active: make(map[string]int)}
+}
+
+func (l *perIPLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] >= l.max {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+func (l *perIPLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] <= 1 {
+		delete(l.active, ip)
+		return
+	}
+	l.active[ip]--
+}
+
+// perIPConcurrencyMiddleware answers 429 when a client already has max
+// requests in flight. Clients are told apart by peer address, since a
+// spoofed X-Forwarded-For would otherwise dodge the limit; only peers in
+// trusted may name the client in X-Forwarded-For. max of 0 disables the
+// limit.
+func perIPConcurrencyMiddleware(max int, trusted []*net.IPNet, pages *errorpage.Pages) middleware {
+	if max <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	l := newPerIPLimiter(max)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := trustedClientIP(r, trusted).String()
+			if !l.acquire(ip) {
+				w.Header().Set("Retry-After", "1")
+				pages.Error(w, r, "too many concurrent requests", http.StatusTooManyRequests)
+				return
+			}
+			defer l.release(ip)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// trustedClientIP returns the client address behind trusted proxies: the
+// rightmost X-Forwarded-For entry not in trusted, when the peer itself is
+// trusted. Entries left of it were written by the client and are ignored.
+// Without a trusted peer it is the peer address.
+func trustedClientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	ip := peerIP(r)
+	if !inNets(trusted, ip) {
+		return ip
+	}
+	chain := forwardedIPs(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip = chain[i]
+		if !inNets(trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func inNets(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
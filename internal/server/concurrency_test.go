@@ -0,0 +1,295 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/proxy"
+)
+
+func TestConcurrencyMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		max        int
+		wait       time.Duration
+		releaseIn  time.Duration
+		wantStatus int
+	}{
+		{name: "unlimited", max: 0, wantStatus: http.StatusOK},
+		{name: "limit reached rejects", max: 1, wantStatus: http.StatusServiceUnavailable},
+		{name: "queue times out", max: 1, wait: 20 * time.Millisecond, releaseIn: 200 * time.Millisecond, wantStatus: http.StatusServiceUnavailable},
+		{name: "queued until slot frees", max: 1, wait: time.Second, releaseIn: 20 * time.Millisecond, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newConcurrencyLimiter(tt.max, tt.wait)
+			release := make(chan struct{})
+			started := make(chan struct{}, 1)
+			h := concurrencyMiddleware(l, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/block" {
+					started <- struct{}{}
+					<-release
+				}
+			}))
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/block", nil))
+			}()
+			<-started
+			if got := l.InFlight(); got != 1 {
+				t.Errorf("InFlight() = %d, want 1", got)
+			}
+			if tt.releaseIn > 0 {
+				time.AfterFunc(tt.releaseIn, func() { close(release) })
+			} else {
+				defer close(release)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+				t.Error("rejected response should set Retry-After")
+			}
+			if tt.releaseIn > 0 {
+				<-done
+			}
+		})
+	}
+}
+
+func TestMetrics_InFlight(t *testing.T) {
+	srv := newTestServer(t, config.DefaultConfig(), nil)
+
+	rec := httptest.NewRecorder()
+	srv.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "sockstream_requests_in_flight 0") {
+		t.Errorf("/metrics missing in-flight gauge:\n%s", rec.Body.String())
+	}
+}
+
+func TestConcurrencyLimiter_QueueMetrics(t *testing.T) {
+	l := newConcurrencyLimiter(1, time.Second)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if !l.acquire(r) {
+		t.Fatal("first acquire failed")
+	}
+
+	acquired := make(chan bool)
+	go func() { acquired <- l.acquire(r) }()
+	deadline := time.Now().Add(time.Second)
+	for l.Queued() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("request was not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	l.release()
+	if !<-acquired {
+		t.Fatal("queued acquire failed")
+	}
+
+	if got := l.Queued(); got != 0 {
+		t.Errorf("Queued() = %d, want 0", got)
+	}
+	count, total := l.QueueWait()
+	if count != 1 || total < 10*time.Millisecond {
+		t.Errorf("QueueWait() = %d, %v; want 1 wait of at least 10ms", count, total)
+	}
+}
+
+func TestMetrics_Queue(t *testing.T) {
+	srv := newTestServer(t, config.DefaultConfig(), nil)
+
+	rec := httptest.NewRecorder()
+	srv.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{"sockstream_requests_queued 0", "sockstream_queue_wait_seconds_count 0"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics missing %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+func TestMetrics_RetryBudget(t *testing.T) {
+	pool, err := proxy.NewProxyPool(config.ProxyConfig{
+		RetryBudget: config.RetryBudgetConfig{Percent: 10},
+	})
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	srv := newTestServer(t, config.DefaultConfig(), pool)
+
+	rec := httptest.NewRecorder()
+	srv.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{"sockstream_retry_budget_requests 0", "sockstream_retry_budget_retries 0", "sockstream_retry_budget_exhausted_total 0"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics missing %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+func TestPerIPLimiter(t *testing.T) {
+	l := newPerIPLimiter(2)
+	if !l.acquire("10.0.0.1") || !l.acquire("10.0.0.1") {
+		t.Fatal("first two requests should get a slot")
+	}
+	if l.acquire("10.0.0.1") {
+		t.Error("third concurrent request should be refused")
+	}
+	if !l.acquire("10.0.0.2") {
+		t.Error("other clients should not be affected")
+	}
+
+	l.release("10.0.0.1")
+	l.release("10.0.0.1")
+	l.release("10.0.0.2")
+	if len(l.active) != 0 {
+		t.Errorf("active = %v, want empty after release", l.active)
+	}
+}
+
+func TestPerIPConcurrencyMiddleware(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := perIPConcurrencyMiddleware(1, nil, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			close(started)
+			<-release
+		}
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "/block", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		wantStatus int
+	}{
+		{name: "same client over limit", remoteAddr: "10.0.0.1:5678", wantStatus: http.StatusTooManyRequests},
+		{name: "other client", remoteAddr: "10.0.0.2:1234", wantStatus: http.StatusOK},
+		{name: "spoofed forwarded for", remoteAddr: "10.0.0.1:5678", xff: "203.0.113.9", wantStatus: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	close(release)
+	<-done
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status after release = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestTrustedClientIP(t *testing.T) {
+	trusted, err := parseCIDRs("trusted_proxies", []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{name: "untrusted peer ignores header", remoteAddr: "203.0.113.5:1234", xff: "198.51.100.1", want: "203.0.113.5"},
+		{name: "trusted peer names client", remoteAddr: "10.0.0.1:1234", xff: "198.51.100.1", want: "198.51.100.1"},
+		{name: "spoofed entries left of the client", remoteAddr: "10.0.0.1:1234", xff: "192.0.2.7, 198.51.100.1", want: "198.51.100.1"},
+		{name: "trusted hops skipped", remoteAddr: "10.0.0.1:1234", xff: "198.51.100.1, 10.0.0.2", want: "198.51.100.1"},
+		{name: "trusted peer without header", remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := trustedClientIP(req, trusted).String(); got != tt.want {
+				t.Errorf("trustedClientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPerIPConcurrencyMiddleware_TrustedProxies(t *testing.T) {
+	trusted, err := parseCIDRs("trusted_proxies", []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := perIPConcurrencyMiddleware(1, trusted, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			close(started)
+			<-release
+		}
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "/block", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "198.51.100.1")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+	defer func() {
+		close(release)
+		<-done
+	}()
+
+	tests := []struct {
+		name       string
+		xff        string
+		wantStatus int
+	}{
+		{name: "same client behind balancer", xff: "198.51.100.1", wantStatus: http.StatusTooManyRequests},
+		{name: "other client behind balancer", xff: "198.51.100.2", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "10.0.0.1:5678"
+			req.Header.Set("X-Forwarded-For", tt.xff)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
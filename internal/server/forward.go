@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/errorpage"
+	"github.com/foxzi/SockStream/internal/proxy"
+)
+
+// forwardHandler serves clients that use sockstream as their HTTP proxy.
+// CONNECT requests are tunnelled through the pool's dialer; absolute-form
+// requests are sent through the pool as plain HTTP.
+type forwardHandler struct {
+	cfg    config.ForwardConfig
+	pool   *proxy.ProxyPool
+	logger *slog.Logger
+	pages  *errorpage.Pages
+	http   *httputil.ReverseProxy
+}
+
+func newForwardHandler(cfg config.ForwardConfig, pool *proxy.ProxyPool, logger *slog.Logger, pages *errorpage.Pages) *forwardHandler {
+	h := &forwardHandler{cfg: cfg, pool: pool, logger: logger, pages: pages}
+	h.http = &httputil.ReverseProxy{
+		// The outgoing request already carries the absolute URL; hop-by-hop
+		// headers such as Proxy-Authorization are stripped by ReverseProxy
+		Rewrite: func(pr *httputil.ProxyRequest) {},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			h.dialError(w, r, err)
+		},
+	}
+	if pool != nil {
+		h.http.Transport = pool
+		h.http.BufferPool = pool.BufferPool()
+	}
+	return h
+}
+
+// forwardRouter sends proxy requests to fwd and everything else, such as
+// /healthz or /metrics, to mux.
+func forwardRouter(fwd, mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || r.URL.IsAbs() {
+			fwd.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (h *forwardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="sockstream"`)
+		h.pages.Error(w, r, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	if h.pool == nil {
+		h.pages.Error(w, r, "no upstream proxy pool configured", http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case r.Method == http.MethodConnect:
+		h.connect(w, r)
+	case r.URL.IsAbs():
+		h.http.ServeHTTP(w, r)
+	default:
+		h.pages.Error(w, r, "forward proxy requires an absolute request URI", http.StatusBadRequest)
+	}
+}
+
+// authorized checks Proxy-Authorization basic credentials when a username is configured.
+func (h *forwardHandler) authorized(r *http.Request) bool {
+	if h.cfg.Username == "" {
+		return true
+	}
+	encoded, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(h.cfg.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(h.cfg.Password)) == 1
+	return userOK && passOK
+}
+
+func (h *forwardHandler) connect(w http.ResponseWriter, r *http.Request) {
+	addr := r.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+
+	upstream, err := h.pool.DialContext(r.Context(), "tcp", addr)
+	if err != nil {
+		h.dialError(w, r, err)
+		return
+	}
+
+	client, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		upstream.Close()
+		h.logger.Error("connect hijack failed", "error", err)
+		h.pages.Error(w, r, "connect not supported", http.StatusInternalServerError)
+		return
+	}
+	// The tunnel outlives the server's read/write timeouts
+	_ = client.SetDeadline(time.Time{})
+
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	if n := buf.Reader.Buffered(); n > 0 {
+		pending, _ := buf.Reader.Peek(n)
+		if _, err := upstream.Write(pending); err != nil {
+			client.Close()
+			upstream.Close()
+			return
+		}
+	}
+	tunnel(client, upstream)
+}
+
+func (h *forwardHandler) dialError(w http.ResponseWriter, r *http.Request, err error) {
+	if proxy.ClientGone(r) {
+		h.logger.Debug("forward client cancelled request", "error", err, "host", r.Host)
+		return
+	}
+	h.logger.Error("forward proxy error", "error", err, "host", r.Host)
+	status, msg := proxy.ErrorStatus(err)
+	h.pages.Error(w, r, msg, status)
+}
+
+// tunnel copies data both ways until either side is done, then closes both.
+func tunnel(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		// Unblock the opposite copy
+		_ = dst.Close()
+		_ = src.Close()
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+}
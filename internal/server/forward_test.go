@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/proxy"
+)
+
+func newForwardServer(t *testing.T, cfg config.Config) *httptest.Server {
+	t.Helper()
+	cfg.Mode = "forward"
+	pool, err := proxy.NewProxyPool(cfg.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, cfg, pool)
+	ts := httptest.NewServer(srv.handler)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestForwardMode_Connect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	ts := newForwardServer(t, config.DefaultConfig())
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	target := echo.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("tunnel echo = %q, want ping", got)
+	}
+}
+
+func TestForwardMode_Requests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization leaked to the target")
+		}
+		_, _ = io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Forward = config.ForwardConfig{Username: "alice", Password: "secret"}
+	cfg.Access.BlockUserAgents = []string{"^blocked$"}
+	ts := newForwardServer(t, cfg)
+	proxyURL, _ := url.Parse(ts.URL)
+
+	basic := func(user, pass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+
+	tests := []struct {
+		name       string
+		url        string
+		auth       string
+		userAgent  string
+		wantStatus int
+	}{
+		{name: "missing credentials", url: backend.URL, wantStatus: http.StatusProxyAuthRequired},
+		{name: "wrong password", url: backend.URL, auth: basic("alice", "nope"), wantStatus: http.StatusProxyAuthRequired},
+		{name: "authorized", url: backend.URL, auth: basic("alice", "secret"), wantStatus: http.StatusOK},
+		{name: "access rules still apply", url: backend.URL, auth: basic("alice", "secret"), userAgent: "blocked", wantStatus: http.StatusForbidden},
+		{name: "local endpoints served", url: ts.URL + "/healthz", wantStatus: http.StatusOK},
+		{name: "origin-form rejected", url: ts.URL + "/", auth: basic("alice", "secret"), wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+			// Requests for the proxy itself must not go through the proxy
+			if u, _ := url.Parse(tt.url); u.Host == proxyURL.Host {
+				client = &http.Client{}
+			}
+			req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.auth != "" {
+				req.Header.Set("Proxy-Authorization", tt.auth)
+			}
+			if tt.userAgent != "" {
+				req.Header.Set("User-Agent", tt.userAgent)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+				t.Error("missing Proxy-Authenticate header")
+			}
+		})
+	}
+}
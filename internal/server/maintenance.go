@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+// maintenanceMode answers proxied requests with a fixed response while
+// enabled, letting allowlisted clients through to verify the backend.
+type maintenanceMode struct {
+	enabled atomic.Bool
+	cfg     config.MaintenanceConfig
+	allow   *AccessControl
+}
+
+func newMaintenanceMode(cfg config.MaintenanceConfig) (*maintenanceMode, error) {
+	m := &maintenanceMode{cfg: cfg}
+	if cfg.StatusCode == 0 {
+		m.cfg.StatusCode = http.StatusServiceUnavailable
+	}
+	if len(cfg.AllowCIDRs) > 0 {
+		ac, err := NewAccessControl(config.AccessConfig{AllowCIDRs: cfg.AllowCIDRs})
+		if err != nil {
+			return nil, fmt.Errorf("maintenance: %w", err)
+		}
+		m.allow = ac
+	}
+	m.enabled.Store(cfg.Enabled)
+	return m, nil
+}
+
+func (m *maintenanceMode) bypass(r *http.Request) bool {
+	return m.allow != nil && m.allow.Allowed(peerIP(r))
+}
+
+func maintenanceMiddleware(m *maintenanceMode) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !m.enabled.Load() || m.bypass(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if m.cfg.ContentType != "" {
+				w.Header().Set("Content-Type", m.cfg.ContentType)
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(m.cfg.StatusCode)
+			_, _ = w.Write([]byte(m.cfg.Body))
+		})
+	}
+}
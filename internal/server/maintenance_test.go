@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        config.MaintenanceConfig
+		remoteAddr string
+		xff        string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "disabled forwards",
+			cfg:        config.MaintenanceConfig{Enabled: false, StatusCode: 503, Body: "down"},
+			remoteAddr: "203.0.113.5:1234",
+			path:       "/",
+			wantStatus: http.StatusOK,
+			wantBody:   "backend",
+		},
+		{
+			name:       "enabled serves maintenance response",
+			cfg:        config.MaintenanceConfig{Enabled: true, StatusCode: 503, Body: "down"},
+			remoteAddr: "203.0.113.5:1234",
+			path:       "/",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "down",
+		},
+		{
+			name:       "allowlisted client reaches backend",
+			cfg:        config.MaintenanceConfig{Enabled: true, StatusCode: 503, Body: "down", AllowCIDRs: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.1.2.3:1234",
+			path:       "/",
+			wantStatus: http.StatusOK,
+			wantBody:   "backend",
+		},
+		{
+			name:       "non-allowlisted client blocked",
+			cfg:        config.MaintenanceConfig{Enabled: true, StatusCode: 503, Body: "down", AllowCIDRs: []string{"10.0.0.0/8"}},
+			remoteAddr: "203.0.113.5:1234",
+			path:       "/",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "down",
+		},
+		{
+			name:       "forwarded header does not bypass",
+			cfg:        config.MaintenanceConfig{Enabled: true, StatusCode: 503, Body: "down", AllowCIDRs: []string{"10.0.0.0/8"}},
+			remoteAddr: "203.0.113.5:1234",
+			xff:        "10.1.2.3",
+			path:       "/",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "down",
+		},
+		{
+			name:       "health endpoint unaffected",
+			cfg:        config.MaintenanceConfig{Enabled: true, StatusCode: 503, Body: "down"},
+			remoteAddr: "203.0.113.5:1234",
+			path:       "/healthz",
+			wantStatus: http.StatusOK,
+			wantBody:   "ok",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.Maintenance = tt.cfg
+			backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("backend"))
+			})
+			srv, err := New(cfg, discardLogger(), backend, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			rec := httptest.NewRecorder()
+			srv.handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestServer_SetMaintenance(t *testing.T) {
+	srv := newTestServer(t, config.DefaultConfig(), nil)
+
+	get := func() int {
+		rec := httptest.NewRecorder()
+		srv.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Code
+	}
+	if got := get(); got != http.StatusOK {
+		t.Fatalf("status before = %d", got)
+	}
+	srv.SetMaintenance(true)
+	if got := get(); got != http.StatusServiceUnavailable {
+		t.Errorf("status in maintenance = %d, want 503", got)
+	}
+	srv.SetMaintenance(false)
+	if got := get(); got != http.StatusOK {
+		t.Errorf("status after = %d, want 200", got)
+	}
+}
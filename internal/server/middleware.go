@@ -3,31 +3,87 @@ package server
 import (
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"sockstream/internal/config"
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/errorpage"
+	"github.com/foxzi/SockStream/internal/proxy"
 )
 
 type middleware func(http.Handler) http.Handler
 
-func loggingMiddleware(logger *slog.Logger) middleware {
+func loggingMiddleware(logger *slog.Logger, cfg config.Logging) middleware {
+	slow := time.Duration(cfg.SlowThresholdMs) * time.Millisecond
+	sampler := newLogSampler(cfg.SampleRate)
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := countBody(r)
 			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
 			start := time.Now()
 			next.ServeHTTP(rec, r)
-			logger.Info("request",
+			duration := time.Since(start)
+			status := rec.result(r)
+			var tag []any
+			if t := requestTag(r); t != "" {
+				tag = []any{"tag", t}
+			}
+			if slow > 0 && duration > slow {
+				logger.Warn("slow request", append([]any{
+					"method", r.Method,
+					"path", r.URL.Path,
+					"status", status,
+					"duration", duration,
+					"threshold", slow,
+					"bytes_in", body.count(),
+					"bytes_out", rec.bytes,
+				}, tag...)...)
+				return
+			}
+			if status < http.StatusInternalServerError && !sampler.sample(status) {
+				return
+			}
+			logger.Info("request", append([]any{
 				"method", r.Method,
 				"url", r.URL.String(),
-				"status", rec.status,
-				"duration", time.Since(start),
-			)
+				"status", status,
+				"duration", duration,
+				"bytes_in", body.count(),
+				"bytes_out", rec.bytes,
+			}, tag...)...)
 		})
 	}
 }
 
+// logSampler keeps 1 in rate requests, counting each status code separately
+// so rare statuses are not drowned out by common ones.
+type logSampler struct {
+	rate   uint64
+	counts [600]atomic.Uint64
+}
+
+func newLogSampler(rate int) *logSampler {
+	if rate <= 1 {
+		return nil
+	}
+	return &logSampler{rate: uint64(rate)}
+}
+
+// sample reports whether a request with status should be logged. The first
+// request of every status is always kept.
+func (s *logSampler) sample(status int) bool {
+	if s == nil {
+		return true
+	}
+	if status < 0 || status >= len(s.counts) {
+		status = 0
+	}
+	return (s.counts[status].Add(1)-1)%s.rate == 0
+}
+
 func corsMiddleware(cfg config.CORSConfig) middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -56,7 +112,7 @@ func corsMiddleware(cfg config.CORSConfig) middleware {
 				w.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%d", cfg.MaxAgeSeconds))
 			}
 
-			if r.Method == http.MethodOptions {
+			if r.Method == http.MethodOptions && (!cfg.PassthroughOptions || isPreflight(r)) {
 				w.WriteHeader(http.StatusNoContent)
 				return
 			}
@@ -66,15 +122,117 @@ func corsMiddleware(cfg config.CORSConfig) middleware {
 	}
 }
 
-func accessMiddleware(ac *AccessControl) middleware {
+// isPreflight reports whether an OPTIONS request is a CORS preflight.
+func isPreflight(r *http.Request) bool {
+	return r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// securityHeadersMiddleware adds the configured headers to responses that
+// do not carry them already; the target's own values are kept.
+func securityHeadersMiddleware(cfg config.SecurityHeadersConfig) middleware {
+	return func(next http.Handler) http.Handler {
+		if !cfg.Enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			headers := make([][2]string, 0, 4)
+			if cfg.HSTS != "" && r.TLS != nil {
+				headers = append(headers, [2]string{"Strict-Transport-Security", cfg.HSTS})
+			}
+			if cfg.ContentTypeOptions != "" {
+				headers = append(headers, [2]string{"X-Content-Type-Options", cfg.ContentTypeOptions})
+			}
+			if cfg.FrameOptions != "" {
+				headers = append(headers, [2]string{"X-Frame-Options", cfg.FrameOptions})
+			}
+			if cfg.ReferrerPolicy != "" {
+				headers = append(headers, [2]string{"Referrer-Policy", cfg.ReferrerPolicy})
+			}
+			sw := &securityHeaderWriter{ResponseWriter: w, headers: headers}
+			next.ServeHTTP(sw, r)
+			// A handler that writes nothing gets its response sent by net/http
+			sw.apply()
+		})
+	}
+}
+
+// securityHeaderWriter adds headers just before the response goes out, once
+// the proxied response's headers are known.
+type securityHeaderWriter struct {
+	http.ResponseWriter
+	headers [][2]string
+	applied bool
+}
+
+func (w *securityHeaderWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	h := w.Header()
+	for _, kv := range w.headers {
+		if len(h.Values(kv[0])) == 0 {
+			h.Set(kv[0], kv[1])
+		}
+	}
+}
+
+func (w *securityHeaderWriter) WriteHeader(status int) {
+	// 1xx responses other than 101 may precede the final one
+	if status >= http.StatusOK || status == http.StatusSwitchingProtocols {
+		w.apply()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *securityHeaderWriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *securityHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func accessMiddleware(ac *AccessControl, pages *errorpage.Pages) middleware {
+	status, msg := http.StatusForbidden, "forbidden"
+	if ac != nil {
+		status, msg = ac.deniedResponse()
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if ac == nil {
 				next.ServeHTTP(w, r)
 				return
 			}
-			if ip := clientIP(r); !ac.Allowed(ip) {
-				http.Error(w, "forbidden", http.StatusForbidden)
+			if !ac.AllowedRequest(r) {
+				pages.Error(w, r, msg, status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// serviceAccessMiddleware limits the service endpoints to clients in allow.
+// With mux set, only requests routed to a pattern other than the proxied "/"
+// are checked; without it every request is. The peer address is checked, not
+// X-Forwarded-For. An empty allow list disables it.
+func serviceAccessMiddleware(allow []*net.IPNet, mux *http.ServeMux, pages *errorpage.Pages) middleware {
+	if len(allow) == 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if mux != nil {
+				if _, pattern := mux.Handler(r); pattern == "/" {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			if !allowedBy(allow, nil, peerIP(r)) {
+				pages.Error(w, r, "forbidden", http.StatusForbidden)
 				return
 			}
 			next.ServeHTTP(w, r)
@@ -82,16 +240,206 @@ func accessMiddleware(ac *AccessControl) middleware {
 	}
 }
 
+// grpcStreamMiddleware lifts the server read and write timeouts for gRPC
+// calls, whose streams may stay open far longer. enabled is false outside
+// grpc mode.
+func grpcStreamMiddleware(enabled bool) middleware {
+	if !enabled {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if proxy.IsGRPC(r.Header) {
+				rc := http.NewResponseController(w)
+				_ = rc.SetReadDeadline(time.Time{})
+				_ = rc.SetWriteDeadline(time.Time{})
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// streamDeadlineMiddleware keeps long-lived responses from being cut off by
+// the server's read and write timeouts. Event streams have both lifted, as
+// gRPC calls do; other responses of unknown length have them pushed back by
+// timeout as data is written, so a stream lives while it makes progress.
+func streamDeadlineMiddleware(timeout time.Duration) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&streamWriter{ResponseWriter: w, rc: http.NewResponseController(w), timeout: timeout}, r)
+		})
+	}
+}
+
+// streamWriter moves the connection deadlines once it sees what kind of
+// response is being written.
+type streamWriter struct {
+	http.ResponseWriter
+	rc          *http.ResponseController
+	timeout     time.Duration
+	wroteHeader bool
+	// extend is set for responses of unknown length; extended is when the
+	// deadlines were last moved
+	extend   bool
+	extended time.Time
+}
+
+func (w *streamWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= http.StatusOK {
+		w.wroteHeader = true
+		h := w.Header()
+		switch {
+		case strings.HasPrefix(strings.ToLower(h.Get("Content-Type")), "text/event-stream"):
+			_ = w.rc.SetReadDeadline(time.Time{})
+			_ = w.rc.SetWriteDeadline(time.Time{})
+		case h.Get("Content-Length") == "" && status != http.StatusNoContent && status != http.StatusNotModified:
+			w.extend = true
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	// Moving the deadlines is cheap but not free; once a second is plenty
+	if now := time.Now(); w.extend && now.Sub(w.extended) >= time.Second {
+		w.extended = now
+		_ = w.rc.SetReadDeadline(now.Add(w.timeout))
+		_ = w.rc.SetWriteDeadline(now.Add(w.timeout))
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func userAgentMiddleware(f *UserAgentFilter, pages *errorpage.Pages) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if f == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !f.Allowed(r.UserAgent()) {
+				pages.Error(w, r, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func headerLimitMiddleware(maxBytes int, logger *slog.Logger, pages *errorpage.Pages) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if maxBytes <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if size := requestHeaderSize(r); size > maxBytes {
+				logger.Warn("request header too large",
+					"client", clientIP(r).String(),
+					"size", size,
+					"limit", maxBytes,
+				)
+				pages.Error(w, r, "request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func headerCountMiddleware(maxCount int, logger *slog.Logger, pages *errorpage.Pages) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if maxCount <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if count := requestHeaderCount(r); count > maxCount {
+				logger.Warn("too many request headers",
+					"client", clientIP(r).String(),
+					"count", count,
+					"limit", maxCount,
+				)
+				pages.Error(w, r, "request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestHeaderCount counts header lines; repeated names count once per value.
+func requestHeaderCount(r *http.Request) int {
+	count := 0
+	for _, values := range r.Header {
+		count += len(values)
+	}
+	return count
+}
+
+// requestHeaderSize approximates the wire size of the request line and headers.
+func requestHeaderSize(r *http.Request) int {
+	size := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	size += len("Host: ") + len(r.Host) + 2
+	for k, values := range r.Header {
+		for _, v := range values {
+			size += len(k) + len(v) + 4
+		}
+	}
+	return size
+}
+
+// statusClientClosed is recorded, as nginx does, for requests whose client
+// went away before any response was written.
+const statusClientClosed = 499
+
 type statusRecorder struct {
 	http.ResponseWriter
 	status int
+	// bytes counts the body bytes written
+	bytes   int64
+	written bool
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.written = true
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
 }
 
 func (r *statusRecorder) WriteHeader(status int) {
+	r.written = true
 	r.status = status
 	r.ResponseWriter.WriteHeader(status)
 }
 
+// result returns the status to record for req: the one written, or
+// statusClientClosed when the client left before anything was.
+func (r *statusRecorder) result(req *http.Request) int {
+	if !r.written && proxy.ClientGone(req) {
+		return statusClientClosed
+	}
+	return r.status
+}
+
+// Flush lets streaming responses (SSE) pass through the recorder unbuffered.
+func (r *statusRecorder) Flush() {
+	_ = http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func originAllowed(allowed []string, origin string) bool {
 	if len(allowed) == 0 {
 		return false
@@ -0,0 +1,439 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/proxy"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestHeaderLimitMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBytes   int
+		headerSize int
+		wantStatus int
+		wantCalled bool
+	}{
+		{
+			name:       "disabled",
+			maxBytes:   0,
+			headerSize: 8192,
+			wantStatus: http.StatusOK,
+			wantCalled: true,
+		},
+		{
+			name:       "within limit",
+			maxBytes:   1024,
+			headerSize: 100,
+			wantStatus: http.StatusOK,
+			wantCalled: true,
+		},
+		{
+			name:       "oversized header rejected",
+			maxBytes:   1024,
+			headerSize: 2048,
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+			wantCalled: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				w.WriteHeader(http.StatusOK)
+			})
+			h := headerLimitMiddleware(tt.maxBytes, discardLogger(), nil)(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Large", strings.Repeat("a", tt.headerSize))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("next called = %v, want %v", called, tt.wantCalled)
+			}
+		})
+	}
+}
+
+func TestHeaderLimitMiddleware_EarlyRejectOverWire(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	srv := httptest.NewServer(headerLimitMiddleware(512, discardLogger(), nil)(next))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		req.Header.Add("X-Filler", strings.Repeat("b", 64))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	}
+	if called {
+		t.Error("handler should not be reached for oversized headers")
+	}
+}
+
+func TestHeaderCountMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxCount   int
+		headers    int
+		wantStatus int
+	}{
+		{name: "disabled", maxCount: 0, headers: 500, wantStatus: http.StatusOK},
+		{name: "within limit", maxCount: 50, headers: 50, wantStatus: http.StatusOK},
+		{name: "too many headers", maxCount: 50, headers: 51, wantStatus: http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			h := headerCountMiddleware(tt.maxCount, discardLogger(), nil)(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			// Repeated names count once per value
+			for i := 0; i < tt.headers; i++ {
+				req.Header.Add("X-Filler", "a")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	full := config.SecurityHeadersConfig{
+		Enabled:            true,
+		HSTS:               "max-age=31536000",
+		ContentTypeOptions: "nosniff",
+		FrameOptions:       "DENY",
+		ReferrerPolicy:     "no-referrer",
+	}
+
+	tests := []struct {
+		name string
+		cfg  config.SecurityHeadersConfig
+		tls  bool
+		want map[string]string
+	}{
+		{
+			name: "disabled",
+			cfg:  config.SecurityHeadersConfig{HSTS: "max-age=1", ContentTypeOptions: "nosniff"},
+			tls:  true,
+			want: map[string]string{"Strict-Transport-Security": "", "X-Content-Type-Options": ""},
+		},
+		{
+			name: "all headers over tls",
+			cfg:  full,
+			tls:  true,
+			want: map[string]string{
+				"Strict-Transport-Security": "max-age=31536000",
+				"X-Content-Type-Options":    "nosniff",
+				"X-Frame-Options":           "DENY",
+				"Referrer-Policy":           "no-referrer",
+			},
+		},
+		{
+			name: "no hsts over plain http",
+			cfg:  full,
+			tls:  false,
+			want: map[string]string{"Strict-Transport-Security": "", "X-Content-Type-Options": "nosniff"},
+		},
+		{
+			name: "empty value disables header",
+			cfg:  config.SecurityHeadersConfig{Enabled: true, ContentTypeOptions: "nosniff"},
+			tls:  true,
+			want: map[string]string{"Strict-Transport-Security": "", "X-Frame-Options": "", "X-Content-Type-Options": "nosniff"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := securityHeadersMiddleware(tt.cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			for k, want := range tt.want {
+				if got := rec.Header().Get(k); got != want {
+					t.Errorf("%s = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersMiddleware_KeepsTargetHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL)
+	cfg := config.DefaultConfig()
+	cfg.Target = backend.URL
+	cfg.SecurityHeaders = config.SecurityHeadersConfig{Enabled: true, ContentTypeOptions: "nosniff", FrameOptions: "DENY"}
+	srv, err := New(cfg, discardLogger(), proxy.NewReverseProxy(target, cfg, nil, discardLogger()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := rec.Header().Values("X-Frame-Options"); len(got) != 1 || got[0] != "SAMEORIGIN" {
+		t.Errorf("X-Frame-Options = %q, want the target's SAMEORIGIN only", got)
+	}
+	if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+	}
+}
+
+func TestCORSMiddleware_Options(t *testing.T) {
+	tests := []struct {
+		name        string
+		passthrough bool
+		preflight   bool
+		wantStatus  int
+		wantCalled  bool
+	}{
+		{name: "default short-circuits plain options", passthrough: false, preflight: false, wantStatus: http.StatusNoContent, wantCalled: false},
+		{name: "default short-circuits preflight", passthrough: false, preflight: true, wantStatus: http.StatusNoContent, wantCalled: false},
+		{name: "passthrough forwards plain options", passthrough: true, preflight: false, wantStatus: http.StatusOK, wantCalled: true},
+		{name: "passthrough still answers preflight", passthrough: true, preflight: true, wantStatus: http.StatusNoContent, wantCalled: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				w.WriteHeader(http.StatusOK)
+			})
+			cfg := config.CORSConfig{AllowedOrigins: []string{"*"}, PassthroughOptions: tt.passthrough}
+			h := corsMiddleware(cfg)(next)
+
+			req := httptest.NewRequest(http.MethodOptions, "/dav/", nil)
+			req.Header.Set("Origin", "https://app.example.com")
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", "PUT")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("next called = %v, want %v", called, tt.wantCalled)
+			}
+		})
+	}
+}
+
+func TestLoggingMiddleware_SlowThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		delay     time.Duration
+		wantLevel string
+	}{
+		{name: "disabled", threshold: 0, delay: 20 * time.Millisecond, wantLevel: "level=INFO"},
+		{name: "fast request", threshold: 1000, delay: 0, wantLevel: "level=INFO"},
+		{name: "slow request", threshold: 5, delay: 20 * time.Millisecond, wantLevel: "level=WARN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&out, nil))
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.delay)
+			})
+			h := loggingMiddleware(logger, config.Logging{SlowThresholdMs: tt.threshold})(next)
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+
+			if !strings.Contains(out.String(), tt.wantLevel) {
+				t.Errorf("log = %q, want %s", out.String(), tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestLoggingMiddleware_ClientGone(t *testing.T) {
+	tests := []struct {
+		name       string
+		write      bool
+		wantStatus string
+	}{
+		{name: "nothing written", wantStatus: "status=499"},
+		{name: "response written first", write: true, wantStatus: "status=502"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&out, nil))
+			ctx, cancel := context.WithCancel(context.Background())
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.write {
+					w.WriteHeader(http.StatusBadGateway)
+				}
+				cancel()
+			})
+			h := loggingMiddleware(logger, config.Logging{})(next)
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+
+			if !strings.Contains(out.String(), tt.wantStatus) {
+				t.Errorf("log = %q, want %s", out.String(), tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	if s := newLogSampler(1); !s.sample(200) {
+		t.Error("rate 1 should log everything")
+	}
+
+	s := newLogSampler(3)
+	logged := 0
+	for i := 0; i < 9; i++ {
+		if s.sample(200) {
+			logged++
+		}
+	}
+	if logged != 3 {
+		t.Errorf("logged %d of 9 requests at rate 3, want 3", logged)
+	}
+	if !s.sample(404) {
+		t.Error("first request of a new status should be logged")
+	}
+}
+
+func TestLoggingMiddleware_Sampling(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, nil))
+	status := http.StatusOK
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	h := loggingMiddleware(logger, config.Logging{SampleRate: 10})(next)
+
+	for i := 0; i < 10; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	status = http.StatusBadGateway
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	if got := strings.Count(out.String(), "status=200"); got != 1 {
+		t.Errorf("logged %d successful requests, want 1", got)
+	}
+	if got := strings.Count(out.String(), "status=502"); got != 3 {
+		t.Errorf("logged %d server errors, want all 3", got)
+	}
+}
+
+func TestServer_ErrorPages(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Access.BlockCIDRs = []string{"10.0.0.0/8"}
+	cfg.ErrorPages = config.ErrorPagesConfig{
+		ContentType: "application/json",
+		Pages:       map[string]string{"403": `{"error":"{{.Message}}","status":{{.Status}}}`},
+	}
+	srv := newTestServer(t, cfg, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	rec := httptest.NewRecorder()
+	srv.handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if want := `{"error":"forbidden","status":403}`; rec.Body.String() != want {
+		t.Errorf("body = %q, want %q", rec.Body.String(), want)
+	}
+}
+
+func TestServer_ErrorPagesHeaderLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits func(*config.LimitsConfig)
+	}{
+		{name: "header count", limits: func(l *config.LimitsConfig) { l.MaxHeaderCount = 10 }},
+		{name: "header bytes", limits: func(l *config.LimitsConfig) { l.MaxHeaderBytes = 256 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			tt.limits(&cfg.Limits)
+			cfg.ErrorPages = config.ErrorPagesConfig{
+				ContentType: "application/json",
+				Default:     `{"status":{{.Status}}}`,
+			}
+			srv := newTestServer(t, cfg, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for i := 0; i < 20; i++ {
+				req.Header.Add("X-Filler", strings.Repeat("a", 20))
+			}
+			rec := httptest.NewRecorder()
+			srv.handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusRequestHeaderFieldsTooLarge {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestHeaderFieldsTooLarge)
+			}
+			if want := `{"status":431}`; rec.Body.String() != want {
+				t.Errorf("body = %q, want %q", rec.Body.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspRetryInterval   = 10 * time.Minute
+	ocspDefaultInterval = 12 * time.Hour
+)
+
+// ocspStapler serves a certificate with a stapled OCSP response and
+// refreshes the response before it expires.
+type ocspStapler struct {
+	cert   atomic.Pointer[tls.Certificate]
+	client *http.Client
+	logger *slog.Logger
+	now    func() time.Time
+	kick   chan struct{}
+
+	mu     sync.Mutex
+	leaf   *x509.Certificate
+	issuer *x509.Certificate
+}
+
+func newOCSPStapler(cert tls.Certificate, logger *slog.Logger) (*ocspStapler, error) {
+	s := &ocspStapler{
+		client: &http.Client{Timeout: 15 * time.Second},
+		logger: logger,
+		now:    time.Now,
+		kick:   make(chan struct{}, 1),
+	}
+	if err := s.setCertificate(cert); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ocspStapler) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// setCertificate replaces the served certificate and schedules an immediate
+// OCSP fetch for it. The new certificate is served without a staple until then.
+func (s *ocspStapler) setCertificate(cert tls.Certificate) error {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	var issuer *x509.Certificate
+	if len(cert.Certificate) > 1 {
+		var err error
+		if issuer, err = x509.ParseCertificate(cert.Certificate[1]); err != nil {
+			return fmt.Errorf("parse issuer certificate: %w", err)
+		}
+	}
+	cert.OCSPStaple = nil
+
+	s.mu.Lock()
+	s.leaf, s.issuer = leaf, issuer
+	s.cert.Store(&cert)
+	s.mu.Unlock()
+
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start fetches responses in the background and keeps them fresh until ctx
+// is done. Handshakes get no staple until the first fetch succeeds, so a
+// slow or unreachable responder does not hold up startup. Certificates
+// without an issuer in the chain or an OCSP server are served without a
+// staple.
+func (s *ocspStapler) Start(ctx context.Context) {
+	go func() {
+		// setCertificate has already kicked off the first fetch
+		timer := time.NewTimer(ocspDefaultInterval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.kick:
+			case <-timer.C:
+			}
+			timer.Reset(s.refresh(ctx))
+		}
+	}()
+}
+
+// refresh fetches and staples a new response, returning when to refresh next.
+func (s *ocspStapler) refresh(ctx context.Context) time.Duration {
+	s.mu.Lock()
+	leaf, issuer := s.leaf, s.issuer
+	s.mu.Unlock()
+	if issuer == nil || len(leaf.OCSPServer) == 0 {
+		s.logger.Warn("ocsp stapling skipped: certificate has no issuer chain or ocsp server")
+		return ocspDefaultInterval
+	}
+
+	resp, raw, err := s.fetch(ctx, leaf, issuer)
+	if err != nil {
+		s.logger.Warn("failed to fetch ocsp response", "error", err)
+		return ocspRetryInterval
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The certificate was replaced while fetching; its own refresh is queued
+	if s.leaf != leaf {
+		return ocspRetryInterval
+	}
+	cert := *s.cert.Load()
+	cert.OCSPStaple = raw
+	s.cert.Store(&cert)
+	s.logger.Debug("ocsp response stapled", "next_update", resp.NextUpdate)
+	return nextOCSPRefresh(resp, s.now())
+}
+
+func (s *ocspStapler) fetch(ctx context.Context, leaf, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	body, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	httpResp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("ocsp responder returned status %d", httpResp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Status != ocsp.Good {
+		return nil, nil, errors.New("ocsp status is not good")
+	}
+	return resp, raw, nil
+}
+
+// nextOCSPRefresh schedules the refresh halfway through the response's
+// validity window.
+func nextOCSPRefresh(resp *ocsp.Response, now time.Time) time.Duration {
+	if resp.NextUpdate.IsZero() {
+		return ocspDefaultInterval
+	}
+	next := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	if d := next.Sub(now); d > time.Minute {
+		return d
+	}
+	return time.Minute
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// newOCSPTestCert issues a leaf certificate whose OCSP responder answers with status.
+func newOCSPTestCert(t *testing.T, status int) tls.Certificate {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now,
+			NextUpdate:   now.Add(4 * time.Hour),
+			RevokedAt:    now,
+		}, caKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(responder.Close)
+
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		OCSPServer:   []string{responder.URL},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{leafDER, caDER}, PrivateKey: leafKey}
+}
+
+func TestOCSPStapler(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		wantStaple bool
+	}{
+		{name: "good response stapled", status: ocsp.Good, wantStaple: true},
+		{name: "revoked response not stapled", status: ocsp.Revoked, wantStaple: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newOCSPStapler(newOCSPTestCert(t, tt.status), discardLogger())
+			if err != nil {
+				t.Fatalf("newOCSPStapler() error = %v", err)
+			}
+			s.refresh(context.Background())
+
+			cert, _ := s.getCertificate(nil)
+			if got := len(cert.OCSPStaple) > 0; got != tt.wantStaple {
+				t.Errorf("stapled = %v, want %v", got, tt.wantStaple)
+			}
+		})
+	}
+}
+
+func TestOCSPStapler_SetCertificate(t *testing.T) {
+	s, err := newOCSPStapler(newOCSPTestCert(t, ocsp.Revoked), discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	if err := s.setCertificate(newOCSPTestCert(t, ocsp.Good)); err != nil {
+		t.Fatalf("setCertificate() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cert, _ := s.getCertificate(nil)
+		if len(cert.OCSPStaple) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replacement certificate was not stapled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOCSPStapler_StartDoesNotBlock(t *testing.T) {
+	s, err := newOCSPStapler(newOCSPTestCert(t, ocsp.Good), discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	s.client.Transport = blockingTransport(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	go func() {
+		s.Start(ctx)
+		close(started)
+	}()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Start() waited for the OCSP responder")
+	}
+	if cert, _ := s.getCertificate(nil); len(cert.OCSPStaple) > 0 {
+		t.Error("certificate stapled before the responder answered")
+	}
+}
+
+// blockingTransport holds every request until release is closed.
+type blockingTransport chan struct{}
+
+func (b blockingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	select {
+	case <-b:
+	case <-r.Context().Done():
+	}
+	return nil, errors.New("responder unavailable")
+}
+
+func TestNextOCSPRefresh(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		resp *ocsp.Response
+		want time.Duration
+	}{
+		{name: "no next update", resp: &ocsp.Response{ThisUpdate: now}, want: ocspDefaultInterval},
+		{name: "halfway through validity", resp: &ocsp.Response{ThisUpdate: now, NextUpdate: now.Add(48 * time.Hour)}, want: 24 * time.Hour},
+		{name: "past halfway", resp: &ocsp.Response{ThisUpdate: now.Add(-10 * time.Hour), NextUpdate: now.Add(time.Hour)}, want: time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextOCSPRefresh(tt.resp, now); got != tt.want {
+				t.Errorf("nextOCSPRefresh() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
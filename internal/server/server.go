@@ -2,112 +2,532 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 
-	"sockstream/internal/config"
+	"github.com/foxzi/SockStream/internal/acmedns"
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/errorpage"
+	"github.com/foxzi/SockStream/internal/proxy"
 )
 
 type Server struct {
 	cfg     config.Config
 	logger  *slog.Logger
 	handler http.Handler
+	access  *AccessControl
+	maint   *maintenanceMode
+	pool    *proxy.ProxyPool
+	// certs is set by Start when serving cert_file/key_file
+	certs atomic.Pointer[certReloader]
+	// listenerCerts holds the certificates of extra listeners with their own files
+	listenerCerts atomic.Pointer[[]*certReloader]
+	// admin serves the service endpoints on cfg.Admin.Listen; nil when disabled
+	admin http.Handler
 }
 
-func New(cfg config.Config, logger *slog.Logger, proxyHandler http.Handler) (*Server, error) {
+// New builds the server handler chain. pool may be nil when no proxy pool is used.
+func New(cfg config.Config, logger *slog.Logger, proxyHandler http.Handler, pool *proxy.ProxyPool) (*Server, error) {
 	ac, err := NewAccessControl(cfg.Access)
 	if err != nil {
 		return nil, err
 	}
+	uaf, err := NewUserAgentFilter(cfg.Access)
+	if err != nil {
+		return nil, err
+	}
+	maint, err := newMaintenanceMode(cfg.Maintenance)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := errorpage.New(cfg.ErrorPages)
+	if err != nil {
+		return nil, err
+	}
+	// Manual certificates take precedence over ACME in Start
+	if cfg.TLS.ACME.Enabled && !cfg.TLS.HasCertificates() {
+		if err := checkCacheDir(cfg.TLS.ACME.CacheDir); err != nil {
+			return nil, err
+		}
+	}
+	serviceAllow, err := parseCIDRs("health_allow", cfg.Access.HealthAllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parseCIDRs("trusted_proxies", cfg.Limits.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := newTagger(cfg.Tagging)
+	if err != nil {
+		return nil, err
+	}
+	traffic := &trafficCounter{}
+	limiter := newConcurrencyLimiter(cfg.Limits.MaxConcurrent, time.Duration(cfg.Limits.QueueTimeoutMs)*time.Millisecond)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
-	})
-	mux.Handle("/", proxyHandler)
+	registerHealth(mux, pool)
+	// Status, metrics and the admin API move to their own mux when the admin
+	// listener is enabled; health checks stay on both for load balancers
+	serviceMux := mux
+	var adminHandler http.Handler
+	if cfg.Admin.Listen != "" {
+		serviceMux = http.NewServeMux()
+		registerHealth(serviceMux, pool)
+		adminHandler = chain(serviceMux,
+			loggingMiddleware(logger, cfg.Logging),
+			serviceAccessMiddleware(serviceAllow, nil, pages),
+		)
+	}
+	serviceMux.HandleFunc("/status", statusHandler(pool))
+	serviceMux.HandleFunc("/metrics", metricsHandler(pool, limiter, tags, traffic))
+	serviceMux.HandleFunc("/version", versionHandler(time.Now()))
+	registerAdmin(serviceMux, cfg.Admin.Token, pool)
+	if cfg.Debug.Pprof {
+		registerPprof(serviceMux, cfg.Admin.Token)
+	}
+	forward := strings.EqualFold(cfg.Mode, "forward")
+	if forward {
+		proxyHandler = newForwardHandler(cfg.Forward, pool, logger, pages)
+	}
+	proxied := chain(proxyHandler,
+		trafficMiddleware(traffic),
+		grpcStreamMiddleware(strings.EqualFold(cfg.Mode, "grpc")),
+		streamDeadlineMiddleware(serverTimeout),
+		maintenanceMiddleware(maint),
+		// Before the limiters, so time spent queued counts against the deadline
+		clientTimeoutMiddleware(time.Duration(cfg.Limits.MaxClientTimeoutSeconds)*time.Second, pages),
+		perIPConcurrencyMiddleware(cfg.Limits.MaxConcurrentPerIP, trustedProxies, pages),
+		concurrencyMiddleware(limiter, pages),
+		responseBufferMiddleware(cfg.Streaming),
+	)
+	mux.Handle("/", proxied)
 
-	handler := chain(mux,
-		accessMiddleware(ac),
+	var root http.Handler = serviceAccessMiddleware(serviceAllow, mux, pages)(mux)
+	if forward {
+		root = forwardRouter(proxied, root)
+	}
+	handler := chain(root,
+		securityHeadersMiddleware(cfg.SecurityHeaders),
+		headerLimitMiddleware(cfg.Limits.MaxHeaderBytes, logger, pages),
+		headerCountMiddleware(cfg.Limits.MaxHeaderCount, logger, pages),
+		accessMiddleware(ac, pages),
+		userAgentMiddleware(uaf, pages),
 		corsMiddleware(cfg.CORS),
-		loggingMiddleware(logger),
+		degradedMiddleware(pool, cfg.Proxy.DegradedHeader),
+		taggingMiddleware(tags),
+		loggingMiddleware(logger, cfg.Logging),
 	)
 
 	return &Server{
 		cfg:     cfg,
 		logger:  logger,
 		handler: handler,
+		admin:   adminHandler,
+		access:  ac,
+		maint:   maint,
+		pool:    pool,
 	}, nil
 }
 
+// SetMaintenance turns maintenance mode on or off, logging changes.
+func (s *Server) SetMaintenance(enabled bool) {
+	if s.maint.enabled.Swap(enabled) != enabled {
+		s.logger.Info("maintenance mode changed", "enabled", enabled)
+	}
+}
+
+// Reload re-reads file-backed settings: the access allow/block files and the
+// TLS certificate.
+func (s *Server) Reload() {
+	if certs := s.certs.Load(); certs != nil {
+		certs.reloadWithLog()
+	}
+	if certs := s.listenerCerts.Load(); certs != nil {
+		for _, c := range *certs {
+			c.reloadWithLog()
+		}
+	}
+	if !s.access.HasFiles() {
+		return
+	}
+	if err := s.access.Reload(); err != nil {
+		s.logger.Error("failed to reload access lists", "error", err)
+		return
+	}
+	s.logger.Info("access lists reloaded")
+}
+
+func (s *Server) startReloadLoop(ctx context.Context) {
+	if s.cfg.Access.ReloadSeconds <= 0 || !s.access.HasFiles() {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(s.cfg.Access.ReloadSeconds) * time.Second)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.access.Reload(); err != nil {
+					s.logger.Error("failed to reload access lists", "error", err)
+				}
+			}
+		}
+	}()
+}
+
 func (s *Server) Start(ctx context.Context) error {
-	httpSrv := &http.Server{
-		Addr:         s.cfg.Listen,
-		Handler:      s.handler,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+	s.startReloadLoop(ctx)
+
+	httpSrv := s.newHTTPServer(s.cfg.Listen)
+
+	if s.cfg.TLS.HasCertificates() {
+		certs, err := newCertReloader(s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile, s.logger)
+		if err != nil {
+			return err
+		}
+		getCertificate := certs.getCertificate
+		if s.cfg.TLS.OCSPStapling {
+			stapler, err := newOCSPStapler(*certs.cert.Load(), s.logger)
+			if err != nil {
+				return err
+			}
+			certs.onChange = func(cert tls.Certificate) {
+				if err := stapler.setCertificate(cert); err != nil {
+					s.logger.Error("failed to update stapled certificate", "error", err)
+				}
+			}
+			stapler.Start(ctx)
+			getCertificate = stapler.getCertificate
+		}
+		certs.watch(ctx, time.Duration(s.cfg.TLS.CertReloadSeconds)*time.Second)
+		s.certs.Store(certs)
+		httpSrv.TLSConfig = &tls.Config{GetCertificate: getCertificate}
 	}
 
-	var acmeSrv *http.Server
-	if s.cfg.TLS.ACME.Enabled {
+	if s.cfg.TLS.ACME.Enabled && s.cfg.TLS.ACME.UsesDNS01() {
+		manager, err := acmedns.New(s.cfg.TLS.ACME, s.logger)
+		if err != nil {
+			return err
+		}
+		if err := manager.Start(ctx); err != nil {
+			return err
+		}
+		httpSrv.TLSConfig = manager.TLSConfig()
+	} else if s.cfg.TLS.ACME.Enabled {
 		manager := s.acmeManager()
 		httpSrv.TLSConfig = manager.TLSConfig()
 
-		acmeAddr := s.acmeAddr()
-		acmeSrv = &http.Server{
-			Addr:    acmeAddr,
-			Handler: manager.HTTPHandler(nil),
+		// A nil fallback keeps autocert's default 302 redirect for non-challenge requests
+		var fallback http.Handler
+		if s.cfg.TLS.RedirectHTTP {
+			fallback = httpsRedirectHandler(s.cfg.Listen, s.cfg.ExternalURL)
 		}
+		s.serveHTTP(ctx, "acme http", s.acmeAddr(), manager.HTTPHandler(fallback))
+	}
+	if s.cfg.TLS.RedirectHTTP && httpSrv.TLSConfig != nil && !s.acmeHTTP01() {
+		s.serveHTTP(ctx, "http redirect", s.redirectAddr(), httpsRedirectHandler(s.cfg.Listen, s.cfg.ExternalURL))
+	}
+
+	if s.cfg.Socks5.Listen != "" {
+		if err := s.startSocks5(ctx); err != nil {
+			return err
+		}
+	}
+
+	if httpSrv.TLSConfig != nil {
+		if err := applyTLSPolicy(httpSrv.TLSConfig, s.cfg.TLS); err != nil {
+			return err
+		}
+	}
+
+	servers := []*http.Server{httpSrv}
+	var listenerCerts []*certReloader
+	for _, l := range s.cfg.Listeners {
+		srv := s.newHTTPServer(l.Address)
+		switch {
+		case l.Plain:
+		case l.CertFile != "":
+			certs, err := newCertReloader(l.CertFile, l.KeyFile, s.logger)
+			if err != nil {
+				return fmt.Errorf("listener %s: %w", l.Address, err)
+			}
+			certs.watch(ctx, time.Duration(s.cfg.TLS.CertReloadSeconds)*time.Second)
+			listenerCerts = append(listenerCerts, certs)
+			srv.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+			if err := applyTLSPolicy(srv.TLSConfig, s.cfg.TLS); err != nil {
+				return err
+			}
+		case httpSrv.TLSConfig != nil:
+			srv.TLSConfig = httpSrv.TLSConfig.Clone()
+		}
+		s.logger.Info("starting extra listener", "listen", l.Address, "tls", srv.TLSConfig != nil)
+		servers = append(servers, srv)
+	}
+	s.listenerCerts.Store(&listenerCerts)
+	if s.admin != nil {
+		srv := s.newHTTPServer(s.cfg.Admin.Listen)
+		srv.Handler = s.admin
+		s.logger.Info("starting admin listener", "listen", s.cfg.Admin.Listen)
+		servers = append(servers, srv)
+	}
+
+	inherited, err := activationListeners()
+	if err != nil {
+		return err
+	}
+	return s.serveAll(ctx, servers, inherited)
+}
+
+// serverTimeout is the read and write timeout of the main listeners.
+// Streaming responses and client deadlines move it per request.
+const serverTimeout = 30 * time.Second
+
+// newHTTPServer returns a server for the main handler on addr.
+func (s *Server) newHTTPServer(addr string) *http.Server {
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      s.handler,
+		ReadTimeout:  serverTimeout,
+		WriteTimeout: serverTimeout,
+		IdleTimeout:  120 * time.Second,
+		// Stops reading oversized headers early (net/http allows some slack and
+		// answers 431 itself); headerLimitMiddleware enforces the exact limit.
+		// 0 keeps the 1 MB default
+		MaxHeaderBytes: s.cfg.Limits.MaxHeaderBytes,
+	}
+	if strings.EqualFold(s.cfg.Mode, "grpc") {
+		// gRPC clients speak h2c with prior knowledge on plain listeners;
+		// TLS listeners negotiate h2 through ALPN either way
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		srv.Protocols = &protocols
+	}
+	return srv
+}
+
+// serveAll binds every server before serving any, so a bad address fails
+// Start without leaving the others running. The inherited sockets, if any,
+// are used in order instead of binding. Servers with a TLS config serve TLS.
+// When ctx is done or any server fails, all of them are shut down; the first
+// failure is returned, or http.ErrServerClosed after a clean stop.
+func (s *Server) serveAll(ctx context.Context, servers []*http.Server, inherited []net.Listener) error {
+	for _, ln := range inherited[min(len(inherited), len(servers)):] {
+		s.logger.Warn("closing unused activation socket", "addr", ln.Addr().String())
+		ln.Close()
+	}
+	listeners := make([]net.Listener, 0, len(servers))
+	for i, srv := range servers {
+		if i < len(inherited) {
+			s.logger.Info("using activation socket", "listen", srv.Addr, "addr", inherited[i].Addr().String())
+			listeners = append(listeners, inherited[i])
+			continue
+		}
+		addr := srv.Addr
+		if addr == "" {
+			addr = ":http"
+			if srv.TLSConfig != nil {
+				addr = ":https"
+			}
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	errCh := make(chan error, len(servers))
+	for i, srv := range servers {
 		go func() {
-			<-ctx.Done()
-			shutdownWithLog(acmeSrv, s.logger)
+			if srv.TLSConfig != nil {
+				errCh <- srv.ServeTLS(listeners[i], "", "")
+				return
+			}
+			errCh <- srv.Serve(listeners[i])
 		}()
+	}
+
+	err := http.ErrServerClosed
+	select {
+	case <-ctx.Done():
+	case err = <-errCh:
+	}
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
 		go func() {
-			if err := acmeSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				s.logger.Error("acme http server error", "error", err)
-			}
+			defer wg.Done()
+			shutdownWithLog(srv, s.logger)
 		}()
 	}
+	wg.Wait()
+	return err
+}
+
+// startSocks5 opens the SOCKS5 listener and serves it in the background
+// until ctx is done.
+func (s *Server) startSocks5(ctx context.Context) error {
+	if s.pool == nil {
+		return errors.New("socks5 listener requires a proxy pool")
+	}
+	ln, err := net.Listen("tcp", s.cfg.Socks5.Listen)
+	if err != nil {
+		return fmt.Errorf("socks5 listen: %w", err)
+	}
+	s.logger.Info("starting socks5 server", "listen", s.cfg.Socks5.Listen)
+	srv := &socks5Server{
+		cfg:    s.cfg.Socks5,
+		dial:   s.pool.DialContext,
+		access: s.access,
+		logger: s.logger,
+	}
+	go srv.serve(ctx, ln)
+	return nil
+}
 
+// serveHTTP runs a plain HTTP server on addr in the background until ctx is done.
+func (s *Server) serveHTTP(ctx context.Context, name, addr string, handler http.Handler) {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
 	go func() {
 		<-ctx.Done()
-		shutdownWithLog(httpSrv, s.logger)
+		shutdownWithLog(srv, s.logger)
 	}()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.logger.Error(name+" server error", "error", err)
+		}
+	}()
+}
 
-	if s.cfg.TLS.HasCertificates() {
-		return httpSrv.ListenAndServeTLS(s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile)
-	}
-	if s.cfg.TLS.ACME.Enabled {
-		return httpSrv.ListenAndServeTLS("", "")
-	}
-	return httpSrv.ListenAndServe()
+func (s *Server) acmeHTTP01() bool {
+	return s.cfg.TLS.ACME.Enabled && !s.cfg.TLS.ACME.UsesDNS01()
 }
 
 func (s *Server) acmeManager() *autocert.Manager {
-	host := s.cfg.TLS.ACME.Domain
-	policy := autocert.HostWhitelist(host)
-	return &autocert.Manager{
+	policy := autocert.HostWhitelist(s.cfg.TLS.ACME.AllDomains()...)
+	m := &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: policy,
 		Cache:      autocert.DirCache(s.cfg.TLS.ACME.CacheDir),
 		Email:      s.cfg.TLS.ACME.Email,
 	}
+	if dir := s.cfg.TLS.ACME.Directory(); dir != "" {
+		m.Client = &acme.Client{DirectoryURL: dir}
+	}
+	return m
+}
+
+// checkCacheDir creates the ACME cache directory if needed and makes sure it
+// is writable. autocert only logs failed cache writes, so an unwritable cache
+// would re-issue certificates on every restart and run into CA rate limits.
+func checkCacheDir(dir string) error {
+	if dir == "" {
+		return errors.New("acme cache_dir must be set")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create acme cache_dir: %w", err)
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("acme cache_dir %q is not writable: %w", dir, err)
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// applyTLSPolicy sets the configured minimum version and cipher suites on the
+// listener's TLS config.
+func applyTLSPolicy(tlsCfg *tls.Config, tc config.TLSConfig) error {
+	minVersion, err := config.ParseTLSVersion(tc.MinVersion)
+	if err != nil {
+		return err
+	}
+	suites, err := config.ParseCipherSuites(tc.CipherSuites)
+	if err != nil {
+		return err
+	}
+	if minVersion != 0 {
+		tlsCfg.MinVersion = minVersion
+	}
+	if len(suites) > 0 {
+		tlsCfg.CipherSuites = suites
+	}
+	return nil
 }
 
 func (s *Server) acmeAddr() string {
-	addr := s.cfg.TLS.ACME.HTTP01Port
-	if addr == "" {
+	return portAddr(s.cfg.TLS.ACME.HTTP01Port)
+}
+
+func (s *Server) redirectAddr() string {
+	return portAddr(s.cfg.TLS.RedirectPort)
+}
+
+// portAddr turns a port such as "80" or ":80" into a listen address, defaulting to :80.
+func portAddr(port string) string {
+	if port == "" {
 		return ":80"
 	}
-	if strings.HasPrefix(addr, ":") {
-		return addr
+	if strings.HasPrefix(port, ":") {
+		return port
+	}
+	return ":" + port
+}
+
+// httpsRedirectHandler permanently redirects to the same host and path on the
+// TLS listener's port. An https external URL replaces the host and port, since
+// the public address may differ from the listener behind a load balancer.
+func httpsRedirectHandler(listen, externalURL string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(listen)
+	var externalHost string
+	if u, err := url.Parse(externalURL); err == nil && strings.EqualFold(u.Scheme, "https") {
+		externalHost = u.Host
 	}
-	return ":" + addr
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if externalHost != "" {
+			target := url.URL{Scheme: "https", Host: externalHost, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+	})
 }
 
 func chain(h http.Handler, m ...middleware) http.Handler {
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/proxy"
+)
+
+func TestApplyTLSPolicy(t *testing.T) {
+	tlsCfg := &tls.Config{NextProtos: []string{"h2"}}
+	err := applyTLSPolicy(tlsCfg, config.TLSConfig{
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	})
+	if err != nil {
+		t.Fatalf("applyTLSPolicy() error = %v", err)
+	}
+	if tlsCfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion = %#x, want %#x", tlsCfg.MinVersion, tls.VersionTLS12)
+	}
+	if len(tlsCfg.CipherSuites) != 1 || tlsCfg.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("CipherSuites = %v", tlsCfg.CipherSuites)
+	}
+	if len(tlsCfg.NextProtos) != 1 {
+		t.Error("existing settings should be preserved")
+	}
+
+	empty := &tls.Config{}
+	if err := applyTLSPolicy(empty, config.TLSConfig{}); err != nil {
+		t.Fatalf("applyTLSPolicy() error = %v", err)
+	}
+	if empty.MinVersion != 0 || empty.CipherSuites != nil {
+		t.Error("empty policy should keep Go defaults")
+	}
+}
+
+func TestAcmeManager_HostPolicy(t *testing.T) {
+	s := &Server{cfg: config.Config{TLS: config.TLSConfig{ACME: config.ACMEConfig{
+		Enabled:  true,
+		Domain:   "example.com",
+		Domains:  []string{"api.example.com"},
+		CacheDir: t.TempDir(),
+	}}}}
+	m := s.acmeManager()
+
+	for _, host := range []string{"example.com", "api.example.com"} {
+		if err := m.HostPolicy(context.Background(), host); err != nil {
+			t.Errorf("HostPolicy(%q) error = %v", host, err)
+		}
+	}
+	if err := m.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Error("HostPolicy should reject unlisted hosts")
+	}
+}
+
+func TestAcmeManager_Directory(t *testing.T) {
+	s := &Server{cfg: config.Config{TLS: config.TLSConfig{ACME: config.ACMEConfig{Domain: "example.com"}}}}
+	if m := s.acmeManager(); m.Client != nil {
+		t.Errorf("default Client = %+v, want nil for production", m.Client)
+	}
+
+	s.cfg.TLS.ACME.Staging = true
+	if m := s.acmeManager(); m.Client == nil || m.Client.DirectoryURL != config.LetsEncryptStagingURL {
+		t.Errorf("staging Client = %+v, want directory %s", m.Client, config.LetsEncryptStagingURL)
+	}
+}
+
+func TestCheckCacheDir(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := filepath.Join(root, "acme", "cache")
+	if err := checkCacheDir(missing); err != nil {
+		t.Fatalf("checkCacheDir(missing) error = %v", err)
+	}
+	if fi, err := os.Stat(missing); err != nil || !fi.IsDir() {
+		t.Errorf("cache dir was not created: %v", err)
+	}
+	if entries, _ := os.ReadDir(missing); len(entries) != 0 {
+		t.Errorf("write check left %d files behind", len(entries))
+	}
+
+	if err := checkCacheDir(filepath.Join(file, "cache")); err == nil {
+		t.Error("checkCacheDir() under a regular file should fail")
+	}
+	if err := checkCacheDir(""); err == nil {
+		t.Error("checkCacheDir(\"\") should fail")
+	}
+}
+
+func TestNew_ReadOnlyACMECache(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root ignores directory permissions")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0700)
+
+	cfg := config.DefaultConfig()
+	cfg.Target = "https://example.com"
+	cfg.TLS.ACME = config.ACMEConfig{Enabled: true, Domain: "example.com", CacheDir: dir}
+	if _, err := New(cfg, discardLogger(), http.NotFoundHandler(), nil); err == nil {
+		t.Fatal("New() should fail with a read-only ACME cache dir")
+	}
+
+	// Manual certificates take precedence, so the cache is not used
+	cfg.TLS.CertFile, cfg.TLS.KeyFile = "cert.pem", "key.pem"
+	if _, err := New(cfg, discardLogger(), http.NotFoundHandler(), nil); err != nil {
+		t.Errorf("New() with manual certificates error = %v", err)
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		listen   string
+		external string
+		target   string
+		host     string
+		want     string
+	}{
+		{name: "default port", listen: "0.0.0.0:443", target: "/path?q=1", host: "example.com", want: "https://example.com/path?q=1"},
+		{name: "strips http port", listen: ":443", target: "/", host: "example.com:80", want: "https://example.com/"},
+		{name: "custom tls port", listen: "0.0.0.0:8443", target: "/a/b", host: "example.com:8080", want: "https://example.com:8443/a/b"},
+		{name: "ipv6 host", listen: ":443", target: "/", host: "[::1]", want: "https://[::1]/"},
+		{name: "external url", listen: ":8443", external: "https://proxy.example.com", target: "/a?b=1", host: "10.0.0.5:8080", want: "https://proxy.example.com/a?b=1"},
+		{name: "http external url ignored", listen: ":8443", external: "http://proxy.example.com", target: "/", host: "example.com", want: "https://example.com:8443/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			httpsRedirectHandler(tt.listen, tt.external).ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusMovedPermanently {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusMovedPermanently)
+			}
+			if got := rec.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortAddr(t *testing.T) {
+	tests := map[string]string{"": ":80", "8080": ":8080", ":8081": ":8081"}
+	for in, want := range tests {
+		if got := portAddr(in); got != want {
+			t.Errorf("portAddr(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestServer_StreamsServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: first\n\n")
+		_ = http.NewResponseController(w).Flush()
+		// Hold the stream open until the client has seen the first event
+		<-release
+	}))
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL)
+	cfg := config.DefaultConfig()
+	cfg.Target = backend.URL
+	cfg.Streaming.FlushIntervalMs = 10000
+	srv, err := New(cfg, discardLogger(), proxy.NewReverseProxy(target, cfg, nil, discardLogger()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(srv.handler)
+	defer front.Close()
+	defer close(release)
+
+	// Headers are only sent on the first flush, so the request itself can block
+	line := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(front.URL + "/events")
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		l, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- l
+	}()
+	select {
+	case got := <-line:
+		if got != "data: first\n" {
+			t.Errorf("first line = %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was buffered instead of streamed")
+	}
+}
+
+func TestServer_StreamOutlivesWriteTimeout(t *testing.T) {
+	for _, contentType := range []string{"text/event-stream", "application/x-ndjson"} {
+		t.Run(contentType, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				for i := 0; i < 4; i++ {
+					_, _ = fmt.Fprintf(w, "data: %d\n\n", i)
+					_ = http.NewResponseController(w).Flush()
+					time.Sleep(150 * time.Millisecond)
+				}
+			}))
+			defer backend.Close()
+
+			target, _ := url.Parse(backend.URL)
+			cfg := config.DefaultConfig()
+			cfg.Target = backend.URL
+			srv, err := New(cfg, discardLogger(), proxy.NewReverseProxy(target, cfg, nil, discardLogger()), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			front := httptest.NewUnstartedServer(srv.handler)
+			front.Config.ReadTimeout = 200 * time.Millisecond
+			front.Config.WriteTimeout = 200 * time.Millisecond
+			front.Start()
+			defer front.Close()
+
+			resp, err := http.Get(front.URL + "/events")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil || !strings.Contains(string(body), "data: 3") {
+				t.Errorf("stream cut off after %q: %v", body, err)
+			}
+		})
+	}
+}
+
+func TestServer_GRPCMode(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		_, _ = io.WriteString(w, r.Proto)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	backend.Config.Protocols = &h2c
+	backend.Start()
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL)
+	cfg := config.DefaultConfig()
+	cfg.Mode = "grpc"
+	cfg.Target = backend.URL
+	cfg.Proxy.Transport.HTTP2Only = true
+	pool, err := proxy.NewProxyPool(cfg.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(cfg, discardLogger(), proxy.NewReverseProxy(target, cfg, pool, discardLogger()), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewUnstartedServer(srv.handler)
+	front.Config = srv.newHTTPServer("")
+	front.Start()
+	defer front.Close()
+
+	client := &http.Client{Transport: &http.Transport{Protocols: &h2c}}
+	req, _ := http.NewRequest(http.MethodPost, front.URL+"/pkg.Service/Method", strings.NewReader("request"))
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("h2c request error = %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+		t.Errorf("client proto = %s, backend proto = %q; want HTTP/2 on both legs", resp.Proto, body)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", got)
+	}
+}
+
+// freeAddr returns a loopback address with a port that was free a moment ago.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestServer_MultipleListeners(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Target = "https://example.com"
+	cfg.Listen = freeAddr(t)
+	extra := freeAddr(t)
+	cfg.Listeners = []config.ListenerConfig{{Address: extra}}
+	cfg.Admin.Listen = freeAddr(t)
+	srv := newTestServer(t, cfg, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Start(ctx) }()
+
+	for _, addr := range []string{cfg.Listen, extra, cfg.Admin.Listen} {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Get("http://" + addr + "/healthz"); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("GET %s: %v", addr, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s status = %d, want 200", addr, resp.StatusCode)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != http.ErrServerClosed {
+			t.Errorf("Start() error = %v, want http.ErrServerClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start() did not return after cancel")
+	}
+}
+
+func TestServer_ListenerBindError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.Target = "https://example.com"
+	cfg.Listen = freeAddr(t)
+	cfg.Listeners = []config.ListenerConfig{{Address: busy.Addr().String()}}
+	cfg.Admin.Listen = ""
+	srv := newTestServer(t, cfg, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := srv.Start(ctx); err == nil || err == http.ErrServerClosed {
+		t.Fatalf("Start() error = %v, want bind error", err)
+	}
+	// The main listener must not be left running
+	if conn, err := net.Dial("tcp", cfg.Listen); err == nil {
+		conn.Close()
+		t.Error("main listener still accepting after a failed start")
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/proxy"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socks5Version        = 0x05
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5AuthNoMatch    = 0xff
+	socks5PasswordVer    = 0x01
+	socks5CmdConnect     = 0x01
+	socks5AtypIPv4       = 0x01
+	socks5AtypDomain     = 0x03
+	socks5AtypIPv6       = 0x04
+	socks5ReplySuccess   = 0x00
+	socks5ReplyFailure   = 0x01
+	socks5ReplyNotAllow  = 0x02
+	socks5ReplyCmdUnsup  = 0x07
+	socks5ReplyAtypUnsup = 0x08
+
+	socks5HandshakeTimeout = 30 * time.Second
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// socks5Server accepts SOCKS5 CONNECT requests and dials the destination
+// through dial, which is normally the proxy pool.
+type socks5Server struct {
+	cfg    config.Socks5Config
+	dial   dialFunc
+	access *AccessControl
+	logger *slog.Logger
+}
+
+// serve accepts connections until ctx is done.
+func (s *socks5Server) serve(ctx context.Context, ln net.Listener) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Error("socks5 accept failed", "error", err)
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+func (s *socks5Server) handle(ctx context.Context, conn net.Conn) {
+	client := remoteIP(conn.RemoteAddr())
+	if s.access != nil && !s.access.Allowed(client) {
+		conn.Close()
+		return
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	br := bufio.NewReader(conn)
+	addr, err := s.handshake(br, conn)
+	if err != nil {
+		s.logger.Debug("socks5 handshake failed", "client", client.String(), "error", err)
+		conn.Close()
+		return
+	}
+
+	upstream, err := s.dial(ctx, "tcp", addr)
+	if err != nil {
+		reply := byte(socks5ReplyFailure)
+		if errors.Is(err, proxy.ErrBlockedTarget) {
+			reply = socks5ReplyNotAllow
+		}
+		s.logger.Error("socks5 dial failed", "client", client.String(), "target", addr, "error", err)
+		_ = writeSocks5Reply(conn, reply)
+		conn.Close()
+		return
+	}
+	if err := writeSocks5Reply(conn, socks5ReplySuccess); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if n := br.Buffered(); n > 0 {
+		pending, _ := br.Peek(n)
+		if _, err := upstream.Write(pending); err != nil {
+			conn.Close()
+			upstream.Close()
+			return
+		}
+	}
+	tunnel(conn, upstream)
+}
+
+// handshake negotiates authentication and reads the CONNECT request,
+// returning the requested host:port.
+func (s *socks5Server) handshake(r io.Reader, w io.Writer) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+
+	want := byte(socks5AuthNone)
+	if s.cfg.Username != "" {
+		want = socks5AuthPassword
+	}
+	if !slices.Contains(methods, want) {
+		_, _ = w.Write([]byte{socks5Version, socks5AuthNoMatch})
+		return "", errors.New("no acceptable auth method")
+	}
+	if _, err := w.Write([]byte{socks5Version, want}); err != nil {
+		return "", err
+	}
+	if want == socks5AuthPassword {
+		if err := s.authenticate(r, w); err != nil {
+			return "", err
+		}
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socks5Version {
+		return "", fmt.Errorf("unsupported version %d", req[0])
+	}
+
+	var host string
+	switch req[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		_ = writeSocks5Reply(w, socks5ReplyAtypUnsup)
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+
+	if req[1] != socks5CmdConnect {
+		_ = writeSocks5Reply(w, socks5ReplyCmdUnsup)
+		return "", fmt.Errorf("unsupported command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// authenticate runs the RFC 1929 username/password sub-negotiation.
+func (s *socks5Server) authenticate(r io.Reader, w io.Writer) error {
+	var ver [1]byte
+	if _, err := io.ReadFull(r, ver[:]); err != nil {
+		return err
+	}
+	if ver[0] != socks5PasswordVer {
+		return fmt.Errorf("unsupported auth version %d", ver[0])
+	}
+	user, err := readSocks5String(r)
+	if err != nil {
+		return err
+	}
+	pass, err := readSocks5String(r)
+	if err != nil {
+		return err
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.cfg.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.cfg.Password)) == 1
+	if !userOK || !passOK {
+		_, _ = w.Write([]byte{socks5PasswordVer, socks5ReplyNotAllow})
+		return errors.New("invalid credentials")
+	}
+	_, err = w.Write([]byte{socks5PasswordVer, socks5ReplySuccess})
+	return err
+}
+
+func readSocks5String(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// writeSocks5Reply sends a reply with an unspecified bound address; the real
+// one belongs to the upstream proxy and is not known here.
+func writeSocks5Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socks5Version, code, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return parseIP(host)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	xproxy "golang.org/x/net/proxy"
+
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/proxy"
+)
+
+func TestSocks5Server(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	pool, err := proxy.NewProxyPool(config.ProxyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     config.Socks5Config
+		block   []string
+		auth    *xproxy.Auth
+		target  string
+		wantErr bool
+	}{
+		{name: "no auth", target: echo.Addr().String()},
+		{name: "domain target", target: "localhost:" + portOf(t, echo.Addr())},
+		{name: "password auth", cfg: config.Socks5Config{Username: "alice", Password: "secret"}, auth: &xproxy.Auth{User: "alice", Password: "secret"}, target: echo.Addr().String()},
+		{name: "wrong password", cfg: config.Socks5Config{Username: "alice", Password: "secret"}, auth: &xproxy.Auth{User: "alice", Password: "nope"}, target: echo.Addr().String(), wantErr: true},
+		{name: "auth required", cfg: config.Socks5Config{Username: "alice", Password: "secret"}, target: echo.Addr().String(), wantErr: true},
+		{name: "blocked client", block: []string{"127.0.0.0/8"}, target: echo.Addr().String(), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac, err := NewAccessControl(config.AccessConfig{BlockCIDRs: tt.block})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			srv := &socks5Server{cfg: tt.cfg, dial: pool.DialContext, access: ac, logger: discardLogger()}
+			go srv.serve(ctx, ln)
+
+			dialer, err := xproxy.SOCKS5("tcp", ln.Addr().String(), tt.auth, xproxy.Direct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dialer.Dial("tcp", tt.target)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("Dial() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "ping" {
+				t.Errorf("echo = %q, want ping", got)
+			}
+		})
+	}
+}
+
+func portOf(t *testing.T, addr net.Addr) string {
+	t.Helper()
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/buildinfo"
+	"github.com/foxzi/SockStream/internal/proxy"
+)
+
+type statusResponse struct {
+	Status string `json:"status"`
+	poolStatus
+	// Pools reports the named pools of proxy.pools
+	Pools map[string]poolStatus `json:"pools,omitempty"`
+}
+
+type poolStatus struct {
+	Degraded bool                `json:"degraded"`
+	Total    int                 `json:"total"`
+	Healthy  int                 `json:"healthy"`
+	Proxies  []proxy.ProxyStatus `json:"proxies"`
+}
+
+// newPoolStatus summarizes pool, which may be nil.
+func newPoolStatus(pool *proxy.ProxyPool) poolStatus {
+	st := poolStatus{Proxies: []proxy.ProxyStatus{}}
+	if pool == nil {
+		return st
+	}
+	st.Degraded = pool.Degraded()
+	st.Total = pool.Size()
+	st.Healthy = pool.HealthyCount()
+	if statuses := pool.GetStatus(); statuses != nil {
+		st.Proxies = statuses
+	}
+	return st
+}
+
+// registerHealth adds the liveness and readiness endpoints to mux.
+func registerHealth(mux *http.ServeMux, pool *proxy.ProxyPool) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", readyHandler(pool))
+}
+
+// readyHandler answers 503 while the pool, or any of its named pools, has
+// no healthy proxy.
+func readyHandler(pool *proxy.ProxyPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if pool != nil && pool.HealthyCount() == 0 {
+			http.Error(w, "no healthy proxies", http.StatusServiceUnavailable)
+			return
+		}
+		if pool != nil {
+			pools := pool.Pools()
+			for _, name := range slices.Sorted(maps.Keys(pools)) {
+				if pools[name].HealthyCount() == 0 {
+					http.Error(w, "no healthy proxies in pool "+name, http.StatusServiceUnavailable)
+					return
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}
+}
+
+func statusHandler(pool *proxy.ProxyPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := statusResponse{Status: "ok", poolStatus: newPoolStatus(pool)}
+		degraded := resp.Degraded
+		if pool != nil {
+			for name, sub := range pool.Pools() {
+				if resp.Pools == nil {
+					resp.Pools = make(map[string]poolStatus)
+				}
+				resp.Pools[name] = newPoolStatus(sub)
+				degraded = degraded || resp.Pools[name].Degraded
+			}
+		}
+		if degraded {
+			resp.Status = "degraded"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+type versionResponse struct {
+	buildinfo.Info
+	UptimeSeconds int64 `json:"uptime_seconds"`
+}
+
+// versionHandler reports the build and the time since started.
+func versionHandler(started time.Time) http.HandlerFunc {
+	info := buildinfo.Get()
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(versionResponse{
+			Info:          info,
+			UptimeSeconds: int64(time.Since(started).Seconds()),
+		})
+	}
+}
+
+func metricsHandler(pool *proxy.ProxyPool, limiter *concurrencyLimiter, tags *tagger, traffic *trafficCounter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeGauge(w, "sockstream_requests_in_flight", "Number of requests currently being proxied.", limiter.InFlight())
+		writeGauge(w, "sockstream_requests_queued", "Number of requests waiting for a concurrency slot.", limiter.Queued())
+		writeQueueWait(w, limiter)
+		traffic.writeMetrics(w)
+		tags.writeMetrics(w)
+		if pool == nil {
+			return
+		}
+		writeGauge(w, "sockstream_proxies_total", "Number of proxies in the pool.", pool.Size())
+		writeGauge(w, "sockstream_proxies_healthy", "Number of healthy proxies in the pool.", pool.HealthyCount())
+		writeGauge(w, "sockstream_proxy_pool_degraded", "Whether the proxy pool is degraded (1) or not (0).", boolToInt(pool.Degraded()))
+		pools := pool.Pools()
+		if len(pools) > 0 {
+			writePoolGauges(w, pools)
+		}
+		statuses := poolProxyStatuses("", pool.GetStatus())
+		for _, name := range slices.Sorted(maps.Keys(pools)) {
+			statuses = append(statuses, poolProxyStatuses(name, pools[name].GetStatus())...)
+		}
+		writeProxyLatency(w, statuses)
+		writeProxyTraffic(w, statuses)
+		writeRetryBudget(w, pool)
+	}
+}
+
+// writePoolGauges exports the size, health and degraded flag of each named pool.
+func writePoolGauges(w io.Writer, pools map[string]*proxy.ProxyPool) {
+	names := slices.Sorted(maps.Keys(pools))
+	for _, m := range []struct {
+		name, help string
+		value      func(*proxy.ProxyPool) int
+	}{
+		{"sockstream_pool_proxies_total", "Number of proxies in each named pool.", (*proxy.ProxyPool).Size},
+		{"sockstream_pool_proxies_healthy", "Number of healthy proxies in each named pool.", (*proxy.ProxyPool).HealthyCount},
+		{"sockstream_pool_degraded", "Whether each named pool is degraded (1) or not (0).", func(p *proxy.ProxyPool) int { return boolToInt(p.Degraded()) }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{pool=%q} %d\n", m.name, name, m.value(pools[name]))
+		}
+	}
+}
+
+// poolProxyStatus is the status of a proxy in the named pool, or in the
+// default pool when pool is empty. The same address may be in several pools.
+type poolProxyStatus struct {
+	pool string
+	proxy.ProxyStatus
+}
+
+func poolProxyStatuses(pool string, statuses []proxy.ProxyStatus) []poolProxyStatus {
+	out := make([]poolProxyStatus, len(statuses))
+	for i, st := range statuses {
+		out[i] = poolProxyStatus{pool: pool, ProxyStatus: st}
+	}
+	return out
+}
+
+// writeProxyLatency exports recent response time quantiles for each proxy.
+func writeProxyLatency(w io.Writer, statuses []poolProxyStatus) {
+	const name = "sockstream_proxy_latency_seconds"
+	fmt.Fprintf(w, "# HELP %s Recent response time of each proxy.\n# TYPE %s gauge\n", name, name)
+	for _, st := range statuses {
+		if st.Latency == nil {
+			continue
+		}
+		quantiles := []struct {
+			q  string
+			ms float64
+		}{{"0.5", st.Latency.P50}, {"0.95", st.Latency.P95}, {"0.99", st.Latency.P99}}
+		for _, q := range quantiles {
+			fmt.Fprintf(w, "%s{pool=%q,proxy=%q,quantile=%q} %g\n", name, st.pool, st.Address, q.q, q.ms/1000)
+		}
+	}
+}
+
+// writeProxyTraffic exports the body bytes sent and received through each proxy.
+func writeProxyTraffic(w io.Writer, statuses []poolProxyStatus) {
+	for _, m := range []struct {
+		name, help string
+		value      func(proxy.ProxyStatus) int64
+	}{
+		{"sockstream_proxy_sent_bytes_total", "Request body bytes sent through each proxy.", func(st proxy.ProxyStatus) int64 { return st.BytesSent }},
+		{"sockstream_proxy_received_bytes_total", "Response body bytes received through each proxy.", func(st proxy.ProxyStatus) int64 { return st.BytesReceived }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		for _, st := range statuses {
+			fmt.Fprintf(w, "%s{pool=%q,proxy=%q} %d\n", m.name, st.pool, st.Address, m.value(st.ProxyStatus))
+		}
+	}
+}
+
+// writeQueueWait exports the time requests spent waiting for a concurrency slot.
+func writeQueueWait(w io.Writer, limiter *concurrencyLimiter) {
+	const name = "sockstream_queue_wait_seconds"
+	count, total := limiter.QueueWait()
+	fmt.Fprintf(w, "# HELP %s Time requests waited for a concurrency slot.\n# TYPE %s summary\n", name, name)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, total.Seconds(), name, count)
+}
+
+// writeRetryBudget exports the retry budget window when one is configured.
+func writeRetryBudget(w io.Writer, pool *proxy.ProxyPool) {
+	status, ok := pool.RetryBudget()
+	if !ok {
+		return
+	}
+	writeGauge(w, "sockstream_retry_budget_requests", "Requests counted in the retry budget window.", status.Requests)
+	writeGauge(w, "sockstream_retry_budget_retries", "Retries made in the retry budget window.", status.Retries)
+	const name = "sockstream_retry_budget_exhausted_total"
+	fmt.Fprintf(w, "# HELP %s Retries refused because the budget was spent.\n# TYPE %s counter\n%s %d\n", name, name, name, status.Exhausted)
+}
+
+// degradedMiddleware adds the configured header to responses while the pool is degraded.
+func degradedMiddleware(pool *proxy.ProxyPool, header string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if pool != nil && header != "" && pool.Degraded() {
+				w.Header().Set(header, "true")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/buildinfo"
+	"github.com/foxzi/SockStream/internal/config"
+	"github.com/foxzi/SockStream/internal/proxy"
+)
+
+func newTestServer(t *testing.T, cfg config.Config, pool *proxy.ProxyPool) *Server {
+	t.Helper()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	srv, err := New(cfg, discardLogger(), next, pool)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return srv
+}
+
+// newDeadPool returns a pool whose proxies all point at a closed local port,
+// with the initial health check already applied.
+func newDeadPool(t *testing.T, cfg config.ProxyConfig) *proxy.ProxyPool {
+	t.Helper()
+	pool, err := proxy.NewProxyPool(cfg)
+	if err != nil {
+		t.Fatalf("NewProxyPool() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	pool.StartHealthCheck(ctx)
+	return pool
+}
+
+func TestStatusEndpoints_Healthy(t *testing.T) {
+	cfg := config.DefaultConfig()
+	pool, err := proxy.NewProxyPool(cfg.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, cfg, pool)
+
+	rec := httptest.NewRecorder()
+	srv.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status statusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if status.Degraded || status.Status != "ok" {
+		t.Errorf("status = %+v, want ok and not degraded", status)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/readyz status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	srv := newTestServer(t, config.DefaultConfig(), nil)
+
+	rec := httptest.NewRecorder()
+	srv.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/version status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode version: %v", err)
+	}
+	if got["version"] != buildinfo.Version || got["go_version"] != runtime.Version() {
+		t.Errorf("version = %v, go_version = %v", got["version"], got["go_version"])
+	}
+	if _, ok := got["uptime_seconds"].(float64); !ok {
+		t.Errorf("uptime_seconds = %v, want a number", got["uptime_seconds"])
+	}
+
+	// Like /status, it is not served next to proxied traffic
+	rec = httptest.NewRecorder()
+	srv.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if strings.Contains(rec.Body.String(), "go_version") {
+		t.Error("/version answered on the main listener while the admin listener is enabled")
+	}
+}
+
+func TestStatusEndpoints_Degraded(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Proxy.URLs = []string{"http://127.0.0.1:1", "http://127.0.0.1:2"}
+	cfg.Proxy.DegradedPercent = 50
+	cfg.Proxy.DegradedHeader = "X-Sockstream-Degraded"
+	pool := newDeadPool(t, cfg.Proxy)
+	srv := newTestServer(t, cfg, pool)
+
+	rec := httptest.NewRecorder()
+	srv.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status statusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if !status.Degraded || status.Status != "degraded" {
+		t.Errorf("status = %+v, want degraded", status)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "sockstream_proxy_pool_degraded 1") {
+		t.Errorf("/metrics missing degraded gauge:\n%s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	srv.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/anything", nil))
+	if got := rec.Header().Get("X-Sockstream-Degraded"); got != "true" {
+		t.Errorf("degraded header = %q, want %q", got, "true")
+	}
+}
+
+func TestStatusEndpoints_NamedPools(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Proxy.Pools = map[string]config.ProxyConfig{
+		"dead": {URLs: []string{"http://127.0.0.1:1"}},
+	}
+	cfg.Proxy.Routes = []config.ProxyRoute{{Hosts: []string{".dead.example"}, Pool: "dead"}}
+	pool := newDeadPool(t, cfg.Proxy)
+	srv := newTestServer(t, cfg, pool)
+
+	rec := httptest.NewRecorder()
+	srv.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status statusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	dead, ok := status.Pools["dead"]
+	if !ok || dead.Total != 1 || dead.Healthy != 0 || len(dead.Proxies) != 1 {
+		t.Errorf("status pools = %+v, want dead with 1 unhealthy proxy", status.Pools)
+	}
+	if status.Total != 1 || status.Healthy != 1 {
+		t.Errorf("status = %+v, want the direct default pool", status)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "pool dead") {
+		t.Errorf("/readyz = %d %q, want 503 naming the pool", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	srv.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `sockstream_pool_proxies_healthy{pool="dead"} 0`) ||
+		!strings.Contains(body, `sockstream_proxy_sent_bytes_total{pool="dead",proxy="http://127.0.0.1:1"} 0`) {
+		t.Errorf("/metrics missing named pool series:\n%s", body)
+	}
+}
+
+func TestWriteProxyLatency(t *testing.T) {
+	var out strings.Builder
+	writeProxyLatency(&out, append(poolProxyStatuses("", []proxy.ProxyStatus{
+		{Address: "socks5://a:1080", Latency: &proxy.LatencyStats{P50: 12, P95: 80, P99: 150, Samples: 10}},
+		{Address: "socks5://b:1080"},
+	}), poolProxyStatuses("eu", []proxy.ProxyStatus{
+		{Address: "socks5://a:1080", Latency: &proxy.LatencyStats{P50: 20, P95: 90, P99: 200, Samples: 10}},
+	})...))
+
+	got := out.String()
+	for _, want := range []string{
+		`sockstream_proxy_latency_seconds{pool="",proxy="socks5://a:1080",quantile="0.5"} 0.012`,
+		`sockstream_proxy_latency_seconds{pool="",proxy="socks5://a:1080",quantile="0.99"} 0.15`,
+		`sockstream_proxy_latency_seconds{pool="eu",proxy="socks5://a:1080",quantile="0.5"} 0.02`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "b:1080") {
+		t.Error("proxies without samples should be skipped")
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+type tagKey struct{}
+
+// requestTag returns the tag taggingMiddleware attached to r, or "".
+func requestTag(r *http.Request) string {
+	tag, _ := r.Context().Value(tagKey{}).(string)
+	return tag
+}
+
+// tagger assigns each request one of a fixed set of tags and counts
+// completed requests per tag and status class.
+type tagger struct {
+	header string
+	values map[string]string
+	nets   []taggedNet
+	def    string
+	// names lists every tag that can be assigned, sorted, for metrics
+	names  []string
+	counts map[string]*[5]atomic.Uint64
+}
+
+type taggedNet struct {
+	net *net.IPNet
+	tag string
+}
+
+// newTagger returns nil when no tags are configured.
+func newTagger(cfg config.TaggingConfig) (*tagger, error) {
+	if len(cfg.Tags) == 0 && cfg.Default == "" {
+		return nil, nil
+	}
+	t := &tagger{
+		header: cfg.Header,
+		values: make(map[string]string),
+		def:    cfg.Default,
+		counts: make(map[string]*[5]atomic.Uint64),
+	}
+	for name, rule := range cfg.Tags {
+		for _, v := range rule.HeaderValues {
+			t.values[v] = name
+		}
+		nets, err := parseCIDRs("tagging", trimAll(rule.CIDRs))
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nets {
+			t.nets = append(t.nets, taggedNet{net: n, tag: name})
+		}
+		t.counts[name] = new([5]atomic.Uint64)
+	}
+	if t.def != "" && t.counts[t.def] == nil {
+		t.counts[t.def] = new([5]atomic.Uint64)
+	}
+	for name := range t.counts {
+		t.names = append(t.names, name)
+	}
+	slices.Sort(t.names)
+	// The most specific subnet wins when several overlap
+	slices.SortStableFunc(t.nets, func(a, b taggedNet) int {
+		ao, _ := a.net.Mask.Size()
+		bo, _ := b.net.Mask.Size()
+		return bo - ao
+	})
+	return t, nil
+}
+
+func trimAll(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = strings.TrimSpace(s)
+	}
+	return out
+}
+
+// tag picks the tag for r: a listed header value first, then the client
+// subnet, then the default.
+func (t *tagger) tag(r *http.Request) string {
+	if t.header != "" {
+		if tag, ok := t.values[r.Header.Get(t.header)]; ok {
+			return tag
+		}
+	}
+	if ip := clientIP(r); ip != nil {
+		for _, n := range t.nets {
+			if n.net.Contains(ip) {
+				return n.tag
+			}
+		}
+	}
+	return t.def
+}
+
+func (t *tagger) observe(tag string, status int) {
+	counts, ok := t.counts[tag]
+	if !ok {
+		return
+	}
+	class := status/100 - 1
+	if class < 0 || class >= len(counts) {
+		return
+	}
+	counts[class].Add(1)
+}
+
+// writeMetrics exports the per-tag request counters.
+func (t *tagger) writeMetrics(w io.Writer) {
+	if t == nil {
+		return
+	}
+	const name = "sockstream_tagged_requests_total"
+	fmt.Fprintf(w, "# HELP %s Requests completed, by tag and status class.\n# TYPE %s counter\n", name, name)
+	for _, tag := range t.names {
+		counts := t.counts[tag]
+		for i := range counts {
+			fmt.Fprintf(w, "%s{tag=%q,code=\"%dxx\"} %d\n", name, tag, i+1, counts[i].Load())
+		}
+	}
+}
+
+// taggingMiddleware attaches the request's tag to its context, where the
+// access log picks it up, and counts the response under it.
+func taggingMiddleware(t *tagger) middleware {
+	return func(next http.Handler) http.Handler {
+		if t == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tag := t.tag(r)
+			if tag == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			r = r.WithContext(context.WithValue(r.Context(), tagKey{}, tag))
+			next.ServeHTTP(rec, r)
+			t.observe(tag, rec.result(r))
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func testTaggingConfig() config.TaggingConfig {
+	return config.TaggingConfig{
+		Header: "X-Tenant",
+		Tags: map[string]config.TagRule{
+			"acme":   {HeaderValues: []string{"acme", "acme-corp"}, CIDRs: []string{"10.0.0.0/8"}},
+			"globex": {CIDRs: []string{"10.2.0.0/16"}},
+		},
+		Default: "other",
+	}
+}
+
+func TestTagger(t *testing.T) {
+	tg, err := newTagger(testTaggingConfig())
+	if err != nil {
+		t.Fatalf("newTagger() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		header string
+		want   string
+	}{
+		{name: "header value", remote: "192.0.2.1:1234", header: "acme-corp", want: "acme"},
+		{name: "header wins over subnet", remote: "10.2.0.1:1234", header: "acme", want: "acme"},
+		{name: "most specific subnet", remote: "10.2.0.1:1234", want: "globex"},
+		{name: "wider subnet", remote: "10.3.0.1:1234", want: "acme"},
+		{name: "unlisted header value", remote: "192.0.2.1:1234", header: "initech", want: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.header != "" {
+				r.Header.Set("X-Tenant", tt.header)
+			}
+			if got := tg.tag(r); got != tt.want {
+				t.Errorf("tag() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if tg, err := newTagger(config.TaggingConfig{}); tg != nil || err != nil {
+		t.Errorf("newTagger(empty) = %v, %v; want nil, nil", tg, err)
+	}
+}
+
+func TestTaggingMiddleware(t *testing.T) {
+	tg, err := newTagger(testTaggingConfig())
+	if err != nil {
+		t.Fatalf("newTagger() error = %v", err)
+	}
+	var out bytes.Buffer
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	h := chain(next,
+		taggingMiddleware(tg),
+		loggingMiddleware(slog.New(slog.NewTextHandler(&out, nil)), config.Logging{}),
+	)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Tenant", "acme")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if !strings.Contains(out.String(), "tag=acme") {
+		t.Errorf("log = %q, want tag=acme", out.String())
+	}
+	var metrics bytes.Buffer
+	tg.writeMetrics(&metrics)
+	for _, want := range []string{
+		`sockstream_tagged_requests_total{tag="acme",code="4xx"} 1`,
+		`sockstream_tagged_requests_total{tag="globex",code="4xx"} 0`,
+		`sockstream_tagged_requests_total{tag="other",code="2xx"} 0`,
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, metrics.String())
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/errorpage"
+)
+
+// TimeoutHeader carries a client's deadline for its request, as a Go duration
+// ("30s", "1500ms") or whole seconds, when limits.max_client_timeout_seconds
+// is set. It is removed before forwarding.
+const TimeoutHeader = "X-Sockstream-Timeout"
+
+// parseClientTimeout parses a TimeoutHeader value.
+func parseClientTimeout(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, serr := strconv.Atoi(v)
+		if serr != nil {
+			return 0, err
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout %q must be positive", v)
+	}
+	return d, nil
+}
+
+// clientTimeoutGrace is how long the connection outlives a client's
+// deadline, so the 504 sent when it passes still reaches the client.
+const clientTimeoutGrace = 5 * time.Second
+
+// clientTimeoutMiddleware applies the deadline a client asks for with
+// TimeoutHeader, answering 400 when it is invalid or over max. The server's
+// read and write timeouts are moved to match, as they may be shorter.
+func clientTimeoutMiddleware(max time.Duration, pages *errorpage.Pages) middleware {
+	return func(next http.Handler) http.Handler {
+		if max <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			v := r.Header.Get(TimeoutHeader)
+			if v == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			d, err := parseClientTimeout(v)
+			if err != nil {
+				pages.Error(w, r, "invalid "+TimeoutHeader, http.StatusBadRequest)
+				return
+			}
+			if d > max {
+				pages.Error(w, r, fmt.Sprintf("%s exceeds the maximum of %s", TimeoutHeader, max), http.StatusBadRequest)
+				return
+			}
+			rc := http.NewResponseController(w)
+			_ = rc.SetReadDeadline(time.Now().Add(d + clientTimeoutGrace))
+			_ = rc.SetWriteDeadline(time.Now().Add(d + clientTimeoutGrace))
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			r = r.WithContext(ctx)
+			r.Header.Del(TimeoutHeader)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
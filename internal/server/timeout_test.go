@@ -0,0 +1,106 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestClientTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		max        int
+		header     string
+		wantStatus int
+		// wantDeadline is the deadline the backend should see, 0 for none
+		wantDeadline time.Duration
+	}{
+		{name: "no header", max: 60, wantStatus: http.StatusOK},
+		{name: "duration", max: 60, header: "30s", wantStatus: http.StatusOK, wantDeadline: 30 * time.Second},
+		{name: "bare seconds", max: 60, header: "5", wantStatus: http.StatusOK, wantDeadline: 5 * time.Second},
+		{name: "at max", max: 60, header: "1m", wantStatus: http.StatusOK, wantDeadline: time.Minute},
+		{name: "over max", max: 60, header: "61s", wantStatus: http.StatusBadRequest},
+		{name: "invalid", max: 60, header: "soon", wantStatus: http.StatusBadRequest},
+		{name: "zero", max: 60, header: "0s", wantStatus: http.StatusBadRequest},
+		{name: "negative", max: 60, header: "-5s", wantStatus: http.StatusBadRequest},
+		{name: "disabled ignores header", max: 0, header: "soon", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.Limits.MaxClientTimeoutSeconds = tt.max
+			var (
+				remaining   time.Duration
+				hasDeadline bool
+				forwarded   string
+			)
+			backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var deadline time.Time
+				deadline, hasDeadline = r.Context().Deadline()
+				remaining = time.Until(deadline)
+				forwarded = r.Header.Get(TimeoutHeader)
+			})
+			srv, err := New(cfg, discardLogger(), backend, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(TimeoutHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			srv.handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if tt.wantDeadline == 0 {
+				if hasDeadline {
+					t.Errorf("backend saw a deadline %v away", remaining)
+				}
+				return
+			}
+			if !hasDeadline {
+				t.Fatal("backend saw no deadline")
+			}
+			if remaining < tt.wantDeadline-time.Second || remaining > tt.wantDeadline {
+				t.Errorf("deadline in %v, want about %v", remaining, tt.wantDeadline)
+			}
+			if forwarded != "" {
+				t.Errorf("%s forwarded as %q", TimeoutHeader, forwarded)
+			}
+		})
+	}
+}
+
+func TestClientTimeout_ExtendsServerDeadlines(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	})
+	backend := httptest.NewUnstartedServer(clientTimeoutMiddleware(time.Minute, nil)(slow))
+	backend.Config.WriteTimeout = 100 * time.Millisecond
+	backend.Start()
+	defer backend.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+	req.Header.Set(TimeoutHeader, "2s")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request with a deadline past the write timeout failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "done" {
+		t.Errorf("body = %q, want %q", body, "done")
+	}
+}
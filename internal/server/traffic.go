@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// trafficCounter totals the request and response body bytes of proxied
+// requests.
+type trafficCounter struct {
+	in  atomic.Int64
+	out atomic.Int64
+}
+
+func (t *trafficCounter) writeMetrics(w io.Writer) {
+	for _, m := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"sockstream_request_bytes_total", "Request body bytes received from clients.", t.in.Load()},
+		{"sockstream_response_bytes_total", "Response body bytes sent to clients.", t.out.Load()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+	}
+}
+
+// trafficMiddleware adds the body bytes of each request and its response
+// to t. Hijacked connections, such as WebSocket upgrades, are not counted.
+func trafficMiddleware(t *trafficCounter) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := countBody(r)
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			t.in.Add(body.count())
+			t.out.Add(rec.bytes)
+		})
+	}
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+// countBody replaces r.Body with a countingBody. The result is nil, and
+// counts 0, when there is no body.
+func countBody(r *http.Request) *countingBody {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	b := &countingBody{ReadCloser: r.Body}
+	r.Body = b
+	return b
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) count() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.n
+}
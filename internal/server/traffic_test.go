@@ -0,0 +1,56 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foxzi/SockStream/internal/config"
+)
+
+func TestMetrics_Traffic(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, "hello world")
+	})
+	srv, err := New(config.DefaultConfig(), discardLogger(), backend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("12345"))
+		srv.handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// Service endpoints are not proxied traffic
+	srv.handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	rec := httptest.NewRecorder()
+	srv.admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{"sockstream_request_bytes_total 10\n", "sockstream_response_bytes_total 22\n"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics missing %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+func TestLoggingMiddleware_Bytes(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, nil))
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, "abc")
+	})
+	h := loggingMiddleware(logger, config.Logging{})(next)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("1234567")))
+
+	for _, want := range []string{"bytes_in=7", "bytes_out=3"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log = %q, want %s", out.String(), want)
+		}
+	}
+}